@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// cartActivityKey is a sorted set of cart keys scored by the unix time of
+	// their last change. Only carts with items are tracked.
+	cartActivityKey       = "carts:activity"
+	abandonmentMetricsKey = "carts:abandonment:metrics"
+
+	EventCartAbandoned = "CartAbandoned"
+)
+
+var ErrInvalidRecoveryToken = errors.New("recovery link is invalid or has expired")
+
+type AbandonmentConfig struct {
+	// Thresholds are the idle periods after which a CartAbandoned event is
+	// emitted, once per threshold for each period of inactivity
+	Thresholds   []time.Duration
+	ScanInterval time.Duration
+	// RecoveryTTL is how long a recovery link stays valid
+	RecoveryTTL time.Duration
+	// RecoveryURL, if set, is the base of the recovery link put in events;
+	// the token is appended to it
+	RecoveryURL string
+	// EventsStream is the Redis stream events are appended to
+	EventsStream string
+}
+
+// CartAbandonedEvent is published when a cart with items has been idle for
+// one of the configured thresholds.
+type CartAbandonedEvent struct {
+	Type           string     `json:"type"`
+	UserID         uint       `json:"userId,omitempty"`
+	Guest          bool       `json:"guest"`
+	Threshold      string     `json:"threshold"`
+	LastActivityAt time.Time  `json:"lastActivityAt"`
+	Items          []CartItem `json:"items"`
+	Subtotal       float64    `json:"subtotal"`
+	Total          float64    `json:"total"`
+	RecoveryToken  string     `json:"recoveryToken"`
+	RecoveryURL    string     `json:"recoveryUrl,omitempty"`
+	OccurredAt     time.Time  `json:"occurredAt"`
+}
+
+// recoverySnapshot is what a recovery token restores: the cart contents at
+// the time it was found abandoned.
+type recoverySnapshot struct {
+	UserID      uint       `json:"userId"`
+	GuestToken  string     `json:"guestToken,omitempty"`
+	Items       []CartItem `json:"items"`
+	CouponCodes []string   `json:"couponCodes,omitempty"`
+	Threshold   string     `json:"threshold"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+type AbandonmentMetrics struct {
+	Threshold    string  `json:"threshold"`
+	Abandoned    int64   `json:"abandoned"`
+	Recovered    int64   `json:"recovered"`
+	RecoveryRate float64 `json:"recoveryRate"`
+}
+
+func abandonedKey(threshold time.Duration) string {
+	return "carts:abandoned:" + threshold.String()
+}
+
+func recoveryKey(token string) string {
+	return "cart:recovery:" + token
+}
+
+// ownerFromKey is the inverse of CartOwner.key.
+func ownerFromKey(key string) (CartOwner, bool) {
+	rest, ok := strings.CutPrefix(key, "cart:")
+	if !ok {
+		return CartOwner{}, false
+	}
+	if token, ok := strings.CutPrefix(rest, "guest:"); ok {
+		return GuestCart(token), isValidGuestToken(token)
+	}
+	id, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil {
+		return CartOwner{}, false
+	}
+	return UserCart(uint(id)), true
+}
+
+// recordActivity keeps the activity index in step with a cart after it was
+// written. Failures only delay abandonment detection, so they are logged.
+func (s *CartService) recordActivity(ctx context.Context, owner CartOwner, cart *Cart) {
+	var err error
+	if cart == nil || len(cart.Items) == 0 {
+		err = s.redisClient.ZRem(ctx, cartActivityKey, owner.key()).Err()
+	} else {
+		err = s.redisClient.ZAdd(ctx, cartActivityKey, &redis.Z{
+			Score:  float64(cart.LastActivityAt.Unix()),
+			Member: owner.key(),
+		}).Err()
+	}
+	if err != nil {
+		log.Printf("Failed to record activity for %s: %v", owner.key(), err)
+	}
+}
+
+type AbandonmentService struct {
+	redisClient *redis.Client
+	carts       *CartService
+	config      AbandonmentConfig
+}
+
+func NewAbandonmentService(redisClient *redis.Client, carts *CartService, config AbandonmentConfig) *AbandonmentService {
+	return &AbandonmentService{
+		redisClient: redisClient,
+		carts:       carts,
+		config:      config,
+	}
+}
+
+// RunScanner scans for abandoned carts every ScanInterval until ctx is done.
+func (s *AbandonmentService) RunScanner(ctx context.Context) {
+	if len(s.config.Thresholds) == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.ScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			emitted, err := s.Scan(ctx)
+			if err != nil {
+				log.Printf("Failed to scan for abandoned carts: %v", err)
+				continue
+			}
+			if emitted > 0 {
+				log.Printf("Emitted %d abandoned cart events", emitted)
+			}
+		}
+	}
+}
+
+// Scan emits a CartAbandoned event for every cart that has passed a
+// threshold since its last activity without an event for that threshold.
+// Claims are made with ZADD GT, so concurrent scanners on several replicas
+// emit each event once.
+func (s *AbandonmentService) Scan(ctx context.Context) (int, error) {
+	now := time.Now()
+	emitted := 0
+	for _, threshold := range s.config.Thresholds {
+		cutoff := now.Add(-threshold).Unix()
+		idle, err := s.redisClient.ZRangeByScoreWithScores(ctx, cartActivityKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(cutoff, 10),
+		}).Result()
+		if err != nil {
+			return emitted, err
+		}
+
+		for _, entry := range idle {
+			key, _ := entry.Member.(string)
+			owner, ok := ownerFromKey(key)
+			if !ok {
+				s.forget(ctx, key)
+				continue
+			}
+			cart, err := s.carts.GetCart(ctx, owner)
+			if err != nil {
+				return emitted, err
+			}
+			if len(cart.Items) == 0 {
+				// Expired or emptied without passing through recordActivity
+				s.forget(ctx, key)
+				continue
+			}
+			if cart.LastActivityAt.Unix() > cutoff {
+				continue
+			}
+
+			claimed, err := s.redisClient.ZAddArgs(ctx, abandonedKey(threshold), redis.ZAddArgs{
+				GT:      true,
+				Ch:      true,
+				Members: []redis.Z{{Score: float64(cart.LastActivityAt.Unix()), Member: key}},
+			}).Result()
+			if err != nil {
+				return emitted, err
+			}
+			if claimed == 0 {
+				continue
+			}
+			if err := s.emit(ctx, owner, cart, threshold); err != nil {
+				log.Printf("Failed to emit abandoned cart event for %s: %v", key, err)
+				continue
+			}
+			emitted++
+		}
+	}
+	return emitted, nil
+}
+
+func (s *AbandonmentService) forget(ctx context.Context, key string) {
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, cartActivityKey, key)
+		for _, threshold := range s.config.Thresholds {
+			pipe.ZRem(ctx, abandonedKey(threshold), key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to drop %s from abandonment tracking: %v", key, err)
+	}
+}
+
+// emit stores a recovery snapshot for the cart and publishes the event.
+func (s *AbandonmentService) emit(ctx context.Context, owner CartOwner, cart *Cart, threshold time.Duration) error {
+	token, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	snapshot, err := json.Marshal(recoverySnapshot{
+		UserID:      owner.UserID,
+		GuestToken:  owner.GuestToken,
+		Items:       cart.Items,
+		CouponCodes: cart.CouponCodes,
+		Threshold:   threshold.String(),
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	event := CartAbandonedEvent{
+		Type:           EventCartAbandoned,
+		UserID:         owner.UserID,
+		Guest:          owner.IsGuest(),
+		Threshold:      threshold.String(),
+		LastActivityAt: cart.LastActivityAt,
+		Items:          cart.Items,
+		Subtotal:       cart.Subtotal,
+		Total:          cart.Total,
+		RecoveryToken:  token,
+		OccurredAt:     time.Now(),
+	}
+	if s.config.RecoveryURL != "" {
+		event.RecoveryURL = s.config.RecoveryURL + token
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, recoveryKey(token), snapshot, s.config.RecoveryTTL)
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.config.EventsStream,
+			MaxLen: 10000,
+			Approx: true,
+			Values: map[string]interface{}{"type": EventCartAbandoned, "payload": payload},
+		})
+		pipe.HIncrBy(ctx, abandonmentMetricsKey, "abandoned:"+threshold.String(), 1)
+		return nil
+	})
+	return err
+}
+
+// Recover restores the contents of an abandoned cart from a recovery token.
+// Lines still in the cart keep the larger quantity. Restored lines are priced
+// afresh and held to the quantity rules of AddToCart, so products that are no
+// longer available are skipped and lines beyond the cap are not restored.
+func (s *AbandonmentService) Recover(ctx context.Context, token string) (*Cart, error) {
+	data, err := s.redisClient.Get(ctx, recoveryKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrInvalidRecoveryToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot recoverySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(snapshot.Items))
+	for _, item := range snapshot.Items {
+		ids = append(ids, item.ProductID)
+	}
+	products, err := s.carts.products.GetMany(ctx, ids, false)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	restored := make([]CartItem, 0, len(snapshot.Items))
+	for _, item := range snapshot.Items {
+		restored = append(restored, CartItem{ProductID: item.ProductID, Quantity: item.Quantity, UpdatedAt: now})
+	}
+
+	owner := CartOwner{UserID: snapshot.UserID, GuestToken: snapshot.GuestToken}
+	cart, err := s.carts.updateCart(ctx, owner, anyCartVersion, func(cart *Cart) error {
+		mergeCartItems(cart, restored, MergeStrategyMax, products, s.carts.config.MaxLines)
+		for _, code := range snapshot.CouponCodes {
+			if !containsCode(cart.CouponCodes, code) {
+				cart.CouponCodes = append(cart.CouponCodes, code)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Links can be opened more than once; only the first use counts
+	first, err := s.redisClient.SetNX(ctx, recoveryKey(token)+":recovered", 1, s.config.RecoveryTTL).Result()
+	if err != nil {
+		log.Printf("Failed to record cart recovery: %v", err)
+	} else if first {
+		if err := s.redisClient.HIncrBy(ctx, abandonmentMetricsKey, "recovered:"+snapshot.Threshold, 1).Err(); err != nil {
+			log.Printf("Failed to record cart recovery: %v", err)
+		}
+	}
+	return cart, nil
+}
+
+// Metrics reports abandoned and recovered carts per threshold.
+func (s *AbandonmentService) Metrics(ctx context.Context) ([]AbandonmentMetrics, error) {
+	counts, err := s.redisClient.HGetAll(ctx, abandonmentMetricsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]AbandonmentMetrics, 0, len(s.config.Thresholds))
+	for _, threshold := range s.config.Thresholds {
+		m := AbandonmentMetrics{Threshold: threshold.String()}
+		m.Abandoned, _ = strconv.ParseInt(counts["abandoned:"+m.Threshold], 10, 64)
+		m.Recovered, _ = strconv.ParseInt(counts["recovered:"+m.Threshold], 10, 64)
+		if m.Abandoned > 0 {
+			m.RecoveryRate = float64(m.Recovered) / float64(m.Abandoned)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOwnerFromKey(t *testing.T) {
+	guest := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		key    string
+		want   CartOwner
+		wantOK bool
+	}{
+		{key: UserCart(7).key(), want: UserCart(7), wantOK: true},
+		{key: GuestCart(guest).key(), want: GuestCart(guest), wantOK: true},
+		{key: "cart:guest:not-a-token", wantOK: false},
+		{key: "cart:seven", wantOK: false},
+		{key: "list:7:saved", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			owner, ok := ownerFromKey(tt.key)
+			if ok != tt.wantOK || (ok && owner != tt.want) {
+				t.Errorf("got %+v, %v; want %+v, %v", owner, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// storeIdleCart stores a cart of owner last changed idle ago and records its
+// activity, as if it had been left since.
+func storeIdleCart(t *testing.T, service *CartService, owner CartOwner, items []CartItem, idle time.Duration) {
+	t.Helper()
+	ctx := context.Background()
+	var stored *Cart
+	err := service.store.Update(ctx, []CartOwner{owner}, func(carts []*Cart) error {
+		carts[0].Items = items
+		carts[0].LastActivityAt = time.Now().Add(-idle)
+		stored = carts[0]
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to store the cart: %v", err)
+	}
+	service.recordActivity(ctx, owner, stored)
+}
+
+func newTestAbandonmentService(t *testing.T) (*AbandonmentService, *CartService) {
+	t.Helper()
+	carts := newTestCartService(t, NewMemoryCartStore(CartTTL{}), map[uint]productInfo{1: {ID: 1, Price: 10, Stock: 5}})
+	return NewAbandonmentService(carts.redisClient, carts, AbandonmentConfig{
+		Thresholds:   []time.Duration{time.Hour, 24 * time.Hour},
+		RecoveryTTL:  time.Hour,
+		RecoveryURL:  "https://shop.example/cart/recover?token=",
+		EventsStream: "events:test",
+	}), carts
+}
+
+// abandonedEvents returns the CartAbandoned events published so far.
+func abandonedEvents(t *testing.T, service *AbandonmentService) []CartAbandonedEvent {
+	t.Helper()
+	messages, err := service.redisClient.XRange(context.Background(), service.config.EventsStream, "-", "+").Result()
+	if err != nil {
+		t.Fatalf("failed to read events: %v", err)
+	}
+	events := make([]CartAbandonedEvent, 0, len(messages))
+	for _, message := range messages {
+		payload, _ := message.Values["payload"].(string)
+		var event CartAbandonedEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			t.Fatalf("invalid event payload %q: %v", payload, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAbandonmentScan(t *testing.T) {
+	ctx := context.Background()
+	service, carts := newTestAbandonmentService(t)
+	items := []CartItem{{ProductID: 1, Quantity: 2, Price: 10}}
+	storeIdleCart(t, carts, UserCart(7), items, 2*time.Hour)
+	storeIdleCart(t, carts, UserCart(8), items, 10*time.Minute)
+	storeIdleCart(t, carts, UserCart(9), items, 30*time.Hour)
+	// Emptied without recordActivity seeing it
+	storeIdleCart(t, carts, UserCart(10), items, 2*time.Hour)
+	if err := carts.store.Delete(ctx, UserCart(10)); err != nil {
+		t.Fatalf("failed to delete the cart: %v", err)
+	}
+
+	// User 7 passed the first threshold and user 9 both
+	emitted, err := service.Scan(ctx)
+	if err != nil || emitted != 3 {
+		t.Fatalf("emitted %d, %v; want 3", emitted, err)
+	}
+	thresholds := map[uint][]string{}
+	for _, event := range abandonedEvents(t, service) {
+		if event.Type != EventCartAbandoned || len(event.Items) != 1 || event.RecoveryURL != service.config.RecoveryURL+event.RecoveryToken {
+			t.Errorf("unexpected event %+v", event)
+		}
+		thresholds[event.UserID] = append(thresholds[event.UserID], event.Threshold)
+	}
+	if len(thresholds) != 2 || len(thresholds[7]) != 1 || len(thresholds[9]) != 2 {
+		t.Errorf("thresholds per user %v, want one for user 7 and two for user 9", thresholds)
+	}
+	if tracked, _ := service.redisClient.ZScore(ctx, cartActivityKey, UserCart(10).key()).Result(); tracked != 0 {
+		t.Error("the emptied cart is still tracked")
+	}
+
+	// Each period of inactivity is reported once per threshold
+	if emitted, err := service.Scan(ctx); err != nil || emitted != 0 {
+		t.Fatalf("emitted %d, %v on the second scan; want 0", emitted, err)
+	}
+
+	// Activity starts a new period, which is reported again once idle
+	storeIdleCart(t, carts, UserCart(7), items, 90*time.Minute)
+	if emitted, err := service.Scan(ctx); err != nil || emitted != 1 {
+		t.Fatalf("emitted %d, %v after new activity; want 1", emitted, err)
+	}
+}
+
+func TestRecoverAbandonedCart(t *testing.T) {
+	ctx := context.Background()
+	service, carts := newTestAbandonmentService(t)
+	owner := UserCart(7)
+	// The price has changed since and product 2 is gone
+	storeIdleCart(t, carts, owner, []CartItem{
+		{ProductID: 1, Quantity: 2, Price: 8},
+		{ProductID: 2, Quantity: 1, Price: 4},
+	}, 2*time.Hour)
+	if emitted, err := service.Scan(ctx); err != nil || emitted != 1 {
+		t.Fatalf("emitted %d, %v; want 1", emitted, err)
+	}
+	token := abandonedEvents(t, service)[0].RecoveryToken
+
+	if _, err := service.Recover(ctx, "unknown"); !errors.Is(err, ErrInvalidRecoveryToken) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidRecoveryToken)
+	}
+	if _, err := carts.ClearCart(ctx, owner, anyCartVersion); err != nil {
+		t.Fatalf("failed to clear the cart: %v", err)
+	}
+	cart, err := service.Recover(ctx, token)
+	if err != nil {
+		t.Fatalf("failed to recover the cart: %v", err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ProductID != 1 || cart.Items[0].Quantity != 2 || cart.Items[0].Price != 10 {
+		t.Errorf("items %+v, want 2 of product 1 at 10", cart.Items)
+	}
+
+	// Opening the link again does not count another recovery
+	if _, err := service.Recover(ctx, token); err != nil {
+		t.Fatalf("failed to recover the cart again: %v", err)
+	}
+	metrics, err := service.Metrics(ctx)
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	want := []AbandonmentMetrics{
+		{Threshold: "1h0m0s", Abandoned: 1, Recovered: 1, RecoveryRate: 1},
+		{Threshold: "24h0m0s"},
+	}
+	if len(metrics) != len(want) || metrics[0] != want[0] || metrics[1] != want[1] {
+		t.Errorf("metrics %+v, want %+v", metrics, want)
+	}
+}
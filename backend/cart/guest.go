@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MergeStrategySum adds the guest quantity to the user's quantity
+	MergeStrategySum = "sum"
+	// MergeStrategyMax keeps the larger of the two quantities
+	MergeStrategyMax = "max"
+	// MergeStrategyNewest keeps whichever line was updated most recently
+	MergeStrategyNewest = "newest"
+)
+
+var (
+	ErrInvalidGuestToken    = errors.New("guest cart not found")
+	ErrInvalidMergeStrategy = errors.New("invalid merge strategy")
+)
+
+// guestTokenBytes is the amount of randomness in a guest cart token.
+const guestTokenBytes = 16
+
+func newGuestToken() (string, error) {
+	b := make([]byte, guestTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isValidGuestToken(token string) bool {
+	if len(token) != guestTokenBytes*2 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+func isValidMergeStrategy(strategy string) bool {
+	switch strategy {
+	case MergeStrategySum, MergeStrategyMax, MergeStrategyNewest:
+		return true
+	}
+	return false
+}
+
+// CreateGuestCart issues a new guest token. The cart itself is only stored
+// once the first item is added.
+func (s *CartService) CreateGuestCart(ctx context.Context) (*Cart, error) {
+	token, err := newGuestToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate guest token: %v", err)
+	}
+	return s.GetCart(ctx, GuestCart(token))
+}
+
+// MergeGuestCart folds a guest cart into the user's cart and deletes the guest
+// cart, atomically. Lines present in both carts are resolved by strategy, and
+// merged quantities are kept within the quantity rules of AddToCart.
+func (s *CartService) MergeGuestCart(ctx context.Context, userID uint, token, strategy string) (*Cart, error) {
+	if strategy == "" {
+		strategy = s.config.MergeStrategy
+	}
+	if !isValidMergeStrategy(strategy) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMergeStrategy, strategy)
+	}
+	if !isValidGuestToken(token) {
+		return nil, ErrInvalidGuestToken
+	}
+
+	guest := GuestCart(token)
+	user := UserCart(userID)
+	var merged *Cart
+
+	err := s.store.Update(ctx, []CartOwner{guest, user}, func(carts []*Cart) error {
+		guestCart, userCart := carts[0], carts[1]
+		merged = userCart
+		// Drop the guest cart in the same update
+		carts[0] = nil
+		if len(guestCart.Items) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(guestCart.Items))
+		for _, item := range guestCart.Items {
+			ids = append(ids, item.ProductID)
+		}
+		products, err := s.products.GetMany(ctx, ids, false)
+		if err != nil {
+			return err
+		}
+		mergeCartItems(userCart, guestCart.Items, strategy, products, s.config.MaxLines)
+		for _, code := range guestCart.CouponCodes {
+			if !containsCode(userCart.CouponCodes, code) {
+				userCart.CouponCodes = append(userCart.CouponCodes, code)
+			}
+		}
+		return s.finalizeCart(ctx, userCart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.recordActivity(ctx, guest, nil)
+	s.recordActivity(ctx, user, merged)
+	return merged, nil
+}
+
+// mergeCartItems merges items into cart, resolving lines present in both by
+// strategy. Merged lines follow the same rules as setLine: quantities are
+// brought within the product's limits and stock at its current price, items
+// whose product cannot be ordered are dropped, and no line is added beyond
+// maxLines, where zero means no cap.
+func mergeCartItems(cart *Cart, items []CartItem, strategy string, products map[uint]productLookup, maxLines int) {
+	for _, incoming := range items {
+		lookup, ok := products[incoming.ProductID]
+		if !ok || lookup.Err != nil {
+			continue
+		}
+		product := &lookup.Product
+
+		found := false
+		for i, existing := range cart.Items {
+			if existing.ProductID != incoming.ProductID {
+				continue
+			}
+			found = true
+
+			newer := existing
+			if incoming.UpdatedAt.After(existing.UpdatedAt) {
+				newer = incoming
+			}
+			switch strategy {
+			case MergeStrategySum:
+				newer.Quantity = existing.Quantity + incoming.Quantity
+			case MergeStrategyMax:
+				newer.Quantity = max(existing.Quantity, incoming.Quantity)
+			}
+			if quantity, ok := clampLineQuantity(product, newer.Quantity); ok {
+				newer.Quantity = quantity
+				newer.Price = product.Price
+				cart.Items[i] = newer
+			}
+			break
+		}
+		if found || (maxLines > 0 && len(cart.Items) >= maxLines) {
+			continue
+		}
+		if quantity, ok := clampLineQuantity(product, incoming.Quantity); ok {
+			incoming.Quantity = quantity
+			incoming.Price = product.Price
+			cart.Items = append(cart.Items, incoming)
+		}
+	}
+}
+
+func containsCode(codes []string, code string) bool {
+	for _, existing := range codes {
+		if existing == code {
+			return true
+		}
+	}
+	return false
+}
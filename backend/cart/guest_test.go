@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeCartItems(t *testing.T) {
+	earlier := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+	products := map[uint]productLookup{
+		1: {Product: productInfo{ID: 1, Price: 10, Stock: 100}},
+		2: {Product: productInfo{ID: 2, Price: 20, Stock: 5}},
+		3: {Product: productInfo{ID: 3, Price: 30, Stock: 100, MinOrderQuantity: 4, MaxPerOrder: 6}},
+		4: {Product: productInfo{ID: 4, Price: 40, Stock: 2, MinOrderQuantity: 3}},
+		5: {Err: ErrProductDeleted},
+	}
+
+	tests := []struct {
+		name     string
+		cart     []CartItem
+		incoming []CartItem
+		strategy string
+		maxLines int
+		want     []CartItem
+	}{
+		{
+			name:     "sum adds quantities",
+			cart:     []CartItem{{ProductID: 1, Quantity: 2, Price: 10, UpdatedAt: earlier}},
+			incoming: []CartItem{{ProductID: 1, Quantity: 3, Price: 10, UpdatedAt: later}},
+			strategy: MergeStrategySum,
+			want:     []CartItem{{ProductID: 1, Quantity: 5, Price: 10, UpdatedAt: later}},
+		},
+		{
+			name:     "max keeps the larger quantity",
+			cart:     []CartItem{{ProductID: 1, Quantity: 7, Price: 10, UpdatedAt: earlier}},
+			incoming: []CartItem{{ProductID: 1, Quantity: 3, Price: 10, UpdatedAt: later}},
+			strategy: MergeStrategyMax,
+			want:     []CartItem{{ProductID: 1, Quantity: 7, Price: 10, UpdatedAt: later}},
+		},
+		{
+			name:     "newest keeps the most recently updated line",
+			cart:     []CartItem{{ProductID: 1, Quantity: 7, Price: 10, UpdatedAt: later}},
+			incoming: []CartItem{{ProductID: 1, Quantity: 3, Price: 10, UpdatedAt: earlier}},
+			strategy: MergeStrategyNewest,
+			want:     []CartItem{{ProductID: 1, Quantity: 7, Price: 10, UpdatedAt: later}},
+		},
+		{
+			name:     "merged lines take the current price",
+			cart:     []CartItem{{ProductID: 1, Quantity: 1, Price: 8, UpdatedAt: earlier}},
+			incoming: []CartItem{{ProductID: 1, Quantity: 1, Price: 9, UpdatedAt: later}},
+			strategy: MergeStrategySum,
+			want:     []CartItem{{ProductID: 1, Quantity: 2, Price: 10, UpdatedAt: later}},
+		},
+		{
+			name:     "sums are capped at the stock",
+			cart:     []CartItem{{ProductID: 2, Quantity: 4, Price: 20, UpdatedAt: earlier}},
+			incoming: []CartItem{{ProductID: 2, Quantity: 4, Price: 20, UpdatedAt: later}},
+			strategy: MergeStrategySum,
+			want:     []CartItem{{ProductID: 2, Quantity: 5, Price: 20, UpdatedAt: later}},
+		},
+		{
+			name:     "new lines are capped at the maximum per order",
+			incoming: []CartItem{{ProductID: 3, Quantity: 9, Price: 30, UpdatedAt: later}},
+			strategy: MergeStrategySum,
+			want:     []CartItem{{ProductID: 3, Quantity: 6, Price: 30, UpdatedAt: later}},
+		},
+		{
+			name:     "new lines are raised to the minimum order quantity",
+			incoming: []CartItem{{ProductID: 3, Quantity: 1, Price: 30, UpdatedAt: later}},
+			strategy: MergeStrategySum,
+			want:     []CartItem{{ProductID: 3, Quantity: 4, Price: 30, UpdatedAt: later}},
+		},
+		{
+			name: "products that cannot be ordered are left out",
+			cart: []CartItem{{ProductID: 1, Quantity: 1, Price: 10, UpdatedAt: earlier}},
+			incoming: []CartItem{
+				{ProductID: 4, Quantity: 1, Price: 40, UpdatedAt: later},
+				{ProductID: 5, Quantity: 1, Price: 50, UpdatedAt: later},
+				{ProductID: 6, Quantity: 1, Price: 60, UpdatedAt: later},
+			},
+			strategy: MergeStrategySum,
+			want:     []CartItem{{ProductID: 1, Quantity: 1, Price: 10, UpdatedAt: earlier}},
+		},
+		{
+			name: "no lines are added beyond the cap",
+			cart: []CartItem{{ProductID: 1, Quantity: 1, Price: 10, UpdatedAt: earlier}},
+			incoming: []CartItem{
+				{ProductID: 2, Quantity: 1, Price: 20, UpdatedAt: later},
+				{ProductID: 1, Quantity: 1, Price: 10, UpdatedAt: later},
+			},
+			strategy: MergeStrategySum,
+			maxLines: 1,
+			want:     []CartItem{{ProductID: 1, Quantity: 2, Price: 10, UpdatedAt: later}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cart := &Cart{Items: append([]CartItem{}, tt.cart...)}
+			mergeCartItems(cart, tt.incoming, tt.strategy, products, tt.maxLines)
+			if !reflect.DeepEqual(cart.Items, tt.want) {
+				t.Errorf("items %+v, want %+v", cart.Items, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeGuestCart(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryCartStore(CartTTL{})
+	service := newTestCartService(t, store, map[uint]productInfo{
+		1: {ID: 1, Price: 10, Stock: 100},
+		2: {ID: 2, Price: 20, Stock: 100},
+	})
+	token := "0123456789abcdef0123456789abcdef"
+	guest, user := GuestCart(token), UserCart(7)
+	for _, add := range []struct {
+		owner CartOwner
+		item  CartItem
+	}{
+		{guest, CartItem{ProductID: 1, Quantity: 2}},
+		{guest, CartItem{ProductID: 2, Quantity: 1}},
+		{user, CartItem{ProductID: 1, Quantity: 3}},
+	} {
+		if _, err := service.AddToCart(ctx, add.owner, add.item, anyCartVersion); err != nil {
+			t.Fatalf("failed to add to cart: %v", err)
+		}
+	}
+
+	merged, err := service.MergeGuestCart(ctx, 7, token, "")
+	if err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+	quantities := make(map[uint]int)
+	for _, item := range merged.Items {
+		quantities[item.ProductID] = item.Quantity
+	}
+	if want := map[uint]int{1: 5, 2: 1}; !reflect.DeepEqual(quantities, want) {
+		t.Errorf("quantities %v, want %v", quantities, want)
+	}
+	if merged.Subtotal != 70 || merged.Version != 2 {
+		t.Errorf("subtotal %v at version %d, want 70 at version 2", merged.Subtotal, merged.Version)
+	}
+	if cart, err := store.Get(ctx, user); err != nil || !reflect.DeepEqual(cart.Items, merged.Items) {
+		t.Errorf("stored cart %+v, %v; want the merged cart", cart, err)
+	}
+	if cart, err := store.Get(ctx, guest); err != nil || len(cart.Items) != 0 {
+		t.Errorf("guest cart %+v, %v; want it deleted", cart, err)
+	}
+
+	// The guest cart is gone, so merging again changes nothing
+	again, err := service.MergeGuestCart(ctx, 7, token, "")
+	if err != nil || again.Version != merged.Version {
+		t.Errorf("cart %+v, %v; want it unchanged", again, err)
+	}
+	if _, err := service.MergeGuestCart(ctx, 7, "not a token", ""); !errors.Is(err, ErrInvalidGuestToken) {
+		t.Errorf("got %v, want %v", err, ErrInvalidGuestToken)
+	}
+	if _, err := service.MergeGuestCart(ctx, 7, token, "latest"); !errors.Is(err, ErrInvalidMergeStrategy) {
+		t.Errorf("got %v, want %v", err, ErrInvalidMergeStrategy)
+	}
+}
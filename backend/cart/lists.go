@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// SavedListID identifies the per-user "saved for later" list, which behaves
+// like a wishlist that always exists and cannot be shared.
+const SavedListID = "saved"
+
+// ListItem is a product kept outside the cart, either saved for later or on
+// a wishlist. Prices are not stored; they are looked up when moved back.
+type ListItem struct {
+	ProductID uint      `json:"productId"`
+	Quantity  int       `json:"quantity"`
+	AddedAt   time.Time `json:"addedAt"`
+}
+
+// ItemList is a saved-for-later list or a named wishlist. Lists are stored
+// without a TTL so they outlive the cart.
+type ItemList struct {
+	ID         string     `json:"id"`
+	UserID     uint       `json:"userId"`
+	Name       string     `json:"name"`
+	Items      []ListItem `json:"items"`
+	ShareToken string     `json:"shareToken,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// SharedList is the read-only public view of a shared wishlist.
+type SharedList struct {
+	Name  string     `json:"name"`
+	Items []ListItem `json:"items"`
+}
+
+var (
+	ErrListNotFound     = errors.New("wishlist not found")
+	ErrListItemNotFound = errors.New("item not found")
+	ErrInvalidList      = errors.New("invalid wishlist")
+)
+
+func listKey(userID uint, listID string) string {
+	return fmt.Sprintf("list:%d:%s", userID, listID)
+}
+
+func listIndexKey(userID uint) string {
+	return fmt.Sprintf("lists:%d", userID)
+}
+
+func listShareKey(token string) string {
+	return "list:share:" + token
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func decodeList(userID uint, listID string, cmd *redis.StringCmd) (*ItemList, error) {
+	data, err := cmd.Bytes()
+	if err == redis.Nil {
+		if listID == SavedListID {
+			return &ItemList{ID: SavedListID, UserID: userID, Name: "Saved for later", Items: []ListItem{}}, nil
+		}
+		return nil, ErrListNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list ItemList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (s *CartService) GetList(ctx context.Context, userID uint, listID string) (*ItemList, error) {
+	return decodeList(userID, listID, s.redisClient.Get(ctx, listKey(userID, listID)))
+}
+
+// GetWishlists returns the user's named wishlists, without the saved list.
+func (s *CartService) GetWishlists(ctx context.Context, userID uint) ([]ItemList, error) {
+	ids, err := s.redisClient.SMembers(ctx, listIndexKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	lists := make([]ItemList, 0, len(ids))
+	for _, id := range ids {
+		list, err := s.GetList(ctx, userID, id)
+		if errors.Is(err, ErrListNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, *list)
+	}
+	return lists, nil
+}
+
+func (s *CartService) CreateWishlist(ctx context.Context, userID uint, name string) (*ItemList, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidList)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	list := &ItemList{ID: id, UserID: userID, Name: name, Items: []ListItem{}, CreatedAt: time.Now()}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, listKey(userID, id), data, 0)
+		pipe.SAdd(ctx, listIndexKey(userID), id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *CartService) DeleteWishlist(ctx context.Context, userID uint, listID string) error {
+	if listID == SavedListID {
+		return fmt.Errorf("%w: the saved list cannot be deleted", ErrInvalidList)
+	}
+	list, err := s.GetList(ctx, userID, listID)
+	if err != nil {
+		return err
+	}
+	_, err = s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, listKey(userID, listID))
+		pipe.SRem(ctx, listIndexKey(userID), listID)
+		if list.ShareToken != "" {
+			pipe.Del(ctx, listShareKey(list.ShareToken))
+		}
+		return nil
+	})
+	return err
+}
+
+// updateList applies mutate to a stored list atomically.
+func (s *CartService) updateList(ctx context.Context, userID uint, listID string, mutate func(*ItemList) error) (*ItemList, error) {
+	key := listKey(userID, listID)
+	var updated *ItemList
+
+	txf := func(tx *redis.Tx) error {
+		list, err := decodeList(userID, listID, tx.Get(ctx, key))
+		if err != nil {
+			return err
+		}
+		if err := mutate(list); err != nil {
+			return err
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			return nil
+		})
+		if err == nil {
+			updated = list
+		}
+		return err
+	}
+
+	// Lists always live in Redis, whichever store holds the carts, so they are
+	// updated under WATCH and retried when another client gets in the way
+	for attempt := 0; attempt < maxCartUpdateAttempts; attempt++ {
+		err := s.redisClient.Watch(ctx, txf, key)
+		if err == nil {
+			return updated, nil
+		}
+		if err != redis.TxFailedErr {
+			return nil, err
+		}
+	}
+	return nil, ErrCartContention
+}
+
+func (s *CartService) AddListItem(ctx context.Context, userID uint, listID string, productID uint, quantity int) (*ItemList, error) {
+	if quantity <= 0 {
+		quantity = 1
+	}
+	if _, err := s.products.Get(ctx, productID); err != nil {
+		return nil, err
+	}
+	return s.updateList(ctx, userID, listID, func(list *ItemList) error {
+		addListItem(list, productID, quantity)
+		return nil
+	})
+}
+
+func (s *CartService) RemoveListItem(ctx context.Context, userID uint, listID string, productID uint) (*ItemList, error) {
+	return s.updateList(ctx, userID, listID, func(list *ItemList) error {
+		if _, ok := removeListItem(list, productID); !ok {
+			return ErrListItemNotFound
+		}
+		return nil
+	})
+}
+
+func addListItem(list *ItemList, productID uint, quantity int) {
+	for i, item := range list.Items {
+		if item.ProductID == productID {
+			list.Items[i].Quantity += quantity
+			return
+		}
+	}
+	list.Items = append(list.Items, ListItem{ProductID: productID, Quantity: quantity, AddedAt: time.Now()})
+}
+
+func removeListItem(list *ItemList, productID uint) (ListItem, bool) {
+	for i, item := range list.Items {
+		if item.ProductID == productID {
+			list.Items = append(list.Items[:i], list.Items[i+1:]...)
+			return item, true
+		}
+	}
+	return ListItem{}, false
+}
+
+// MoveCartItemToList takes a line out of the user's cart and puts it on a
+// list. Carts and lists live in different stores, so the cart is updated
+// first and the line is put back if the list update fails.
+func (s *CartService) MoveCartItemToList(ctx context.Context, userID uint, productID uint, listID string) (*Cart, *ItemList, error) {
+	if _, err := s.GetList(ctx, userID, listID); err != nil {
+		return nil, nil, err
+	}
+
+	owner := UserCart(userID)
+	var moved CartItem
+	cart, err := s.updateCart(ctx, owner, anyCartVersion, func(cart *Cart) error {
+		for i, item := range cart.Items {
+			if item.ProductID == productID {
+				moved = item
+				cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+				return nil
+			}
+		}
+		return ErrListItemNotFound
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list, err := s.updateList(ctx, userID, listID, func(list *ItemList) error {
+		addListItem(list, productID, moved.Quantity)
+		return nil
+	})
+	if err != nil {
+		_, restoreErr := s.updateCart(ctx, owner, anyCartVersion, func(cart *Cart) error {
+			addCartItem(cart, moved.ProductID, moved.Quantity, moved.Price)
+			return nil
+		})
+		if restoreErr != nil {
+			log.Printf("Failed to restore product %d to cart of user %d: %v", productID, userID, restoreErr)
+		}
+		return nil, nil, err
+	}
+	return cart, list, nil
+}
+
+// MoveListItemToCart puts a list item back into the cart at the current
+// price, subject to the same quantity rules as AddToCart. The list is updated
+// first and the item is put back if the cart update fails.
+func (s *CartService) MoveListItemToCart(ctx context.Context, userID uint, listID string, productID uint) (*Cart, *ItemList, error) {
+	current, err := s.GetList(ctx, userID, listID)
+	if err != nil {
+		return nil, nil, err
+	}
+	quantity := 0
+	for _, item := range current.Items {
+		if item.ProductID == productID {
+			quantity = item.Quantity
+		}
+	}
+	if quantity == 0 {
+		return nil, nil, ErrListItemNotFound
+	}
+
+	product, err := s.products.Get(ctx, productID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkLineQuantity(product, quantity); err != nil {
+		return nil, nil, err
+	}
+
+	var moved ListItem
+	list, err := s.updateList(ctx, userID, listID, func(list *ItemList) error {
+		item, ok := removeListItem(list, productID)
+		if !ok {
+			return ErrListItemNotFound
+		}
+		moved = item
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cart, err := s.updateCart(ctx, UserCart(userID), anyCartVersion, func(cart *Cart) error {
+		return s.setLine(cart, product, lineQuantity(cart, productID)+moved.Quantity)
+	})
+	if err != nil {
+		_, restoreErr := s.updateList(ctx, userID, listID, func(list *ItemList) error {
+			addListItem(list, productID, moved.Quantity)
+			return nil
+		})
+		if restoreErr != nil {
+			log.Printf("Failed to restore product %d to list %s of user %d: %v", productID, listID, userID, restoreErr)
+		}
+		return nil, nil, err
+	}
+	return cart, list, nil
+}
+
+// ShareWishlist makes a wishlist publicly readable through a share token,
+// reusing the existing token if it is already shared.
+func (s *CartService) ShareWishlist(ctx context.Context, userID uint, listID string) (*ItemList, error) {
+	if listID == SavedListID {
+		return nil, fmt.Errorf("%w: the saved list cannot be shared", ErrInvalidList)
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	list, err := s.updateList(ctx, userID, listID, func(list *ItemList) error {
+		if list.ShareToken == "" {
+			list.ShareToken = token
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.redisClient.Set(ctx, listShareKey(list.ShareToken), listKey(userID, listID), 0).Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UnshareWishlist revokes the share token of a wishlist.
+func (s *CartService) UnshareWishlist(ctx context.Context, userID uint, listID string) (*ItemList, error) {
+	var token string
+	list, err := s.updateList(ctx, userID, listID, func(list *ItemList) error {
+		token = list.ShareToken
+		list.ShareToken = ""
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		if err := s.redisClient.Del(ctx, listShareKey(token)).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// GetSharedWishlist returns the public view of a shared wishlist.
+func (s *CartService) GetSharedWishlist(ctx context.Context, token string) (*SharedList, error) {
+	key, err := s.redisClient.Get(ctx, listShareKey(token)).Result()
+	if err == redis.Nil {
+		return nil, ErrListNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.redisClient.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrListNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list ItemList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if list.ShareToken != token {
+		return nil, ErrListNotFound
+	}
+	return &SharedList{Name: list.Name, Items: list.Items}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestListItems(t *testing.T) {
+	list := &ItemList{Items: []ListItem{}}
+	addListItem(list, 1, 2)
+	addListItem(list, 2, 1)
+	addListItem(list, 1, 3)
+	if len(list.Items) != 2 || list.Items[0].Quantity != 5 || list.Items[1].Quantity != 1 {
+		t.Fatalf("items %+v, want 5 of product 1 and 1 of product 2", list.Items)
+	}
+
+	item, ok := removeListItem(list, 1)
+	if !ok || item.ProductID != 1 || item.Quantity != 5 {
+		t.Fatalf("removed %+v, %v; want 5 of product 1", item, ok)
+	}
+	if _, ok := removeListItem(list, 1); ok {
+		t.Error("removed product 1 twice")
+	}
+	if len(list.Items) != 1 || list.Items[0].ProductID != 2 {
+		t.Errorf("items %+v, want product 2 only", list.Items)
+	}
+}
+
+func TestWishlists(t *testing.T) {
+	ctx := context.Background()
+	service := newTestCartService(t, NewMemoryCartStore(CartTTL{}), map[uint]productInfo{1: {ID: 1, Price: 10, Stock: 5}})
+
+	if _, err := service.CreateWishlist(ctx, 7, "  "); !errors.Is(err, ErrInvalidList) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidList)
+	}
+	list, err := service.CreateWishlist(ctx, 7, "Birthday")
+	if err != nil {
+		t.Fatalf("failed to create a wishlist: %v", err)
+	}
+	if _, err := service.AddListItem(ctx, 7, list.ID, 1, 2); err != nil {
+		t.Fatalf("failed to add to the wishlist: %v", err)
+	}
+	if _, err := service.AddListItem(ctx, 7, list.ID, 9, 1); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("got %v, want %v", err, ErrProductNotFound)
+	}
+	if _, err := service.GetList(ctx, 8, list.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("another user's list: got %v, want %v", err, ErrListNotFound)
+	}
+
+	// The saved list always exists but is neither listed, shared nor deleted
+	saved, err := service.GetList(ctx, 7, SavedListID)
+	if err != nil || len(saved.Items) != 0 {
+		t.Fatalf("saved list %+v, %v; want it empty", saved, err)
+	}
+	if _, err := service.ShareWishlist(ctx, 7, SavedListID); !errors.Is(err, ErrInvalidList) {
+		t.Errorf("sharing the saved list: got %v, want %v", err, ErrInvalidList)
+	}
+	if err := service.DeleteWishlist(ctx, 7, SavedListID); !errors.Is(err, ErrInvalidList) {
+		t.Errorf("deleting the saved list: got %v, want %v", err, ErrInvalidList)
+	}
+	lists, err := service.GetWishlists(ctx, 7)
+	if err != nil || len(lists) != 1 || lists[0].ID != list.ID || len(lists[0].Items) != 1 {
+		t.Fatalf("wishlists %+v, %v; want the birthday list with one item", lists, err)
+	}
+
+	shared, err := service.ShareWishlist(ctx, 7, list.ID)
+	if err != nil || shared.ShareToken == "" {
+		t.Fatalf("shared %+v, %v; want a share token", shared, err)
+	}
+	again, err := service.ShareWishlist(ctx, 7, list.ID)
+	if err != nil || again.ShareToken != shared.ShareToken {
+		t.Errorf("shared again with token %q, %v; want %q", again.ShareToken, err, shared.ShareToken)
+	}
+	public, err := service.GetSharedWishlist(ctx, shared.ShareToken)
+	if err != nil || public.Name != "Birthday" || len(public.Items) != 1 {
+		t.Fatalf("shared list %+v, %v; want the birthday list", public, err)
+	}
+	if _, err := service.UnshareWishlist(ctx, 7, list.ID); err != nil {
+		t.Fatalf("failed to unshare: %v", err)
+	}
+	if _, err := service.GetSharedWishlist(ctx, shared.ShareToken); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("revoked token: got %v, want %v", err, ErrListNotFound)
+	}
+
+	if err := service.DeleteWishlist(ctx, 7, list.ID); err != nil {
+		t.Fatalf("failed to delete the wishlist: %v", err)
+	}
+	if lists, err := service.GetWishlists(ctx, 7); err != nil || len(lists) != 0 {
+		t.Errorf("wishlists %+v, %v; want none", lists, err)
+	}
+	if err := service.DeleteWishlist(ctx, 7, list.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("got %v, want %v", err, ErrListNotFound)
+	}
+}
+
+func TestMoveBetweenCartAndList(t *testing.T) {
+	ctx := context.Background()
+	products := map[uint]productInfo{1: {ID: 1, Price: 10, Stock: 5}, 2: {ID: 2, Price: 4, Stock: 1}}
+	service := newTestCartService(t, NewMemoryCartStore(CartTTL{}), products)
+	owner := UserCart(7)
+	if _, err := service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 3}, anyCartVersion); err != nil {
+		t.Fatalf("failed to add to cart: %v", err)
+	}
+
+	if _, _, err := service.MoveCartItemToList(ctx, 7, 1, "missing"); !errors.Is(err, ErrListNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrListNotFound)
+	}
+	cart, list, err := service.MoveCartItemToList(ctx, 7, 1, SavedListID)
+	if err != nil {
+		t.Fatalf("failed to save for later: %v", err)
+	}
+	if len(cart.Items) != 0 || len(list.Items) != 1 || list.Items[0].Quantity != 3 {
+		t.Fatalf("cart %+v and list %+v, want the line moved to the list", cart.Items, list.Items)
+	}
+	if _, _, err := service.MoveCartItemToList(ctx, 7, 1, SavedListID); !errors.Is(err, ErrListItemNotFound) {
+		t.Errorf("got %v, want %v", err, ErrListItemNotFound)
+	}
+
+	cart, list, err = service.MoveListItemToCart(ctx, 7, SavedListID, 1)
+	if err != nil {
+		t.Fatalf("failed to move back to the cart: %v", err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 3 || cart.Items[0].Price != 10 || len(list.Items) != 0 {
+		t.Errorf("cart %+v and list %+v, want the line back in the cart", cart.Items, list.Items)
+	}
+
+	// An item that breaks the quantity rules stays on the list
+	if _, err := service.AddListItem(ctx, 7, SavedListID, 2, 2); err != nil {
+		t.Fatalf("failed to save for later: %v", err)
+	}
+	_, _, err = service.MoveListItemToCart(ctx, 7, SavedListID, 2)
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) || lineErr.Code != LineErrorInsufficientStock {
+		t.Fatalf("got %v, want insufficient stock", err)
+	}
+	saved, err := service.GetList(ctx, 7, SavedListID)
+	if err != nil || len(saved.Items) != 1 || saved.Items[0].Quantity != 2 {
+		t.Errorf("saved list %+v, %v; want product 2 kept", saved, err)
+	}
+}
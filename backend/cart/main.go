@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,183 +20,223 @@ import (
 )
 
 type CartItem struct {
-	ProductID uint    `json:"productId"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ProductID uint      `json:"productId"`
+	Quantity  int       `json:"quantity"`
+	Price     float64   `json:"price"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 type Cart struct {
-	UserID uint        `json:"userId"`
-	Items  []CartItem  `json:"items"`
-	Total  float64     `json:"total"`
+	UserID        uint           `json:"userId"`
+	GuestToken    string         `json:"guestToken,omitempty"`
+	Items         []CartItem     `json:"items"`
+	CouponCodes   []string       `json:"couponCodes,omitempty"`
+	Subtotal      float64        `json:"subtotal"`
+	Discounts     []DiscountLine `json:"discounts,omitempty"`
+	DiscountTotal float64        `json:"discountTotal"`
+	FreeShipping  bool           `json:"freeShipping"`
+	Total         float64        `json:"total"`
+	Version       int64          `json:"version"`
+	// LastActivityAt is when the cart was last changed
+	LastActivityAt time.Time `json:"lastActivityAt"`
 }
 
-type CartService struct {
-	redisClient *redis.Client
-	productsURL string
+// CartOwner identifies a cart: either a signed-in user or an anonymous
+// shopper holding a guest token.
+type CartOwner struct {
+	UserID     uint
+	GuestToken string
 }
 
-func NewCartService(redisClient *redis.Client, productsURL string) *CartService {
-	return &CartService{
-		redisClient: redisClient,
-		productsURL: productsURL,
-	}
+func UserCart(userID uint) CartOwner {
+	return CartOwner{UserID: userID}
 }
 
-func (s *CartService) GetCart(ctx context.Context, userID uint) (*Cart, error) {
-	key := fmt.Sprintf("cart:%d", userID)
-	data, err := s.redisClient.Get(ctx, key).Bytes()
-	if err == redis.Nil {
-		return &Cart{UserID: userID, Items: []CartItem{}, Total: 0}, nil
-	}
-	if err != nil {
-		return nil, err
-	}
+func GuestCart(token string) CartOwner {
+	return CartOwner{GuestToken: token}
+}
 
-	var cart Cart
-	if err := json.Unmarshal(data, &cart); err != nil {
-		return nil, err
-	}
-	return &cart, nil
+func (o CartOwner) IsGuest() bool {
+	return o.GuestToken != ""
 }
 
-func (s *CartService) AddToCart(ctx context.Context, userID uint, item CartItem) error {
-	// Get current cart
-	cart, err := s.GetCart(ctx, userID)
-	if err != nil {
-		return err
+func (o CartOwner) key() string {
+	if o.IsGuest() {
+		return "cart:guest:" + o.GuestToken
 	}
+	return fmt.Sprintf("cart:%d", o.UserID)
+}
 
-	// Check if product exists and get current price
-	productURL := fmt.Sprintf("%s/api/products/%d", s.productsURL, item.ProductID)
-	resp, err := http.Get(productURL)
-	if err != nil {
-		return fmt.Errorf("failed to fetch product: %v", err)
-	}
-	defer resp.Body.Close()
+type CartConfig struct {
+	// MergeStrategy is used when a merge request does not name one
+	MergeStrategy string
+	// ProductCacheTTL is how long product lookups are reused
+	ProductCacheTTL time.Duration
+	// MaxLines caps the number of distinct products in a cart; zero means no cap
+	MaxLines int
+}
 
-	if resp.StatusCode == http.StatusNotFound {
-		return fmt.Errorf("product not found")
-	}
+// maxCartUpdateAttempts bounds the optimistic retries when concurrent
+// requests keep modifying the same cart.
+const maxCartUpdateAttempts = 10
 
-	var product struct {
-		Price float64 `json:"price"`
-		Stock int     `json:"stock"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
-		return fmt.Errorf("failed to decode product: %v", err)
-	}
+// anyCartVersion as the expected version applies an update whatever the
+// version of the cart.
+const anyCartVersion int64 = -1
 
-	// Validate stock
-	if product.Stock < item.Quantity {
-		return fmt.Errorf("insufficient stock")
-	}
+var (
+	ErrProductNotFound     = errors.New("product not found")
+	ErrProductDeleted      = errors.New("product is no longer available")
+	ErrCartVersionMismatch = errors.New("cart has been modified")
+	ErrCartContention      = errors.New("cart is being modified concurrently, please retry")
+)
 
-	// Update cart
-	found := false
-	for i, existingItem := range cart.Items {
-		if existingItem.ProductID == item.ProductID {
-			cart.Items[i].Quantity += item.Quantity
-			cart.Items[i].Price = product.Price
-			found = true
-			break
-		}
-	}
+type CartService struct {
+	store       CartStore
+	redisClient *redis.Client
+	products    *productClient
+	promotions  *PromotionService
+	config      CartConfig
+}
 
-	if !found {
-		item.Price = product.Price
-		cart.Items = append(cart.Items, item)
+func NewCartService(store CartStore, redisClient *redis.Client, productsURL string, promotions *PromotionService, config CartConfig) *CartService {
+	return &CartService{
+		store:       store,
+		redisClient: redisClient,
+		products:    newProductClient(productsURL, config.ProductCacheTTL),
+		promotions:  promotions,
+		config:      config,
 	}
+}
 
-	// Calculate total
-	cart.Total = 0
-	for _, item := range cart.Items {
-		cart.Total += item.Price * float64(item.Quantity)
-	}
+func (s *CartService) GetCart(ctx context.Context, owner CartOwner) (*Cart, error) {
+	return s.store.Get(ctx, owner)
+}
 
-	// Save to Redis
-	data, err := json.Marshal(cart)
+// updateCart applies mutate to the stored cart atomically. An expectedVersion
+// other than anyCartVersion makes the update conditional on the cart still
+// being at that version.
+func (s *CartService) updateCart(ctx context.Context, owner CartOwner, expectedVersion int64, mutate func(*Cart) error) (*Cart, error) {
+	var updated *Cart
+	err := s.store.Update(ctx, []CartOwner{owner}, func(carts []*Cart) error {
+		cart := carts[0]
+		if expectedVersion != anyCartVersion && cart.Version != expectedVersion {
+			return ErrCartVersionMismatch
+		}
+		if err := mutate(cart); err != nil {
+			return err
+		}
+		if err := s.finalizeCart(ctx, cart); err != nil {
+			return err
+		}
+		updated = cart
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	key := fmt.Sprintf("cart:%d", userID)
-	return s.redisClient.Set(ctx, key, data, 24*time.Hour).Err()
+	s.recordActivity(ctx, owner, updated)
+	return updated, nil
 }
 
-func (s *CartService) UpdateCartItem(ctx context.Context, userID uint, productID uint, quantity int) error {
-	cart, err := s.GetCart(ctx, userID)
-	if err != nil {
+// finalizeCart reprices the cart including promotions, bumps the version
+// and marks the cart as active.
+func (s *CartService) finalizeCart(ctx context.Context, cart *Cart) error {
+	if err := s.promotions.ApplyPromotions(ctx, cart); err != nil {
 		return err
 	}
+	cart.Version++
+	cart.LastActivityAt = time.Now()
+	return nil
+}
 
-	// Check if product exists and get current price
-	productURL := fmt.Sprintf("%s/api/products/%d", s.productsURL, productID)
-	resp, err := http.Get(productURL)
-	if err != nil {
-		return fmt.Errorf("failed to fetch product: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusNotFound {
-		return fmt.Errorf("product not found")
+func (s *CartService) AddToCart(ctx context.Context, owner CartOwner, item CartItem, expectedVersion int64) (*Cart, error) {
+	if item.Quantity <= 0 {
+		return nil, &LineError{
+			Code:      LineErrorInvalidQuantity,
+			Message:   fmt.Sprintf("quantity for product %d must be positive", item.ProductID),
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+		}
 	}
 
-	var product struct {
-		Price float64 `json:"price"`
-		Stock int     `json:"stock"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
-		return fmt.Errorf("failed to decode product: %v", err)
+	// Check if product exists and get current price
+	product, err := s.products.Get(ctx, item.ProductID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Validate stock
-	if product.Stock < quantity {
-		return fmt.Errorf("insufficient stock")
-	}
+	return s.updateCart(ctx, owner, expectedVersion, func(cart *Cart) error {
+		return s.setLine(cart, product, lineQuantity(cart, item.ProductID)+item.Quantity)
+	})
+}
 
-	// Update cart
-	found := false
-	for i, item := range cart.Items {
-		if item.ProductID == productID {
-			if quantity <= 0 {
-				cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
-			} else {
-				cart.Items[i].Quantity = quantity
-				cart.Items[i].Price = product.Price
-			}
-			found = true
-			break
+// addCartItem adds quantity units of a product to the cart at price, merging
+// with an existing line for the same product.
+func addCartItem(cart *Cart, productID uint, quantity int, price float64) {
+	now := time.Now()
+	for i, existingItem := range cart.Items {
+		if existingItem.ProductID == productID {
+			cart.Items[i].Quantity += quantity
+			cart.Items[i].Price = price
+			cart.Items[i].UpdatedAt = now
+			return
 		}
 	}
 
-	if !found && quantity > 0 {
-		cart.Items = append(cart.Items, CartItem{
+	cart.Items = append(cart.Items, CartItem{
+		ProductID: productID,
+		Quantity:  quantity,
+		Price:     price,
+		UpdatedAt: now,
+	})
+}
+
+// UpdateCartItem sets the quantity of a cart line. A quantity of zero
+// removes the line.
+func (s *CartService) UpdateCartItem(ctx context.Context, owner CartOwner, productID uint, quantity int, expectedVersion int64) (*Cart, error) {
+	if quantity < 0 {
+		return nil, &LineError{
+			Code:      LineErrorInvalidQuantity,
+			Message:   fmt.Sprintf("quantity for product %d must not be negative", productID),
 			ProductID: productID,
 			Quantity:  quantity,
-			Price:     product.Price,
-		})
-	}
-
-	// Calculate total
-	cart.Total = 0
-	for _, item := range cart.Items {
-		cart.Total += item.Price * float64(item.Quantity)
+		}
 	}
 
-	// Save to Redis
-	data, err := json.Marshal(cart)
-	if err != nil {
-		return err
+	// Removing an item must work even if the product has since been deleted
+	var product *productInfo
+	if quantity > 0 {
+		var err error
+		product, err = s.products.Get(ctx, productID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	key := fmt.Sprintf("cart:%d", userID)
-	return s.redisClient.Set(ctx, key, data, 24*time.Hour).Err()
+	return s.updateCart(ctx, owner, expectedVersion, func(cart *Cart) error {
+		if quantity > 0 {
+			return s.setLine(cart, product, quantity)
+		}
+		for i, item := range cart.Items {
+			if item.ProductID == productID {
+				cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
 }
 
-func (s *CartService) ClearCart(ctx context.Context, userID uint) error {
-	key := fmt.Sprintf("cart:%d", userID)
-	return s.redisClient.Del(ctx, key).Err()
+// ClearCart empties the cart. The emptied cart is stored rather than deleted
+// so its version keeps counting up, and an If-Match taken before the clear
+// cannot match again.
+func (s *CartService) ClearCart(ctx context.Context, owner CartOwner, expectedVersion int64) (*Cart, error) {
+	return s.updateCart(ctx, owner, expectedVersion, func(cart *Cart) error {
+		cart.Items = []CartItem{}
+		cart.CouponCodes = nil
+		return nil
+	})
 }
 
 func main() {
@@ -208,65 +251,496 @@ func main() {
 		DB:       0,
 	})
 
+	// Initialize cart store
+	ttl := CartTTL{
+		User:  getEnvDuration("CART_TTL", 24*time.Hour),
+		Guest: getEnvDuration("GUEST_CART_TTL", 12*time.Hour),
+	}
+	store, err := newCartStore(getEnv("CART_STORE", CartStoreRedis), getEnvBool("CART_WRITE_THROUGH", false), redisClient, ttl)
+	if err != nil {
+		log.Fatalf("Failed to initialize cart store: %v", err)
+	}
+
 	// Initialize cart service
-	service := NewCartService(redisClient, os.Getenv("PRODUCTS_SERVICE_URL"))
+	promotionService := NewPromotionService(redisClient)
+	service := NewCartService(store, redisClient, os.Getenv("PRODUCTS_SERVICE_URL"), promotionService, CartConfig{
+		MergeStrategy:   getEnv("CART_MERGE_STRATEGY", MergeStrategySum),
+		ProductCacheTTL: getEnvDuration("PRODUCT_CACHE_TTL", 5*time.Second),
+		MaxLines:        getEnvInt("MAX_CART_LINES", 50),
+	})
+
+	abandonmentService := NewAbandonmentService(redisClient, service, AbandonmentConfig{
+		Thresholds:   getEnvDurations("ABANDONED_CART_THRESHOLDS", []time.Duration{time.Hour, 24 * time.Hour}),
+		ScanInterval: getEnvDuration("ABANDONED_CART_SCAN_INTERVAL", 5*time.Minute),
+		RecoveryTTL:  getEnvDuration("CART_RECOVERY_TTL", 7*24*time.Hour),
+		RecoveryURL:  os.Getenv("CART_RECOVERY_URL"),
+		EventsStream: getEnv("CART_EVENTS_STREAM", "cart-events"),
+	})
 
 	// Initialize Gin router
 	r := gin.Default()
 
 	// API routes
-	r.GET("/api/cart/:userId", func(c *gin.Context) {
+	r.POST("/api/cart/guest", func(c *gin.Context) {
+		cart, err := service.CreateGuestCart(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create guest cart"})
+			return
+		}
+		c.Header("ETag", cartETag(cart))
+		c.JSON(http.StatusCreated, cart)
+	})
+
+	r.POST("/api/cart/:userId/merge", func(c *gin.Context) {
 		userID := uint(parseUint(c.Param("userId")))
-		cart, err := service.GetCart(c.Request.Context(), userID)
+		var input struct {
+			GuestToken string `json:"guestToken" binding:"required"`
+			Strategy   string `json:"strategy"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		cart, err := service.MergeGuestCart(c.Request.Context(), userID, input.GuestToken, input.Strategy)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Header("ETag", cartETag(cart))
+		c.JSON(http.StatusOK, cart)
+	})
+
+	// Signed-in and guest carts share the same item routes
+	cartRoutes := []struct {
+		prefix string
+		owner  func(c *gin.Context) (CartOwner, error)
+	}{
+		{"/api/cart/:userId", func(c *gin.Context) (CartOwner, error) {
+			return UserCart(uint(parseUint(c.Param("userId")))), nil
+		}},
+		{"/api/cart/guest/:token", func(c *gin.Context) (CartOwner, error) {
+			token := c.Param("token")
+			if !isValidGuestToken(token) {
+				return CartOwner{}, ErrInvalidGuestToken
+			}
+			return GuestCart(token), nil
+		}},
+	}
+
+	for _, route := range cartRoutes {
+		resolveOwner := route.owner
+
+		r.GET(route.prefix, func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			cart, err := service.GetCart(c.Request.Context(), owner)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cart"})
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.JSON(http.StatusOK, cart)
+		})
+
+		r.POST(route.prefix+"/items", func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			expectedVersion, ok := parseIfMatch(c.GetHeader("If-Match"))
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+				return
+			}
+			var item CartItem
+			if err := c.BindJSON(&item); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+				return
+			}
+			cart, err := service.AddToCart(c.Request.Context(), owner, item, expectedVersion)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.JSON(http.StatusOK, cart)
+		})
+
+		r.PUT(route.prefix+"/items/:productId", func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			productID := uint(parseUint(c.Param("productId")))
+			expectedVersion, ok := parseIfMatch(c.GetHeader("If-Match"))
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+				return
+			}
+			var input struct {
+				Quantity int `json:"quantity"`
+			}
+			if err := c.BindJSON(&input); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+				return
+			}
+			cart, err := service.UpdateCartItem(c.Request.Context(), owner, productID, input.Quantity, expectedVersion)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.JSON(http.StatusOK, cart)
+		})
+
+		r.POST(route.prefix+"/revalidate", func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			cart, changes, err := service.RevalidateCart(c.Request.Context(), owner)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.JSON(http.StatusOK, gin.H{"cart": cart, "changes": changes})
+		})
+
+		r.POST(route.prefix+"/coupons", func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			var input struct {
+				Code string `json:"code" binding:"required"`
+			}
+			if err := c.BindJSON(&input); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+				return
+			}
+			cart, err := service.ApplyCoupon(c.Request.Context(), owner, input.Code)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.JSON(http.StatusOK, cart)
+		})
+
+		r.DELETE(route.prefix+"/coupons/:code", func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			cart, err := service.RemoveCoupon(c.Request.Context(), owner, c.Param("code"))
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.JSON(http.StatusOK, cart)
+		})
+
+		r.DELETE(route.prefix, func(c *gin.Context) {
+			owner, err := resolveOwner(c)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			expectedVersion, ok := parseIfMatch(c.GetHeader("If-Match"))
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+				return
+			}
+			cart, err := service.ClearCart(c.Request.Context(), owner, expectedVersion)
+			if err != nil {
+				writeCartError(c, err)
+				return
+			}
+			c.Header("ETag", cartETag(cart))
+			c.Status(http.StatusNoContent)
+		})
+	}
+
+	r.POST("/api/cart/recover/:token", func(c *gin.Context) {
+		cart, err := abandonmentService.Recover(c.Request.Context(), c.Param("token"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cart"})
+			writeCartError(c, err)
 			return
 		}
+		c.Header("ETag", cartETag(cart))
 		c.JSON(http.StatusOK, cart)
 	})
 
-	r.POST("/api/cart/:userId/items", func(c *gin.Context) {
+	r.GET("/api/admin/carts/abandonment", func(c *gin.Context) {
+		metrics, err := abandonmentService.Metrics(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch abandonment metrics"})
+			return
+		}
+		c.JSON(http.StatusOK, metrics)
+	})
+
+	// Saved-for-later and wishlist routes (signed-in users only)
+	r.GET("/api/cart/:userId/saved", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		list, err := service.GetList(c.Request.Context(), userID, SavedListID)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	r.POST("/api/cart/:userId/items/:productId/save", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		productID := uint(parseUint(c.Param("productId")))
+		cart, list, err := service.MoveCartItemToList(c.Request.Context(), userID, productID, SavedListID)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Header("ETag", cartETag(cart))
+		c.JSON(http.StatusOK, gin.H{"cart": cart, "list": list})
+	})
+
+	r.POST("/api/cart/:userId/saved/:productId/restore", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		productID := uint(parseUint(c.Param("productId")))
+		cart, list, err := service.MoveListItemToCart(c.Request.Context(), userID, SavedListID, productID)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Header("ETag", cartETag(cart))
+		c.JSON(http.StatusOK, gin.H{"cart": cart, "list": list})
+	})
+
+	r.DELETE("/api/cart/:userId/saved/:productId", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		productID := uint(parseUint(c.Param("productId")))
+		list, err := service.RemoveListItem(c.Request.Context(), userID, SavedListID, productID)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	r.GET("/api/cart/:userId/wishlists", func(c *gin.Context) {
 		userID := uint(parseUint(c.Param("userId")))
-		var item CartItem
-		if err := c.BindJSON(&item); err != nil {
+		lists, err := service.GetWishlists(c.Request.Context(), userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wishlists"})
+			return
+		}
+		c.JSON(http.StatusOK, lists)
+	})
+
+	r.POST("/api/cart/:userId/wishlists", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		var input struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.BindJSON(&input); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 			return
 		}
-		if err := service.AddToCart(c.Request.Context(), userID, item); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		list, err := service.CreateWishlist(c.Request.Context(), userID, input.Name)
+		if err != nil {
+			writeCartError(c, err)
 			return
 		}
-		cart, _ := service.GetCart(c.Request.Context(), userID)
-		c.JSON(http.StatusOK, cart)
+		c.JSON(http.StatusCreated, list)
+	})
+
+	r.GET("/api/cart/:userId/wishlists/:listId", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		list, err := service.GetList(c.Request.Context(), userID, c.Param("listId"))
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	r.DELETE("/api/cart/:userId/wishlists/:listId", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		if err := service.DeleteWishlist(c.Request.Context(), userID, c.Param("listId")); err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	r.POST("/api/cart/:userId/wishlists/:listId/items", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		var input struct {
+			ProductID uint `json:"productId" binding:"required"`
+			Quantity  int  `json:"quantity"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		list, err := service.AddListItem(c.Request.Context(), userID, c.Param("listId"), input.ProductID, input.Quantity)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
 	})
 
-	r.PUT("/api/cart/:userId/items/:productId", func(c *gin.Context) {
+	r.DELETE("/api/cart/:userId/wishlists/:listId/items/:productId", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		productID := uint(parseUint(c.Param("productId")))
+		list, err := service.RemoveListItem(c.Request.Context(), userID, c.Param("listId"), productID)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	r.POST("/api/cart/:userId/items/:productId/wishlist", func(c *gin.Context) {
 		userID := uint(parseUint(c.Param("userId")))
 		productID := uint(parseUint(c.Param("productId")))
 		var input struct {
-			Quantity int `json:"quantity"`
+			WishlistID string `json:"wishlistId" binding:"required"`
 		}
 		if err := c.BindJSON(&input); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 			return
 		}
-		if err := service.UpdateCartItem(c.Request.Context(), userID, productID, input.Quantity); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		cart, list, err := service.MoveCartItemToList(c.Request.Context(), userID, productID, input.WishlistID)
+		if err != nil {
+			writeCartError(c, err)
 			return
 		}
-		cart, _ := service.GetCart(c.Request.Context(), userID)
-		c.JSON(http.StatusOK, cart)
+		c.Header("ETag", cartETag(cart))
+		c.JSON(http.StatusOK, gin.H{"cart": cart, "list": list})
+	})
+
+	r.POST("/api/cart/:userId/wishlists/:listId/items/:productId/move-to-cart", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		productID := uint(parseUint(c.Param("productId")))
+		cart, list, err := service.MoveListItemToCart(c.Request.Context(), userID, c.Param("listId"), productID)
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Header("ETag", cartETag(cart))
+		c.JSON(http.StatusOK, gin.H{"cart": cart, "list": list})
 	})
 
-	r.DELETE("/api/cart/:userId", func(c *gin.Context) {
+	r.POST("/api/cart/:userId/wishlists/:listId/share", func(c *gin.Context) {
 		userID := uint(parseUint(c.Param("userId")))
-		if err := service.ClearCart(c.Request.Context(), userID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear cart"})
+		list, err := service.ShareWishlist(c.Request.Context(), userID, c.Param("listId"))
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	r.DELETE("/api/cart/:userId/wishlists/:listId/share", func(c *gin.Context) {
+		userID := uint(parseUint(c.Param("userId")))
+		list, err := service.UnshareWishlist(c.Request.Context(), userID, c.Param("listId"))
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	r.GET("/api/wishlists/shared/:token", func(c *gin.Context) {
+		list, err := service.GetSharedWishlist(c.Request.Context(), c.Param("token"))
+		if err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	// Promotion routes
+	r.GET("/api/admin/promotions", func(c *gin.Context) {
+		promotions, err := promotionService.ListPromotions(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promotions"})
+			return
+		}
+		c.JSON(http.StatusOK, promotions)
+	})
+
+	r.POST("/api/admin/promotions", func(c *gin.Context) {
+		var promotion Promotion
+		if err := c.BindJSON(&promotion); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if err := promotionService.CreatePromotion(c.Request.Context(), &promotion); err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, promotion)
+	})
+
+	r.DELETE("/api/admin/promotions/:id", func(c *gin.Context) {
+		if err := promotionService.DeletePromotion(c.Request.Context(), c.Param("id")); err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Called by the order service once an order with discounts is placed
+	r.POST("/api/promotions/redeem", func(c *gin.Context) {
+		var input struct {
+			UserID       uint     `json:"userId" binding:"required"`
+			PromotionIDs []string `json:"promotionIds"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if err := promotionService.Redeem(c.Request.Context(), input.UserID, input.PromotionIDs); err != nil {
+			writeCartError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Called by the order service when an order fails after redeeming
+	r.POST("/api/promotions/release", func(c *gin.Context) {
+		var input struct {
+			UserID       uint     `json:"userId" binding:"required"`
+			PromotionIDs []string `json:"promotionIds"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if err := promotionService.Release(c.Request.Context(), input.UserID, input.PromotionIDs); err != nil {
+			writeCartError(c, err)
 			return
 		}
 		c.Status(http.StatusNoContent)
 	})
 
+	// Start background jobs
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go abandonmentService.RunScanner(jobsCtx)
+
 	// Start server
 	srv := &http.Server{
 		Addr:    ":8080",
@@ -283,6 +757,7 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	stopJobs()
 
 	// Graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -299,4 +774,131 @@ func parseUint(s string) uint64 {
 		return 0
 	}
 	return result
-} 
\ No newline at end of file
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvDurations reads a comma-separated list of durations, e.g. "1h,24h".
+func getEnvDurations(key string, fallback []time.Duration) []time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	var durations []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 {
+			log.Printf("Warning: invalid %s %q, using %v", key, value, fallback)
+			return fallback
+		}
+		durations = append(durations, d)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func cartETag(cart *Cart) string {
+	return fmt.Sprintf("\"%d\"", cart.Version)
+}
+
+// parseIfMatch extracts the expected cart version from an If-Match header.
+// An absent header or "*" yields anyCartVersion, which disables the check.
+func parseIfMatch(header string) (int64, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return anyCartVersion, true
+	}
+	header = strings.TrimPrefix(header, "W/")
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+func writeCartError(c *gin.Context, err error) {
+	var lineErr *LineError
+	if errors.As(err, &lineErr) {
+		c.JSON(http.StatusUnprocessableEntity, lineErr)
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrProductNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrProductDeleted):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidGuestToken):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidMergeStrategy):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPromotionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidPromotion):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPromotionInactive),
+		errors.Is(err, ErrPromotionExhausted),
+		errors.Is(err, ErrPromotionNotEligible):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrListNotFound),
+		errors.Is(err, ErrListItemNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidRecoveryToken):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidList):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrCartVersionMismatch):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrCartContention):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
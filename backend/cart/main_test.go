@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testRedis returns a client for the Redis database in TEST_REDIS_URL, e.g.
+// redis://localhost:6379/15, which is flushed before and after the test.
+// Tests that need Redis are skipped without one.
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL is not set")
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatalf("invalid TEST_REDIS_URL: %v", err)
+	}
+	client := redis.NewClient(options)
+	flush := func() {
+		if err := client.FlushDB(client.Context()).Err(); err != nil {
+			t.Fatalf("failed to flush the test database: %v", err)
+		}
+	}
+	flush()
+	t.Cleanup(func() {
+		flush()
+		client.Close()
+	})
+	return client
+}
+
+// testDB returns a database for one test: a schema of its own in the database
+// in TEST_DATABASE_URL, given as keyword/value pairs, with the carts table
+// migrated and dropped when the test ends. Tests that need a database are
+// skipped without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("failed to create schema %s: %v", schema, err)
+	}
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := db.AutoMigrate(&CartRecord{}); err != nil {
+		t.Fatalf("failed to migrate the test database: %v", err)
+	}
+	return db
+}
+
+// testProducts serves products from the batch endpoint of the products
+// service; unknown IDs are reported missing.
+func testProducts(t *testing.T, products map[uint]productInfo) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/products/batch" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			IDs []uint `json:"ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batch := struct {
+			Products []productInfo `json:"products"`
+			Missing  []uint        `json:"missing"`
+		}{Products: []productInfo{}, Missing: []uint{}}
+		for _, id := range req.IDs {
+			if product, ok := products[id]; ok {
+				batch.Products = append(batch.Products, product)
+			} else {
+				batch.Missing = append(batch.Missing, id)
+			}
+		}
+		json.NewEncoder(w).Encode(batch)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// newTestCartService returns a cart service on store, with promotions and
+// activity in the test Redis and products served by testProducts.
+func newTestCartService(t *testing.T, store CartStore, products map[uint]productInfo) *CartService {
+	t.Helper()
+	client := testRedis(t)
+	return NewCartService(store, client, testProducts(t, products), NewPromotionService(client), CartConfig{
+		MergeStrategy: MergeStrategySum,
+		MaxLines:      50,
+	})
+}
+
+func TestCartServiceVersion(t *testing.T) {
+	ctx := context.Background()
+	service := newTestCartService(t, NewMemoryCartStore(CartTTL{}), map[uint]productInfo{1: {ID: 1, Price: 10, Stock: 5}})
+	owner := UserCart(7)
+
+	cart, err := service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 1}, anyCartVersion)
+	if err != nil || cart.Version != 1 {
+		t.Fatalf("cart %+v, %v; want version 1", cart, err)
+	}
+
+	tests := []struct {
+		name        string
+		version     int64
+		wantErr     error
+		wantVersion int64
+	}{
+		{name: "current version", version: 1, wantVersion: 2},
+		{name: "stale version", version: 1, wantErr: ErrCartVersionMismatch, wantVersion: 2},
+		{name: "future version", version: 5, wantErr: ErrCartVersionMismatch, wantVersion: 2},
+		{name: "any version", version: anyCartVersion, wantVersion: 3},
+		{name: "version of a new cart", version: 0, wantErr: ErrCartVersionMismatch, wantVersion: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 1}, tt.version)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			cart, err := service.GetCart(ctx, owner)
+			if err != nil || cart.Version != tt.wantVersion {
+				t.Errorf("cart %+v, %v; want version %d", cart, err, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestClearCart(t *testing.T) {
+	ctx := context.Background()
+	service := newTestCartService(t, NewMemoryCartStore(CartTTL{}), map[uint]productInfo{1: {ID: 1, Price: 10, Stock: 5}})
+	owner := UserCart(7)
+	seen, err := service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 1}, anyCartVersion)
+	if err != nil {
+		t.Fatalf("failed to add to cart: %v", err)
+	}
+
+	if _, err := service.ClearCart(ctx, owner, seen.Version+1); !errors.Is(err, ErrCartVersionMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrCartVersionMismatch)
+	}
+	cleared, err := service.ClearCart(ctx, owner, seen.Version)
+	if err != nil {
+		t.Fatalf("failed to clear the cart: %v", err)
+	}
+	if len(cleared.Items) != 0 || cleared.Total != 0 || cleared.Version != seen.Version+1 {
+		t.Errorf("cart %+v, want it empty at version %d", cleared, seen.Version+1)
+	}
+
+	// Refilling the cart does not bring back the version seen before the
+	// clear, so a request made with it still fails
+	if _, err := service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 1}, cleared.Version); err != nil {
+		t.Fatalf("failed to add to cart: %v", err)
+	}
+	_, err = service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 1}, seen.Version)
+	if !errors.Is(err, ErrCartVersionMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrCartVersionMismatch)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeCartError(c, err)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64
+		ok     bool
+	}{
+		{header: "", want: anyCartVersion, ok: true},
+		{header: "*", want: anyCartVersion, ok: true},
+		{header: `"0"`, want: 0, ok: true},
+		{header: `"12"`, want: 12, ok: true},
+		{header: ` W/"12" `, want: 12, ok: true},
+		{header: "12"},
+		{header: `"-1"`},
+		{header: `"twelve"`},
+		{header: `"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, ok := parseIfMatch(tt.header)
+			if ok != tt.ok || (ok && got != tt.want) {
+				t.Errorf("got %d, %v; want %d, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// productBatchSize matches the products service limit per batch request.
+const productBatchSize = 100
+
+// productInfo is the subset of the products service response the cart needs.
+type productInfo struct {
+	ID               uint    `json:"ID"`
+	Price            float64 `json:"price"`
+	Stock            int     `json:"stock"`
+	MinOrderQuantity int     `json:"minOrderQuantity"`
+	MaxPerOrder      int     `json:"maxPerOrder"`
+}
+
+// productLookup is the outcome of looking up one product: either the product
+// or ErrProductNotFound / ErrProductDeleted.
+type productLookup struct {
+	Product productInfo
+	Err     error
+}
+
+type cachedLookup struct {
+	lookup  productLookup
+	expires time.Time
+}
+
+// productClient fetches products from the products service in batches and
+// keeps the results for a short time to absorb repeated lookups.
+type productClient struct {
+	baseURL string
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	cache map[uint]cachedLookup
+}
+
+func newProductClient(baseURL string, ttl time.Duration) *productClient {
+	return &productClient{
+		baseURL: baseURL,
+		ttl:     ttl,
+		cache:   make(map[uint]cachedLookup),
+	}
+}
+
+// Get returns a single product.
+func (c *productClient) Get(ctx context.Context, id uint) (*productInfo, error) {
+	lookups, err := c.GetMany(ctx, []uint{id}, false)
+	if err != nil {
+		return nil, err
+	}
+	lookup := lookups[id]
+	if lookup.Err != nil {
+		return nil, lookup.Err
+	}
+	return &lookup.Product, nil
+}
+
+// GetMany returns a lookup for every id. Cached entries are used unless fresh
+// is set; everything else is fetched with as few requests as possible.
+func (c *productClient) GetMany(ctx context.Context, ids []uint, fresh bool) (map[uint]productLookup, error) {
+	lookups := make(map[uint]productLookup, len(ids))
+	var missing []uint
+
+	now := time.Now()
+	c.mu.Lock()
+	for _, id := range ids {
+		if entry, ok := c.cache[id]; ok && !fresh && now.Before(entry.expires) {
+			lookups[id] = entry.lookup
+			continue
+		}
+		missing = append(missing, id)
+	}
+	c.mu.Unlock()
+
+	for start := 0; start < len(missing); start += productBatchSize {
+		end := start + productBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		fetched, err := c.fetchBatch(ctx, missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		expires := time.Now().Add(c.ttl)
+		c.mu.Lock()
+		for id, lookup := range fetched {
+			lookups[id] = lookup
+			c.cache[id] = cachedLookup{lookup: lookup, expires: expires}
+		}
+		c.mu.Unlock()
+	}
+	c.evictExpired(now)
+	return lookups, nil
+}
+
+func (c *productClient) evictExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, id)
+		}
+	}
+}
+
+func (c *productClient) fetchBatch(ctx context.Context, ids []uint) (map[uint]productLookup, error) {
+	body, err := json.Marshal(map[string][]uint{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/api/products/batch", c.baseURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create products request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch products: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch products: unexpected status %d", resp.StatusCode)
+	}
+
+	var batch struct {
+		Products []productInfo `json:"products"`
+		Deleted  []uint        `json:"deleted"`
+		Missing  []uint        `json:"missing"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to decode products: %v", err)
+	}
+
+	lookups := make(map[uint]productLookup, len(ids))
+	for _, product := range batch.Products {
+		lookups[product.ID] = productLookup{Product: product}
+	}
+	for _, id := range batch.Deleted {
+		lookups[id] = productLookup{Err: ErrProductDeleted}
+	}
+	for _, id := range batch.Missing {
+		lookups[id] = productLookup{Err: ErrProductNotFound}
+	}
+	return lookups, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchServer answers batch lookups the way the products service does:
+// product 1 is live, product 2 deleted and every other ID missing. It counts
+// the requests it gets.
+func batchServer(t *testing.T, requests *int32) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		var req struct {
+			IDs []uint `json:"ids"`
+		}
+		if r.URL.Path != "/api/products/batch" || json.NewDecoder(r.Body).Decode(&req) != nil || len(req.IDs) > productBatchSize {
+			http.Error(w, "bad batch request", http.StatusBadRequest)
+			return
+		}
+		batch := map[string][]interface{}{"products": {}, "deleted": {}, "missing": {}}
+		for _, id := range req.IDs {
+			switch id {
+			case 1:
+				batch["products"] = append(batch["products"], map[string]interface{}{"ID": 1, "price": 10, "stock": 5})
+			case 2:
+				batch["deleted"] = append(batch["deleted"], id)
+			default:
+				batch["missing"] = append(batch["missing"], id)
+			}
+		}
+		json.NewEncoder(w).Encode(batch)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestProductClientGetMany(t *testing.T) {
+	ctx := context.Background()
+	var requests int32
+	client := newProductClient(batchServer(t, &requests), time.Minute)
+
+	lookups, err := client.GetMany(ctx, []uint{1, 2, 3}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := lookups[1]; got.Err != nil || got.Product.ID != 1 || got.Product.Price != 10 {
+		t.Errorf("product 1: %+v, want it live", got)
+	}
+	if got := lookups[2].Err; !errors.Is(got, ErrProductDeleted) {
+		t.Errorf("product 2: %v, want %v", got, ErrProductDeleted)
+	}
+	if got := lookups[3].Err; !errors.Is(got, ErrProductNotFound) {
+		t.Errorf("product 3: %v, want %v", got, ErrProductNotFound)
+	}
+
+	// Deleted and missing products are cached as well, unless fresh is set
+	if _, err := client.GetMany(ctx, []uint{1, 2, 3}, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+	if _, err := client.GetMany(ctx, []uint{1, 2, 3}, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+
+	// Lookups beyond the products service limit are split into batches
+	ids := make([]uint, productBatchSize+10)
+	for i := range ids {
+		ids[i] = uint(i + 100)
+	}
+	lookups, err = client.GetMany(ctx, ids, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lookups) != len(ids) {
+		t.Errorf("%d lookups, want %d", len(lookups), len(ids))
+	}
+	if got := atomic.LoadInt32(&requests); got != 4 {
+		t.Errorf("%d requests, want 4", got)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	PromotionPercentage   = "percentage"
+	PromotionFixedAmount  = "fixed_amount"
+	PromotionBuyXGetY     = "buy_x_get_y"
+	PromotionFreeShipping = "free_shipping"
+)
+
+// Promotion is a discount rule. Promotions with a Code are coupons that the
+// shopper has to apply; promotions without one apply automatically.
+type Promotion struct {
+	ID          string `json:"id"`
+	Code        string `json:"code,omitempty"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	// Value is the percentage for percentage promotions and the amount for
+	// fixed amount promotions
+	Value float64 `json:"value,omitempty"`
+	// ProductIDs restricts the promotion to these products; empty means all
+	ProductIDs []uint `json:"productIds,omitempty"`
+	// BuyQuantity and GetQuantity define buy-X-get-Y: for every BuyQuantity
+	// units paid, GetQuantity more units of the same product are free
+	BuyQuantity  int        `json:"buyQuantity,omitempty"`
+	GetQuantity  int        `json:"getQuantity,omitempty"`
+	MinCartTotal float64    `json:"minCartTotal,omitempty"`
+	StartsAt     *time.Time `json:"startsAt,omitempty"`
+	EndsAt       *time.Time `json:"endsAt,omitempty"`
+	// UsageLimit and PerUserLimit cap redemptions; zero means unlimited
+	UsageLimit   int `json:"usageLimit,omitempty"`
+	PerUserLimit int `json:"perUserLimit,omitempty"`
+	// Stackable promotions combine with each other. A non-stackable
+	// promotion is only used when it beats all stackable ones together.
+	Stackable bool `json:"stackable"`
+}
+
+// DiscountLine is one promotion applied to a cart.
+type DiscountLine struct {
+	PromotionID  string  `json:"promotionId"`
+	Code         string  `json:"code,omitempty"`
+	Description  string  `json:"description"`
+	Amount       float64 `json:"amount"`
+	FreeShipping bool    `json:"freeShipping,omitempty"`
+}
+
+var (
+	ErrPromotionNotFound    = errors.New("coupon not found")
+	ErrPromotionInactive    = errors.New("coupon is not active")
+	ErrPromotionExhausted   = errors.New("coupon usage limit reached")
+	ErrPromotionNotEligible = errors.New("cart is not eligible for this coupon")
+	ErrInvalidPromotion     = errors.New("invalid promotion")
+)
+
+// redeemScript checks the usage limits of every promotion and only then
+// increments all counters, so a redemption either fully succeeds or leaves
+// the counters untouched. KEYS come in pairs of total and per-user counters,
+// ARGV holds the matching limits. Returns 0 on success or the 1-based pair
+// index of the first exhausted promotion.
+var redeemScript = redis.NewScript(`
+for i = 1, #KEYS, 2 do
+	local total = tonumber(redis.call('GET', KEYS[i]) or '0')
+	local user = tonumber(redis.call('GET', KEYS[i + 1]) or '0')
+	local limit = tonumber(ARGV[i])
+	local userLimit = tonumber(ARGV[i + 1])
+	if (limit > 0 and total >= limit) or (userLimit > 0 and user >= userLimit) then
+		return (i + 1) / 2
+	end
+end
+for i = 1, #KEYS, 2 do
+	redis.call('INCR', KEYS[i])
+	redis.call('INCR', KEYS[i + 1])
+end
+return 0
+`)
+
+// releaseScript undoes a redemption, decrementing every counter in KEYS that
+// is still above zero.
+var releaseScript = redis.NewScript(`
+for i = 1, #KEYS do
+	if tonumber(redis.call('GET', KEYS[i]) or '0') > 0 then
+		redis.call('DECR', KEYS[i])
+	end
+end
+return 0
+`)
+
+type PromotionService struct {
+	redisClient *redis.Client
+}
+
+func NewPromotionService(redisClient *redis.Client) *PromotionService {
+	return &PromotionService{redisClient: redisClient}
+}
+
+func promotionKey(id string) string {
+	return "promotion:" + id
+}
+
+func promotionCodeKey(code string) string {
+	return "promotion:code:" + code
+}
+
+func promotionUsageKey(id string) string {
+	return "promotion:" + id + ":uses"
+}
+
+func promotionUserUsageKey(id string, userID uint) string {
+	return fmt.Sprintf("promotion:%s:uses:%d", id, userID)
+}
+
+const promotionIndexKey = "promotions"
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func validatePromotion(p *Promotion) error {
+	switch p.Type {
+	case PromotionPercentage:
+		if p.Value <= 0 || p.Value > 100 {
+			return fmt.Errorf("%w: percentage must be between 0 and 100", ErrInvalidPromotion)
+		}
+	case PromotionFixedAmount:
+		if p.Value <= 0 {
+			return fmt.Errorf("%w: amount must be positive", ErrInvalidPromotion)
+		}
+	case PromotionBuyXGetY:
+		if p.BuyQuantity <= 0 || p.GetQuantity <= 0 {
+			return fmt.Errorf("%w: buyQuantity and getQuantity must be positive", ErrInvalidPromotion)
+		}
+	case PromotionFreeShipping:
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidPromotion, p.Type)
+	}
+	if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+		return fmt.Errorf("%w: endsAt must be after startsAt", ErrInvalidPromotion)
+	}
+	if p.MinCartTotal < 0 || p.UsageLimit < 0 || p.PerUserLimit < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidPromotion)
+	}
+	return nil
+}
+
+// CreatePromotion stores a new promotion. Coupon codes are case-insensitive
+// and must be unique.
+func (s *PromotionService) CreatePromotion(ctx context.Context, p *Promotion) error {
+	if err := validatePromotion(p); err != nil {
+		return err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	p.ID = hex.EncodeToString(b)
+	p.Code = normalizeCode(p.Code)
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if p.Code != "" {
+		ok, err := s.redisClient.SetNX(ctx, promotionCodeKey(p.Code), p.ID, 0).Result()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: code %q already exists", ErrInvalidPromotion, p.Code)
+		}
+	}
+
+	_, err = s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, promotionKey(p.ID), data, 0)
+		pipe.SAdd(ctx, promotionIndexKey, p.ID)
+		return nil
+	})
+	return err
+}
+
+func (s *PromotionService) GetPromotion(ctx context.Context, id string) (*Promotion, error) {
+	data, err := s.redisClient.Get(ctx, promotionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrPromotionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Promotion
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *PromotionService) GetPromotionByCode(ctx context.Context, code string) (*Promotion, error) {
+	id, err := s.redisClient.Get(ctx, promotionCodeKey(normalizeCode(code))).Result()
+	if err == redis.Nil {
+		return nil, ErrPromotionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetPromotion(ctx, id)
+}
+
+func (s *PromotionService) ListPromotions(ctx context.Context) ([]Promotion, error) {
+	ids, err := s.redisClient.SMembers(ctx, promotionIndexKey).Result()
+	if err != nil || len(ids) == 0 {
+		return []Promotion{}, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, promotionKey(id))
+	}
+	values, err := s.redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	promotions := make([]Promotion, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var p Promotion
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, nil
+}
+
+func (s *PromotionService) DeletePromotion(ctx context.Context, id string) error {
+	p, err := s.GetPromotion(ctx, id)
+	if err != nil {
+		return err
+	}
+	_, err = s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, promotionKey(id))
+		pipe.SRem(ctx, promotionIndexKey, id)
+		if p.Code != "" {
+			pipe.Del(ctx, promotionCodeKey(p.Code))
+		}
+		return nil
+	})
+	return err
+}
+
+// CheckCoupon verifies that a coupon exists, is within its validity window
+// and has redemptions left, for the given user if any.
+func (s *PromotionService) CheckCoupon(ctx context.Context, code string, owner CartOwner) (*Promotion, error) {
+	p, err := s.GetPromotionByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if !p.activeAt(time.Now()) {
+		return nil, ErrPromotionInactive
+	}
+	exhausted, err := s.isExhausted(ctx, p, owner)
+	if err != nil {
+		return nil, err
+	}
+	if exhausted {
+		return nil, ErrPromotionExhausted
+	}
+	return p, nil
+}
+
+func (s *PromotionService) isExhausted(ctx context.Context, p *Promotion, owner CartOwner) (bool, error) {
+	if p.UsageLimit > 0 {
+		used, err := s.redisClient.Get(ctx, promotionUsageKey(p.ID)).Int()
+		if err != nil && err != redis.Nil {
+			return false, err
+		}
+		if used >= p.UsageLimit {
+			return true, nil
+		}
+	}
+	if p.PerUserLimit > 0 && !owner.IsGuest() {
+		used, err := s.redisClient.Get(ctx, promotionUserUsageKey(p.ID, owner.UserID)).Int()
+		if err != nil && err != redis.Nil {
+			return false, err
+		}
+		if used >= p.PerUserLimit {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Redeem records one use of each promotion by the user, failing without
+// recording anything if any of them has reached a usage limit.
+func (s *PromotionService) Redeem(ctx context.Context, userID uint, promotionIDs []string) error {
+	if len(promotionIDs) == 0 {
+		return nil
+	}
+
+	promotions := make([]*Promotion, 0, len(promotionIDs))
+	keys := make([]string, 0, 2*len(promotionIDs))
+	limits := make([]interface{}, 0, 2*len(promotionIDs))
+	for _, id := range promotionIDs {
+		p, err := s.GetPromotion(ctx, id)
+		if err != nil {
+			return err
+		}
+		promotions = append(promotions, p)
+		keys = append(keys, promotionUsageKey(id), promotionUserUsageKey(id, userID))
+		limits = append(limits, p.UsageLimit, p.PerUserLimit)
+	}
+
+	failed, err := redeemScript.Run(ctx, s.redisClient, keys, limits...).Int()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %s", ErrPromotionExhausted, promotions[failed-1].Description)
+	}
+	return nil
+}
+
+// Release gives back the uses recorded by Redeem, for an order that could not
+// be placed after its promotions were redeemed.
+func (s *PromotionService) Release(ctx context.Context, userID uint, promotionIDs []string) error {
+	if len(promotionIDs) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(promotionIDs))
+	for _, id := range promotionIDs {
+		keys = append(keys, promotionUsageKey(id), promotionUserUsageKey(id, userID))
+	}
+	return releaseScript.Run(ctx, s.redisClient, keys).Err()
+}
+
+func (p *Promotion) activeAt(now time.Time) bool {
+	if p.StartsAt != nil && now.Before(*p.StartsAt) {
+		return false
+	}
+	if p.EndsAt != nil && !now.Before(*p.EndsAt) {
+		return false
+	}
+	return true
+}
+
+func (p *Promotion) appliesTo(productID uint) bool {
+	if len(p.ProductIDs) == 0 {
+		return true
+	}
+	for _, id := range p.ProductIDs {
+		if id == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// discount returns what the promotion takes off the cart and whether the
+// cart qualifies for it at all.
+func (p *Promotion) discount(cart *Cart) (float64, bool) {
+	if cart.Subtotal < p.MinCartTotal {
+		return 0, false
+	}
+
+	eligible := 0.0
+	for _, item := range cart.Items {
+		if p.appliesTo(item.ProductID) {
+			eligible += item.Price * float64(item.Quantity)
+		}
+	}
+	if eligible == 0 && p.Type != PromotionFreeShipping {
+		return 0, false
+	}
+
+	switch p.Type {
+	case PromotionPercentage:
+		return eligible * p.Value / 100, true
+	case PromotionFixedAmount:
+		return math.Min(p.Value, eligible), true
+	case PromotionBuyXGetY:
+		amount := 0.0
+		for _, item := range cart.Items {
+			if !p.appliesTo(item.ProductID) {
+				continue
+			}
+			free := item.Quantity / (p.BuyQuantity + p.GetQuantity) * p.GetQuantity
+			amount += float64(free) * item.Price
+		}
+		return amount, amount > 0
+	case PromotionFreeShipping:
+		return 0, true
+	}
+	return 0, false
+}
+
+// ApplyPromotions prices the cart: it computes the subtotal, evaluates the
+// automatic promotions and the applied coupons, resolves stacking and sets
+// the discount lines and total. Coupons that no longer exist are dropped.
+func (s *PromotionService) ApplyPromotions(ctx context.Context, cart *Cart) error {
+	cart.Subtotal = 0
+	for _, item := range cart.Items {
+		cart.Subtotal += item.Price * float64(item.Quantity)
+	}
+	cart.Subtotal = roundCents(cart.Subtotal)
+
+	candidates, err := s.ListPromotions(ctx)
+	if err != nil {
+		return err
+	}
+	applied := make(map[string]bool, len(cart.CouponCodes))
+	for _, code := range cart.CouponCodes {
+		applied[code] = true
+	}
+
+	now := time.Now()
+	codes := make([]string, 0, len(cart.CouponCodes))
+	var stackable, shipping []DiscountLine
+	var best *DiscountLine
+	stackableTotal := 0.0
+
+	for i := range candidates {
+		p := &candidates[i]
+		if p.Code != "" {
+			if !applied[p.Code] {
+				continue
+			}
+			codes = append(codes, p.Code)
+		}
+		if !p.activeAt(now) {
+			continue
+		}
+		amount, ok := p.discount(cart)
+		if !ok {
+			continue
+		}
+
+		line := DiscountLine{
+			PromotionID:  p.ID,
+			Code:         p.Code,
+			Description:  p.Description,
+			Amount:       roundCents(amount),
+			FreeShipping: p.Type == PromotionFreeShipping,
+		}
+		switch {
+		case line.FreeShipping:
+			shipping = append(shipping, line)
+		case p.Stackable:
+			stackable = append(stackable, line)
+			stackableTotal += line.Amount
+		case best == nil || line.Amount > best.Amount:
+			best = &line
+		}
+	}
+
+	discounts := shipping
+	if best != nil && best.Amount > stackableTotal {
+		discounts = append(discounts, *best)
+	} else {
+		discounts = append(discounts, stackable...)
+	}
+
+	cart.CouponCodes = codes
+	cart.Discounts = discounts
+	cart.DiscountTotal = 0
+	cart.FreeShipping = false
+	for _, line := range discounts {
+		cart.DiscountTotal += line.Amount
+		cart.FreeShipping = cart.FreeShipping || line.FreeShipping
+	}
+	cart.DiscountTotal = roundCents(math.Min(cart.DiscountTotal, cart.Subtotal))
+	cart.Total = roundCents(cart.Subtotal - cart.DiscountTotal)
+	return nil
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// ApplyCoupon adds a coupon code to the cart after checking that it is
+// valid and that the cart qualifies for it.
+func (s *CartService) ApplyCoupon(ctx context.Context, owner CartOwner, code string) (*Cart, error) {
+	p, err := s.promotions.CheckCoupon(ctx, code, owner)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateCart(ctx, owner, anyCartVersion, func(cart *Cart) error {
+		subtotal := 0.0
+		for _, item := range cart.Items {
+			subtotal += item.Price * float64(item.Quantity)
+		}
+		cart.Subtotal = subtotal
+		if _, ok := p.discount(cart); !ok {
+			return ErrPromotionNotEligible
+		}
+		if !containsCode(cart.CouponCodes, p.Code) {
+			cart.CouponCodes = append(cart.CouponCodes, p.Code)
+		}
+		return nil
+	})
+}
+
+// RemoveCoupon takes a coupon code off the cart.
+func (s *CartService) RemoveCoupon(ctx context.Context, owner CartOwner, code string) (*Cart, error) {
+	code = normalizeCode(code)
+	return s.updateCart(ctx, owner, anyCartVersion, func(cart *Cart) error {
+		codes := cart.CouponCodes[:0]
+		for _, existing := range cart.CouponCodes {
+			if existing != code {
+				codes = append(codes, existing)
+			}
+		}
+		cart.CouponCodes = codes
+		return nil
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import "context"
+
+const (
+	ChangePriceIncreased    = "price_increased"
+	ChangePriceDecreased    = "price_decreased"
+	ChangeQuantityReduced   = "quantity_reduced"
+	ChangeQuantityIncreased = "quantity_increased"
+	ChangeItemUnavailable   = "unavailable"
+	ChangeDiscountChanged   = "discount_changed"
+)
+
+// ChangeNotice tells the shopper how a cart line changed during revalidation.
+type ChangeNotice struct {
+	ProductID   uint    `json:"productId"`
+	Type        string  `json:"type"`
+	OldPrice    float64 `json:"oldPrice,omitempty"`
+	NewPrice    float64 `json:"newPrice,omitempty"`
+	OldQuantity int     `json:"oldQuantity,omitempty"`
+	NewQuantity int     `json:"newQuantity,omitempty"`
+	OldDiscount float64 `json:"oldDiscount,omitempty"`
+	NewDiscount float64 `json:"newDiscount,omitempty"`
+}
+
+// RevalidateCart refreshes every line against current product prices, stock
+// and order limits. Unavailable products, and products whose minimum order
+// quantity exceeds what can be ordered, are removed; other quantities are
+// brought within the limits. The returned notices describe each change made.
+func (s *CartService) RevalidateCart(ctx context.Context, owner CartOwner) (*Cart, []ChangeNotice, error) {
+	current, err := s.GetCart(ctx, owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(current.Items) == 0 {
+		return current, []ChangeNotice{}, nil
+	}
+
+	ids := make([]uint, 0, len(current.Items))
+	for _, item := range current.Items {
+		ids = append(ids, item.ProductID)
+	}
+	// Revalidation is the last check before checkout, so skip the cache
+	products, err := s.products.GetMany(ctx, ids, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var notices []ChangeNotice
+	cart, err := s.updateCart(ctx, owner, anyCartVersion, func(cart *Cart) error {
+		notices = revalidateItems(cart, products)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Expired or exhausted promotions show up as a changed discount
+	if cart.DiscountTotal != current.DiscountTotal {
+		notices = append(notices, ChangeNotice{
+			Type:        ChangeDiscountChanged,
+			OldDiscount: current.DiscountTotal,
+			NewDiscount: cart.DiscountTotal,
+		})
+	}
+	return cart, notices, nil
+}
+
+// revalidateItems brings the lines of cart within the current price, stock
+// and order limits of products and returns a notice for each change. Lines
+// whose product was not looked up are left alone.
+func revalidateItems(cart *Cart, products map[uint]productLookup) []ChangeNotice {
+	notices := []ChangeNotice{}
+	items := cart.Items[:0]
+	for _, item := range cart.Items {
+		lookup, ok := products[item.ProductID]
+		if !ok {
+			// Added after the products were fetched, leave it alone
+			items = append(items, item)
+			continue
+		}
+		product := lookup.Product
+		limit := maxLineQuantity(&product)
+		if lookup.Err != nil || limit <= 0 || limit < product.MinOrderQuantity {
+			notices = append(notices, ChangeNotice{
+				ProductID:   item.ProductID,
+				Type:        ChangeItemUnavailable,
+				OldQuantity: item.Quantity,
+			})
+			continue
+		}
+		if product.Price != item.Price {
+			change := ChangePriceDecreased
+			if product.Price > item.Price {
+				change = ChangePriceIncreased
+			}
+			notices = append(notices, ChangeNotice{
+				ProductID: item.ProductID,
+				Type:      change,
+				OldPrice:  item.Price,
+				NewPrice:  product.Price,
+			})
+			item.Price = product.Price
+		}
+		switch {
+		case item.Quantity > limit:
+			notices = append(notices, ChangeNotice{
+				ProductID:   item.ProductID,
+				Type:        ChangeQuantityReduced,
+				OldQuantity: item.Quantity,
+				NewQuantity: limit,
+			})
+			item.Quantity = limit
+		case item.Quantity < product.MinOrderQuantity:
+			notices = append(notices, ChangeNotice{
+				ProductID:   item.ProductID,
+				Type:        ChangeQuantityIncreased,
+				OldQuantity: item.Quantity,
+				NewQuantity: product.MinOrderQuantity,
+			})
+			item.Quantity = product.MinOrderQuantity
+		}
+		items = append(items, item)
+	}
+	cart.Items = items
+	return notices
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRevalidateItems(t *testing.T) {
+	products := map[uint]productLookup{
+		1:  {Product: productInfo{ID: 1, Price: 10, Stock: 100}},
+		2:  {Product: productInfo{ID: 2, Price: 12, Stock: 100}},
+		3:  {Product: productInfo{ID: 3, Price: 8, Stock: 100}},
+		4:  {Product: productInfo{ID: 4, Price: 10, Stock: 3}},
+		5:  {Product: productInfo{ID: 5, Price: 10, Stock: 100, MaxPerOrder: 2}},
+		6:  {Product: productInfo{ID: 6, Price: 10, Stock: 100, MinOrderQuantity: 4}},
+		7:  {Product: productInfo{ID: 7, Price: 10, Stock: 0}},
+		8:  {Product: productInfo{ID: 8, Price: 10, Stock: 3, MinOrderQuantity: 4}},
+		9:  {Err: ErrProductDeleted},
+		10: {Err: ErrProductNotFound},
+	}
+
+	tests := []struct {
+		name        string
+		items       []CartItem
+		wantItems   []CartItem
+		wantNotices []ChangeNotice
+	}{
+		{
+			name:        "unchanged",
+			items:       []CartItem{{ProductID: 1, Quantity: 2, Price: 10}},
+			wantItems:   []CartItem{{ProductID: 1, Quantity: 2, Price: 10}},
+			wantNotices: []ChangeNotice{},
+		},
+		{
+			name:        "price increased",
+			items:       []CartItem{{ProductID: 2, Quantity: 1, Price: 10}},
+			wantItems:   []CartItem{{ProductID: 2, Quantity: 1, Price: 12}},
+			wantNotices: []ChangeNotice{{ProductID: 2, Type: ChangePriceIncreased, OldPrice: 10, NewPrice: 12}},
+		},
+		{
+			name:        "price decreased",
+			items:       []CartItem{{ProductID: 3, Quantity: 1, Price: 10}},
+			wantItems:   []CartItem{{ProductID: 3, Quantity: 1, Price: 8}},
+			wantNotices: []ChangeNotice{{ProductID: 3, Type: ChangePriceDecreased, OldPrice: 10, NewPrice: 8}},
+		},
+		{
+			name:        "quantity reduced to the stock",
+			items:       []CartItem{{ProductID: 4, Quantity: 5, Price: 10}},
+			wantItems:   []CartItem{{ProductID: 4, Quantity: 3, Price: 10}},
+			wantNotices: []ChangeNotice{{ProductID: 4, Type: ChangeQuantityReduced, OldQuantity: 5, NewQuantity: 3}},
+		},
+		{
+			name:        "quantity reduced to the order limit",
+			items:       []CartItem{{ProductID: 5, Quantity: 5, Price: 10}},
+			wantItems:   []CartItem{{ProductID: 5, Quantity: 2, Price: 10}},
+			wantNotices: []ChangeNotice{{ProductID: 5, Type: ChangeQuantityReduced, OldQuantity: 5, NewQuantity: 2}},
+		},
+		{
+			name:        "quantity raised to a new minimum",
+			items:       []CartItem{{ProductID: 6, Quantity: 1, Price: 10}},
+			wantItems:   []CartItem{{ProductID: 6, Quantity: 4, Price: 10}},
+			wantNotices: []ChangeNotice{{ProductID: 6, Type: ChangeQuantityIncreased, OldQuantity: 1, NewQuantity: 4}},
+		},
+		{
+			name:      "price and quantity both change",
+			items:     []CartItem{{ProductID: 4, Quantity: 5, Price: 9}},
+			wantItems: []CartItem{{ProductID: 4, Quantity: 3, Price: 10}},
+			wantNotices: []ChangeNotice{
+				{ProductID: 4, Type: ChangePriceIncreased, OldPrice: 9, NewPrice: 10},
+				{ProductID: 4, Type: ChangeQuantityReduced, OldQuantity: 5, NewQuantity: 3},
+			},
+		},
+		{
+			name: "unavailable products are removed",
+			items: []CartItem{
+				{ProductID: 7, Quantity: 1, Price: 10},
+				{ProductID: 1, Quantity: 1, Price: 10},
+				{ProductID: 8, Quantity: 4, Price: 10},
+				{ProductID: 9, Quantity: 2, Price: 10},
+				{ProductID: 10, Quantity: 3, Price: 10},
+			},
+			wantItems: []CartItem{{ProductID: 1, Quantity: 1, Price: 10}},
+			wantNotices: []ChangeNotice{
+				{ProductID: 7, Type: ChangeItemUnavailable, OldQuantity: 1},
+				{ProductID: 8, Type: ChangeItemUnavailable, OldQuantity: 4},
+				{ProductID: 9, Type: ChangeItemUnavailable, OldQuantity: 2},
+				{ProductID: 10, Type: ChangeItemUnavailable, OldQuantity: 3},
+			},
+		},
+		{
+			name:        "products that were not looked up are left alone",
+			items:       []CartItem{{ProductID: 11, Quantity: 50, Price: 1}},
+			wantItems:   []CartItem{{ProductID: 11, Quantity: 50, Price: 1}},
+			wantNotices: []ChangeNotice{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cart := &Cart{Items: tt.items}
+			notices := revalidateItems(cart, products)
+			if !reflect.DeepEqual(cart.Items, tt.wantItems) {
+				t.Errorf("items %+v, want %+v", cart.Items, tt.wantItems)
+			}
+			if !reflect.DeepEqual(notices, tt.wantNotices) {
+				t.Errorf("notices %+v, want %+v", notices, tt.wantNotices)
+			}
+		})
+	}
+}
+
+func TestRevalidateCartDiscount(t *testing.T) {
+	ctx := context.Background()
+	products := map[uint]productInfo{1: {ID: 1, Price: 10, Stock: 100}}
+	service := newTestCartService(t, NewMemoryCartStore(CartTTL{}), products)
+	promotion := &Promotion{Description: "10% off from 50", Type: PromotionPercentage, Value: 10, MinCartTotal: 50}
+	if err := service.promotions.CreatePromotion(ctx, promotion); err != nil {
+		t.Fatalf("failed to create promotion: %v", err)
+	}
+	owner := UserCart(7)
+	if _, err := service.AddToCart(ctx, owner, CartItem{ProductID: 1, Quantity: 5}, anyCartVersion); err != nil {
+		t.Fatalf("failed to add to cart: %v", err)
+	}
+
+	// A price drop takes the cart below the promotion minimum
+	products[1] = productInfo{ID: 1, Price: 9, Stock: 100}
+	cart, notices, err := service.RevalidateCart(ctx, owner)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ChangeNotice{
+		{ProductID: 1, Type: ChangePriceDecreased, OldPrice: 10, NewPrice: 9},
+		{Type: ChangeDiscountChanged, OldDiscount: 5, NewDiscount: 0},
+	}
+	if !reflect.DeepEqual(notices, want) {
+		t.Errorf("notices %+v, want %+v", notices, want)
+	}
+	if cart.Subtotal != 45 || cart.Total != 45 {
+		t.Errorf("subtotal %v, total %v; want 45, 45", cart.Subtotal, cart.Total)
+	}
+
+	// Revalidating again finds nothing to change
+	if _, notices, err := service.RevalidateCart(ctx, owner); err != nil || len(notices) != 0 {
+		t.Errorf("notices %+v, %v; want none", notices, err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	CartStoreRedis    = "redis"
+	CartStorePostgres = "postgres"
+	CartStoreMemory   = "memory"
+)
+
+// CartStore persists carts. Update is the only way to modify a cart and must
+// be atomic across all the carts it is given, retrying fn when a concurrent
+// update gets in the way, so fn may run more than once.
+type CartStore interface {
+	// Get returns the cart of owner, or an empty cart if there is none.
+	Get(ctx context.Context, owner CartOwner) (*Cart, error)
+	// Update loads the carts of owners in order, passes them to fn and saves
+	// them. fn may set an entry to nil to delete that cart.
+	Update(ctx context.Context, owners []CartOwner, fn func(carts []*Cart) error) error
+	Delete(ctx context.Context, owner CartOwner) error
+}
+
+// CartTTL is how long an untouched cart is kept. Zero keeps it indefinitely.
+type CartTTL struct {
+	User  time.Duration
+	Guest time.Duration
+}
+
+func (t CartTTL) For(owner CartOwner) time.Duration {
+	if owner.IsGuest() {
+		return t.Guest
+	}
+	return t.User
+}
+
+// expiresAt returns the expiry time for a cart written now, or nil if it
+// never expires.
+func (t CartTTL) expiresAt(owner CartOwner) *time.Time {
+	ttl := t.For(owner)
+	if ttl <= 0 {
+		return nil
+	}
+	expires := time.Now().Add(ttl)
+	return &expires
+}
+
+var errCartConflict = errors.New("cart was modified concurrently")
+
+func emptyCart(owner CartOwner) *Cart {
+	return &Cart{UserID: owner.UserID, GuestToken: owner.GuestToken, Items: []CartItem{}, Total: 0}
+}
+
+// MemoryCartStore keeps carts in process memory. It is meant for tests and
+// local development; carts are lost on restart.
+type MemoryCartStore struct {
+	mu    sync.Mutex
+	carts map[string]memoryCart
+	ttl   CartTTL
+}
+
+type memoryCart struct {
+	data      []byte
+	expiresAt *time.Time
+}
+
+func NewMemoryCartStore(ttl CartTTL) *MemoryCartStore {
+	return &MemoryCartStore{
+		carts: make(map[string]memoryCart),
+		ttl:   ttl,
+	}
+}
+
+func (s *MemoryCartStore) Get(ctx context.Context, owner CartOwner) (*Cart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(owner)
+}
+
+func (s *MemoryCartStore) Update(ctx context.Context, owners []CartOwner, fn func(carts []*Cart) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	carts := make([]*Cart, len(owners))
+	for i, owner := range owners {
+		cart, err := s.load(owner)
+		if err != nil {
+			return err
+		}
+		carts[i] = cart
+	}
+	if err := fn(carts); err != nil {
+		return err
+	}
+
+	for i, owner := range owners {
+		if carts[i] == nil {
+			delete(s.carts, owner.key())
+			continue
+		}
+		data, err := json.Marshal(carts[i])
+		if err != nil {
+			return err
+		}
+		s.carts[owner.key()] = memoryCart{data: data, expiresAt: s.ttl.expiresAt(owner)}
+	}
+	return nil
+}
+
+func (s *MemoryCartStore) Delete(ctx context.Context, owner CartOwner) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, owner.key())
+	return nil
+}
+
+// load decodes a copy of the stored cart so callers can mutate it freely.
+func (s *MemoryCartStore) load(owner CartOwner) (*Cart, error) {
+	entry, ok := s.carts[owner.key()]
+	if !ok || (entry.expiresAt != nil && time.Now().After(*entry.expiresAt)) {
+		return emptyCart(owner), nil
+	}
+	var cart Cart
+	if err := json.Unmarshal(entry.data, &cart); err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// WriteThroughCartStore serves carts from Redis and copies every change to
+// Postgres. A cart missing from Redis, after a flush or eviction, is restored
+// from the Postgres copy on first access.
+type WriteThroughCartStore struct {
+	cache   *RedisCartStore
+	durable *PostgresCartStore
+}
+
+func NewWriteThroughCartStore(cache *RedisCartStore, durable *PostgresCartStore) *WriteThroughCartStore {
+	return &WriteThroughCartStore{cache: cache, durable: durable}
+}
+
+func (s *WriteThroughCartStore) Get(ctx context.Context, owner CartOwner) (*Cart, error) {
+	if err := s.restore(ctx, owner); err != nil {
+		return nil, err
+	}
+	return s.cache.Get(ctx, owner)
+}
+
+func (s *WriteThroughCartStore) Update(ctx context.Context, owners []CartOwner, fn func(carts []*Cart) error) error {
+	for _, owner := range owners {
+		if err := s.restore(ctx, owner); err != nil {
+			return err
+		}
+	}
+
+	var saved []*Cart
+	err := s.cache.Update(ctx, owners, func(carts []*Cart) error {
+		if err := fn(carts); err != nil {
+			return err
+		}
+		saved = carts
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Redis has already committed, so a failed copy is logged rather than
+	// failing a request the client would then retry
+	for i, owner := range owners {
+		if err := s.durable.save(ctx, owner, saved[i]); err != nil {
+			log.Printf("Failed to write cart %s through to Postgres: %v", owner.key(), err)
+		}
+	}
+	return nil
+}
+
+func (s *WriteThroughCartStore) Delete(ctx context.Context, owner CartOwner) error {
+	if err := s.cache.Delete(ctx, owner); err != nil {
+		return err
+	}
+	return s.durable.Delete(ctx, owner)
+}
+
+// restore copies the Postgres cart into Redis if Redis does not have it.
+func (s *WriteThroughCartStore) restore(ctx context.Context, owner CartOwner) error {
+	exists, err := s.cache.exists(ctx, owner)
+	if err != nil || exists {
+		return err
+	}
+	cart, found, err := s.durable.find(ctx, owner)
+	if err != nil {
+		return fmt.Errorf("failed to load cart from Postgres: %w", err)
+	}
+	if !found {
+		return nil
+	}
+	return s.cache.restore(ctx, owner, cart)
+}
+
+// newCartStore builds the store selected by CART_STORE. Postgres is opened
+// for the postgres store and when write-through is enabled.
+func newCartStore(kind string, writeThrough bool, redisClient *redis.Client, ttl CartTTL) (CartStore, error) {
+	var db *gorm.DB
+	if kind == CartStorePostgres || writeThrough {
+		var err error
+		if db, err = openDatabase(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch kind {
+	case CartStoreRedis:
+		store := NewRedisCartStore(redisClient, ttl)
+		if writeThrough {
+			return NewWriteThroughCartStore(store, NewPostgresCartStore(db, ttl)), nil
+		}
+		return store, nil
+	case CartStorePostgres:
+		return NewPostgresCartStore(db, ttl), nil
+	case CartStoreMemory:
+		return NewMemoryCartStore(ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown cart store %q", kind)
+	}
+}
+
+func openDatabase() (*gorm.DB, error) {
+	dsn := "host=" + os.Getenv("DB_HOST") +
+		" user=" + os.Getenv("DB_USER") +
+		" password=" + os.Getenv("DB_PASSWORD") +
+		" dbname=" + os.Getenv("DB_NAME") +
+		" port=" + os.Getenv("DB_PORT") +
+		" sslmode=disable"
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := db.AutoMigrate(&CartRecord{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return db, nil
+}
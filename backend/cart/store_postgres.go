@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CartRecord is a cart stored in Postgres. The cart itself is kept as JSON;
+// Version mirrors Cart.Version and guards concurrent updates.
+type CartRecord struct {
+	Key        string     `gorm:"primaryKey"`
+	UserID     uint       `gorm:"index"`
+	GuestToken string     `gorm:"index"`
+	Data       string     `gorm:"type:jsonb;not null"`
+	Version    int64      `gorm:"not null"`
+	ExpiresAt  *time.Time `gorm:"index"`
+	UpdatedAt  time.Time
+}
+
+func (CartRecord) TableName() string {
+	return "carts"
+}
+
+func (r *CartRecord) expired() bool {
+	return r.ExpiresAt != nil && time.Now().After(*r.ExpiresAt)
+}
+
+// PostgresCartStore keeps carts in the carts table. Updates are optimistic:
+// each row is written only if its version is unchanged since it was read.
+type PostgresCartStore struct {
+	db  *gorm.DB
+	ttl CartTTL
+}
+
+func NewPostgresCartStore(db *gorm.DB, ttl CartTTL) *PostgresCartStore {
+	return &PostgresCartStore{db: db, ttl: ttl}
+}
+
+func (s *PostgresCartStore) Get(ctx context.Context, owner CartOwner) (*Cart, error) {
+	cart, found, err := s.find(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return emptyCart(owner), nil
+	}
+	return cart, nil
+}
+
+func (s *PostgresCartStore) Update(ctx context.Context, owners []CartOwner, fn func(carts []*Cart) error) error {
+	for attempt := 0; attempt < maxCartUpdateAttempts; attempt++ {
+		err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			records := make([]*CartRecord, len(owners))
+			carts := make([]*Cart, len(owners))
+			for i, owner := range owners {
+				record, cart, err := loadCartRecord(tx, owner)
+				if err != nil {
+					return err
+				}
+				records[i], carts[i] = record, cart
+			}
+			if err := fn(carts); err != nil {
+				return err
+			}
+			for i, owner := range owners {
+				if err := s.write(tx, owner, records[i], carts[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !errors.Is(err, errCartConflict) {
+			return err
+		}
+	}
+	return ErrCartContention
+}
+
+func (s *PostgresCartStore) Delete(ctx context.Context, owner CartOwner) error {
+	return s.db.WithContext(ctx).Where("key = ?", owner.key()).Delete(&CartRecord{}).Error
+}
+
+// find returns the stored cart and whether an unexpired one exists.
+func (s *PostgresCartStore) find(ctx context.Context, owner CartOwner) (*Cart, bool, error) {
+	record, cart, err := loadCartRecord(s.db.WithContext(ctx), owner)
+	if err != nil {
+		return nil, false, err
+	}
+	return cart, record != nil && !record.expired(), nil
+}
+
+// loadCartRecord returns the row for owner, if any, and the cart it holds.
+// Expired rows are returned so they can be overwritten, with an empty cart.
+func loadCartRecord(db *gorm.DB, owner CartOwner) (*CartRecord, *Cart, error) {
+	var record CartRecord
+	if err := db.Where("key = ?", owner.key()).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, emptyCart(owner), nil
+		}
+		return nil, nil, err
+	}
+	if record.expired() {
+		return &record, emptyCart(owner), nil
+	}
+	var cart Cart
+	if err := json.Unmarshal([]byte(record.Data), &cart); err != nil {
+		return nil, nil, err
+	}
+	return &record, &cart, nil
+}
+
+// write saves cart over the row read as record, failing with errCartConflict
+// if the row has been changed or created since.
+func (s *PostgresCartStore) write(tx *gorm.DB, owner CartOwner, record *CartRecord, cart *Cart) error {
+	var result *gorm.DB
+	switch {
+	case cart == nil && record == nil:
+		return nil
+	case cart == nil:
+		result = tx.Where("key = ? AND version = ?", record.Key, record.Version).Delete(&CartRecord{})
+	case record == nil:
+		row, err := s.newRecord(owner, cart)
+		if err != nil {
+			return err
+		}
+		result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(row)
+	default:
+		row, err := s.newRecord(owner, cart)
+		if err != nil {
+			return err
+		}
+		result = tx.Model(&CartRecord{}).
+			Where("key = ? AND version = ?", record.Key, record.Version).
+			Updates(map[string]interface{}{
+				"data":       row.Data,
+				"version":    row.Version,
+				"expires_at": row.ExpiresAt,
+				"updated_at": time.Now(),
+			})
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errCartConflict
+	}
+	return nil
+}
+
+// save writes cart unconditionally, as used for write-through copies. An
+// older version never overwrites a newer live one.
+func (s *PostgresCartStore) save(ctx context.Context, owner CartOwner, cart *Cart) error {
+	if cart == nil {
+		return s.Delete(ctx, owner)
+	}
+	row, err := s.newRecord(owner, cart)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "version", "expires_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "carts.version < excluded.version OR carts.expires_at <= now()"},
+		}},
+	}).Create(row).Error
+}
+
+func (s *PostgresCartStore) newRecord(owner CartOwner, cart *Cart) (*CartRecord, error) {
+	data, err := json.Marshal(cart)
+	if err != nil {
+		return nil, err
+	}
+	return &CartRecord{
+		Key:        owner.key(),
+		UserID:     owner.UserID,
+		GuestToken: owner.GuestToken,
+		Data:       string(data),
+		Version:    cart.Version,
+		ExpiresAt:  s.ttl.expiresAt(owner),
+	}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisCartStore keeps each cart as a JSON document under its owner's key,
+// expiring after the configured TTL. Updates WATCH the cart keys so a
+// concurrent write aborts the transaction and the update is retried.
+type RedisCartStore struct {
+	client *redis.Client
+	ttl    CartTTL
+}
+
+func NewRedisCartStore(client *redis.Client, ttl CartTTL) *RedisCartStore {
+	return &RedisCartStore{client: client, ttl: ttl}
+}
+
+func (s *RedisCartStore) Get(ctx context.Context, owner CartOwner) (*Cart, error) {
+	return decodeCart(owner, s.client.Get(ctx, owner.key()))
+}
+
+func (s *RedisCartStore) Update(ctx context.Context, owners []CartOwner, fn func(carts []*Cart) error) error {
+	keys := make([]string, len(owners))
+	for i, owner := range owners {
+		keys[i] = owner.key()
+	}
+
+	txf := func(tx *redis.Tx) error {
+		carts := make([]*Cart, len(owners))
+		for i, owner := range owners {
+			cart, err := decodeCart(owner, tx.Get(ctx, keys[i]))
+			if err != nil {
+				return err
+			}
+			carts[i] = cart
+		}
+		if err := fn(carts); err != nil {
+			return err
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, cart := range carts {
+				if cart == nil {
+					pipe.Del(ctx, keys[i])
+					continue
+				}
+				data, err := json.Marshal(cart)
+				if err != nil {
+					return err
+				}
+				pipe.Set(ctx, keys[i], data, s.ttl.For(owners[i]))
+			}
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < maxCartUpdateAttempts; attempt++ {
+		err := s.client.Watch(ctx, txf, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrCartContention
+}
+
+func (s *RedisCartStore) Delete(ctx context.Context, owner CartOwner) error {
+	return s.client.Del(ctx, owner.key()).Err()
+}
+
+func (s *RedisCartStore) exists(ctx context.Context, owner CartOwner) (bool, error) {
+	n, err := s.client.Exists(ctx, owner.key()).Result()
+	return n > 0, err
+}
+
+// restore seeds a cart that is missing from Redis, leaving it alone if
+// another request has written the key in the meantime.
+func (s *RedisCartStore) restore(ctx context.Context, owner CartOwner, cart *Cart) error {
+	data, err := json.Marshal(cart)
+	if err != nil {
+		return err
+	}
+	return s.client.SetNX(ctx, owner.key(), data, s.ttl.For(owner)).Err()
+}
+
+func decodeCart(owner CartOwner, cmd *redis.StringCmd) (*Cart, error) {
+	data, err := cmd.Bytes()
+	if err == redis.Nil {
+		return emptyCart(owner), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cart Cart
+	if err := json.Unmarshal(data, &cart); err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores opens each cart store; those needing Redis or Postgres are
+// skipped without them.
+var testStores = []struct {
+	name string
+	open func(t *testing.T) CartStore
+}{
+	{name: "memory", open: func(t *testing.T) CartStore {
+		return NewMemoryCartStore(CartTTL{})
+	}},
+	{name: "redis", open: func(t *testing.T) CartStore {
+		return NewRedisCartStore(testRedis(t), CartTTL{})
+	}},
+	{name: "postgres", open: func(t *testing.T) CartStore {
+		return NewPostgresCartStore(testDB(t), CartTTL{})
+	}},
+	{name: "write-through", open: func(t *testing.T) CartStore {
+		return NewWriteThroughCartStore(NewRedisCartStore(testRedis(t), CartTTL{}), NewPostgresCartStore(testDB(t), CartTTL{}))
+	}},
+}
+
+// addUnit adds one unit of product 1 to cart as a cart service update would,
+// bumping the version.
+func addUnit(cart *Cart) {
+	addCartItem(cart, 1, 1, 10)
+	cart.Version++
+}
+
+func TestCartStore(t *testing.T) {
+	ctx := context.Background()
+	user, guest := UserCart(7), GuestCart("0123456789abcdef0123456789abcdef")
+	errFailed := errors.New("update failed")
+
+	for _, store := range testStores {
+		t.Run(store.name, func(t *testing.T) {
+			t.Run("missing cart is empty", func(t *testing.T) {
+				cart, err := store.open(t).Get(ctx, guest)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if cart.GuestToken != guest.GuestToken || len(cart.Items) != 0 || cart.Version != 0 {
+					t.Errorf("cart %+v, want an empty guest cart", cart)
+				}
+			})
+
+			t.Run("update saves every cart", func(t *testing.T) {
+				s := store.open(t)
+				err := s.Update(ctx, []CartOwner{guest, user}, func(carts []*Cart) error {
+					addUnit(carts[0])
+					addUnit(carts[1])
+					addUnit(carts[1])
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				for owner, want := range map[CartOwner]int{guest: 1, user: 2} {
+					cart, err := s.Get(ctx, owner)
+					if err != nil || len(cart.Items) != 1 || cart.Items[0].Quantity != want || cart.Version != int64(want) {
+						t.Errorf("cart of %s %+v, %v; want %d units at version %d", owner.key(), cart, err, want, want)
+					}
+				}
+			})
+
+			t.Run("failed update saves nothing", func(t *testing.T) {
+				s := store.open(t)
+				if err := s.Update(ctx, []CartOwner{user}, func(carts []*Cart) error { addUnit(carts[0]); return nil }); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				err := s.Update(ctx, []CartOwner{guest, user}, func(carts []*Cart) error {
+					addUnit(carts[0])
+					carts[1] = nil
+					return errFailed
+				})
+				if !errors.Is(err, errFailed) {
+					t.Fatalf("got %v, want %v", err, errFailed)
+				}
+				if cart, err := s.Get(ctx, guest); err != nil || len(cart.Items) != 0 {
+					t.Errorf("guest cart %+v, %v; want it empty", cart, err)
+				}
+				if cart, err := s.Get(ctx, user); err != nil || cart.Version != 1 {
+					t.Errorf("user cart %+v, %v; want it kept", cart, err)
+				}
+			})
+
+			t.Run("nil deletes a cart", func(t *testing.T) {
+				s := store.open(t)
+				if err := s.Update(ctx, []CartOwner{guest, user}, func(carts []*Cart) error {
+					addUnit(carts[0])
+					addUnit(carts[1])
+					return nil
+				}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				// As when a guest cart is merged into the user's cart
+				if err := s.Update(ctx, []CartOwner{guest, user}, func(carts []*Cart) error {
+					carts[0] = nil
+					addUnit(carts[1])
+					return nil
+				}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if cart, err := s.Get(ctx, guest); err != nil || len(cart.Items) != 0 || cart.Version != 0 {
+					t.Errorf("guest cart %+v, %v; want it deleted", cart, err)
+				}
+				if cart, err := s.Get(ctx, user); err != nil || cart.Version != 2 {
+					t.Errorf("user cart %+v, %v; want version 2", cart, err)
+				}
+			})
+
+			t.Run("concurrent updates are not lost", func(t *testing.T) {
+				s := store.open(t)
+				const workers = 5
+				errs := make([]error, workers)
+				var wg sync.WaitGroup
+				for i := range errs {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						errs[i] = s.Update(ctx, []CartOwner{user}, func(carts []*Cart) error {
+							addUnit(carts[0])
+							return nil
+						})
+					}(i)
+				}
+				wg.Wait()
+
+				// Updates that kept losing the race give up rather than
+				// overwrite each other
+				applied := 0
+				for _, err := range errs {
+					switch {
+					case err == nil:
+						applied++
+					case !errors.Is(err, ErrCartContention):
+						t.Errorf("got %v, want %v", err, ErrCartContention)
+					}
+				}
+				cart, err := s.Get(ctx, user)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if applied == 0 || len(cart.Items) != 1 || cart.Items[0].Quantity != applied || cart.Version != int64(applied) {
+					t.Errorf("cart %+v after %d updates", cart, applied)
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryCartStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryCartStore(CartTTL{User: time.Hour, Guest: time.Nanosecond})
+	user, guest := UserCart(7), GuestCart("0123456789abcdef0123456789abcdef")
+	if err := store.Update(ctx, []CartOwner{guest, user}, func(carts []*Cart) error {
+		addUnit(carts[0])
+		addUnit(carts[1])
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if cart, err := store.Get(ctx, guest); err != nil || len(cart.Items) != 0 {
+		t.Errorf("guest cart %+v, %v; want it expired", cart, err)
+	}
+	if cart, err := store.Get(ctx, user); err != nil || len(cart.Items) != 1 {
+		t.Errorf("user cart %+v, %v; want it kept", cart, err)
+	}
+}
+
+func TestWriteThroughCartStore(t *testing.T) {
+	ctx := context.Background()
+	cache := NewRedisCartStore(testRedis(t), CartTTL{})
+	durable := NewPostgresCartStore(testDB(t), CartTTL{})
+	store := NewWriteThroughCartStore(cache, durable)
+	user := UserCart(7)
+
+	for i := 0; i < 2; i++ {
+		if err := store.Update(ctx, []CartOwner{user}, func(carts []*Cart) error { addUnit(carts[0]); return nil }); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if cart, err := durable.Get(ctx, user); err != nil || cart.Version != 2 {
+		t.Fatalf("Postgres copy %+v, %v; want version 2", cart, err)
+	}
+
+	// A copy that arrives late never replaces a newer one
+	stale := emptyCart(user)
+	addUnit(stale)
+	if err := durable.save(ctx, user, stale); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cart, err := durable.Get(ctx, user); err != nil || cart.Version != 2 {
+		t.Errorf("Postgres copy %+v, %v; want version 2 kept", cart, err)
+	}
+
+	// A cart lost from Redis comes back from Postgres
+	if err := cache.Delete(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cart, err := store.Get(ctx, user)
+	if err != nil || cart.Version != 2 || cart.Items[0].Quantity != 2 {
+		t.Fatalf("cart %+v, %v; want it restored at version 2", cart, err)
+	}
+	if err := store.Update(ctx, []CartOwner{user}, func(carts []*Cart) error { addUnit(carts[0]); return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cart, err := durable.Get(ctx, user); err != nil || cart.Version != 3 {
+		t.Errorf("Postgres copy %+v, %v; want version 3", cart, err)
+	}
+
+	if err := store.Delete(ctx, user); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cart, err := durable.Get(ctx, user); err != nil || cart.Version != 0 {
+		t.Errorf("Postgres copy %+v, %v; want it deleted", cart, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	LineErrorInvalidQuantity   = "invalid_quantity"
+	LineErrorBelowMinimum      = "below_min_order_quantity"
+	LineErrorAboveMaximum      = "above_max_per_order"
+	LineErrorInsufficientStock = "insufficient_stock"
+	LineErrorTooManyLines      = "too_many_lines"
+)
+
+// LineError reports a cart line that breaks a quantity rule. It is returned
+// to clients as a 422 naming the offending product and the limit it hit.
+type LineError struct {
+	Code      string `json:"code"`
+	Message   string `json:"error"`
+	ProductID uint   `json:"productId"`
+	Quantity  int    `json:"quantity"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+func (e *LineError) Error() string {
+	return e.Message
+}
+
+// checkLineQuantity validates the total quantity of a product in one cart
+// line against the product's order limits and stock.
+func checkLineQuantity(product *productInfo, quantity int) error {
+	lineErr := &LineError{ProductID: product.ID, Quantity: quantity}
+	switch {
+	case quantity <= 0:
+		lineErr.Code = LineErrorInvalidQuantity
+		lineErr.Message = fmt.Sprintf("quantity for product %d must be positive", product.ID)
+	case product.MinOrderQuantity > 0 && quantity < product.MinOrderQuantity:
+		lineErr.Code = LineErrorBelowMinimum
+		lineErr.Limit = product.MinOrderQuantity
+		lineErr.Message = fmt.Sprintf("product %d must be ordered in quantities of at least %d", product.ID, product.MinOrderQuantity)
+	case product.MaxPerOrder > 0 && quantity > product.MaxPerOrder:
+		lineErr.Code = LineErrorAboveMaximum
+		lineErr.Limit = product.MaxPerOrder
+		lineErr.Message = fmt.Sprintf("at most %d of product %d can be ordered", product.MaxPerOrder, product.ID)
+	case quantity > product.Stock:
+		lineErr.Code = LineErrorInsufficientStock
+		lineErr.Limit = product.Stock
+		lineErr.Message = fmt.Sprintf("only %d of product %d in stock", product.Stock, product.ID)
+	default:
+		return nil
+	}
+	return lineErr
+}
+
+// maxLineQuantity is the largest quantity of product a cart line may hold.
+func maxLineQuantity(product *productInfo) int {
+	if product.MaxPerOrder > 0 && product.MaxPerOrder < product.Stock {
+		return product.MaxPerOrder
+	}
+	return product.Stock
+}
+
+// clampLineQuantity brings quantity within the order limits and stock of
+// product. It reports false when no quantity of product can be ordered.
+func clampLineQuantity(product *productInfo, quantity int) (int, bool) {
+	limit := maxLineQuantity(product)
+	if limit <= 0 || limit < product.MinOrderQuantity {
+		return 0, false
+	}
+	return max(min(quantity, limit), product.MinOrderQuantity, 1), true
+}
+
+func lineQuantity(cart *Cart, productID uint) int {
+	for _, item := range cart.Items {
+		if item.ProductID == productID {
+			return item.Quantity
+		}
+	}
+	return 0
+}
+
+// setLine sets the quantity of the product's line at its current price,
+// adding the line if needed, once the quantity and the line cap check out.
+func (s *CartService) setLine(cart *Cart, product *productInfo, quantity int) error {
+	if err := checkLineQuantity(product, quantity); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, item := range cart.Items {
+		if item.ProductID == product.ID {
+			cart.Items[i].Quantity = quantity
+			cart.Items[i].Price = product.Price
+			cart.Items[i].UpdatedAt = now
+			return nil
+		}
+	}
+
+	if s.config.MaxLines > 0 && len(cart.Items) >= s.config.MaxLines {
+		return &LineError{
+			Code:      LineErrorTooManyLines,
+			Message:   fmt.Sprintf("a cart can hold at most %d different products", s.config.MaxLines),
+			ProductID: product.ID,
+			Quantity:  quantity,
+			Limit:     s.config.MaxLines,
+		}
+	}
+	cart.Items = append(cart.Items, CartItem{
+		ProductID: product.ID,
+		Quantity:  quantity,
+		Price:     product.Price,
+		UpdatedAt: now,
+	})
+	return nil
+}
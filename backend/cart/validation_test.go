@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckLineQuantity(t *testing.T) {
+	product := &productInfo{ID: 1, Stock: 10, MinOrderQuantity: 2, MaxPerOrder: 8}
+	tests := []struct {
+		quantity int
+		want     string
+	}{
+		{quantity: 0, want: LineErrorInvalidQuantity},
+		{quantity: 1, want: LineErrorBelowMinimum},
+		{quantity: 2},
+		{quantity: 8},
+		{quantity: 9, want: LineErrorAboveMaximum},
+		{quantity: 11, want: LineErrorAboveMaximum},
+	}
+	for _, tt := range tests {
+		err := checkLineQuantity(product, tt.quantity)
+		var lineErr *LineError
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("quantity %d: unexpected error %v", tt.quantity, err)
+		case tt.want != "" && (!errors.As(err, &lineErr) || lineErr.Code != tt.want):
+			t.Errorf("quantity %d: got %v, want %s", tt.quantity, err, tt.want)
+		}
+	}
+
+	unlimited := &productInfo{ID: 2, Stock: 3}
+	err := checkLineQuantity(unlimited, 4)
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) || lineErr.Code != LineErrorInsufficientStock || lineErr.Limit != 3 {
+		t.Errorf("got %v, want %s with limit 3", err, LineErrorInsufficientStock)
+	}
+}
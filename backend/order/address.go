@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidAddress = errors.New("invalid address")
+
+// Address is a postal address. Country is an ISO 3166-1 alpha-2 code and
+// Region the state or province code where the country uses one.
+type Address struct {
+	Line1      string `json:"line1" gorm:"not null;default:''"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city" gorm:"not null;default:''"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postalCode" gorm:"not null;default:''"`
+	Country    string `json:"country" gorm:"not null;default:''"`
+}
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// postalCodePatterns holds the postal code formats checked for known
+// countries. Other countries only need a non-empty postal code.
+var postalCodePatterns = map[string]*regexp.Regexp{
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"IN": regexp.MustCompile(`^\d{6}$`),
+	"AU": regexp.MustCompile(`^\d{4}$`),
+}
+
+// regionRequired lists the countries whose addresses need a region.
+var regionRequired = map[string]bool{
+	"US": true,
+	"CA": true,
+	"AU": true,
+	"IN": true,
+}
+
+// Normalize trims the address and upper-cases the codes in it.
+func (a *Address) Normalize() {
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.Region = strings.ToUpper(strings.TrimSpace(a.Region))
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+}
+
+// Validate normalizes the address and checks it is complete and well formed.
+func (a *Address) Validate() error {
+	a.Normalize()
+	switch {
+	case a.Line1 == "":
+		return fmt.Errorf("%w: line1 is required", ErrInvalidAddress)
+	case a.City == "":
+		return fmt.Errorf("%w: city is required", ErrInvalidAddress)
+	case !countryCodePattern.MatchString(a.Country):
+		return fmt.Errorf("%w: country must be a two-letter ISO code", ErrInvalidAddress)
+	case a.PostalCode == "":
+		return fmt.Errorf("%w: postalCode is required", ErrInvalidAddress)
+	case regionRequired[a.Country] && a.Region == "":
+		return fmt.Errorf("%w: region is required for %s", ErrInvalidAddress, a.Country)
+	}
+	if pattern, ok := postalCodePatterns[a.Country]; ok && !pattern.MatchString(a.PostalCode) {
+		return fmt.Errorf("%w: postalCode %q is not valid for %s", ErrInvalidAddress, a.PostalCode, a.Country)
+	}
+	return nil
+}
+
+// migrateLegacyAddress moves the free-text address column of orders created
+// before addresses were structured into line1, then drops it.
+func migrateLegacyAddress(db *gorm.DB) error {
+	if !db.Migrator().HasColumn("orders", "address") {
+		return nil
+	}
+	result := db.Exec("UPDATE orders SET address_line1 = address WHERE address_line1 = '' AND address IS NOT NULL")
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Moved %d legacy order addresses into address_line1", result.RowsAffected)
+	}
+	return db.Migrator().DropColumn("orders", "address")
+}
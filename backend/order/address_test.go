@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddressValidate(t *testing.T) {
+	valid := Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+	with := func(change func(*Address)) Address {
+		address := valid
+		change(&address)
+		return address
+	}
+
+	tests := []struct {
+		name    string
+		address Address
+		want    Address
+		wantErr bool
+	}{
+		{name: "valid", address: valid, want: valid},
+		{
+			name:    "normalized",
+			address: Address{Line1: " 1 Main St ", Line2: " Apt 2 ", City: " Springfield", Region: "il", PostalCode: "62701-1234 ", Country: "us"},
+			want:    Address{Line1: "1 Main St", Line2: "Apt 2", City: "Springfield", Region: "IL", PostalCode: "62701-1234", Country: "US"},
+		},
+		{
+			name:    "postal code of a known country",
+			address: Address{Line1: "10 Downing St", City: "London", PostalCode: "sw1a 2aa", Country: "GB"},
+			want:    Address{Line1: "10 Downing St", City: "London", PostalCode: "SW1A 2AA", Country: "GB"},
+		},
+		{
+			name:    "postal code of another country",
+			address: Address{Line1: "Rua Augusta 1", City: "Lisboa", PostalCode: "1100-053", Country: "PT"},
+			want:    Address{Line1: "Rua Augusta 1", City: "Lisboa", PostalCode: "1100-053", Country: "PT"},
+		},
+		{name: "no line1", address: with(func(a *Address) { a.Line1 = " " }), wantErr: true},
+		{name: "no city", address: with(func(a *Address) { a.City = "" }), wantErr: true},
+		{name: "country name", address: with(func(a *Address) { a.Country = "USA" }), wantErr: true},
+		{name: "no postal code", address: with(func(a *Address) { a.PostalCode = "" }), wantErr: true},
+		{name: "no region", address: with(func(a *Address) { a.Region = "" }), wantErr: true},
+		{name: "invalid postal code", address: with(func(a *Address) { a.PostalCode = "6270" }), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := tt.address
+			err := address.Validate()
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAddress) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidAddress)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if address != tt.want {
+				t.Errorf("address %+v, want %+v", address, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidCancellation = errors.New("invalid cancellation")
+
+// cancellableStatuses are the order statuses in which some items have not
+// left the warehouse yet and can still be cancelled.
+var cancellableStatuses = map[string]bool{
+	OrderStatusPending:           true,
+	OrderStatusAuthorized:        true,
+	OrderStatusPaymentFailed:     true,
+	OrderStatusPaid:              true,
+	OrderStatusPartiallyRefunded: true,
+	OrderStatusPartiallyShipped:  true,
+}
+
+// OrderCancellation records the cancellation of an order, or of some of its
+// items. Amount is the value of the cancelled items, and RefundID the refund
+// issued for them when the payment had already been captured.
+type OrderCancellation struct {
+	gorm.Model
+	OrderID  uint               `json:"orderId" gorm:"not null;index"`
+	Reason   string             `json:"reason" gorm:"not null"`
+	Amount   float64            `json:"amount" gorm:"not null"`
+	RefundID *uint              `json:"refundId,omitempty"`
+	Lines    []CancellationLine `json:"lines" gorm:"foreignKey:CancellationID"`
+}
+
+// CancellationLine is a cancelled quantity of an order item. Restocked
+// reports whether the quantity made it back into stock.
+type CancellationLine struct {
+	gorm.Model
+	CancellationID uint `json:"cancellationId" gorm:"not null;index"`
+	OrderItemID    uint `json:"orderItemId" gorm:"not null;index"`
+	ProductID      uint `json:"productId" gorm:"not null"`
+	Quantity       int  `json:"quantity" gorm:"not null"`
+	Restocked      bool `json:"restocked" gorm:"not null;default:false"`
+}
+
+// CancelItemRequest cancels quantity units of an order item.
+type CancelItemRequest struct {
+	OrderItemID uint `json:"orderItemId"`
+	Quantity    int  `json:"quantity"`
+}
+
+// CancelOrder cancels the given items of an order, or all of it without
+// items, and returns their quantities to stock. Money for cancelled items is
+// refunded when it was captured; an authorization is voided when the whole
+// order is cancelled, and otherwise only the rest of it is captured later.
+func (s *OrderService) CancelOrder(ctx context.Context, orderID uint, reason string, items []CancelItemRequest) (*OrderCancellation, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, fmt.Errorf("%w: reason is required", ErrInvalidCancellation)
+	}
+
+	var cancellation *OrderCancellation
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if !cancellableStatuses[order.Status] {
+			return fmt.Errorf("%w: a %s order cannot be cancelled", ErrInvalidOrderState, order.Status)
+		}
+		refunded, err := refundedItems(tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		allocated, err := allocatedQuantities(tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		cancellation, err = buildCancellation(order, reason, items, refunded, allocated)
+		if err != nil {
+			return err
+		}
+		cancelled := make(map[uint]int, len(cancellation.Lines))
+		for _, line := range cancellation.Lines {
+			cancelled[line.OrderItemID] = line.Quantity
+		}
+		full := true
+		for i := range order.Items {
+			item := &order.Items[i]
+			full = full && openQuantity(item, refunded) == cancelled[item.ID]
+		}
+
+		captured, err := s.payments.capturedAmount(tx, orderID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case captured > 0:
+			refundReq := RefundRequest{Reason: "other", Note: "Cancelled: " + reason}
+			// A partial cancellation refunds its lines; a full one everything
+			// left, shipping included
+			if !full {
+				for _, line := range cancellation.Lines {
+					refundReq.Lines = append(refundReq.Lines, RefundLineRequest{OrderItemID: line.OrderItemID, Quantity: line.Quantity})
+				}
+			}
+			refund, providerErr, err := s.refundLocked(ctx, tx, order, refundReq)
+			if err != nil {
+				return err
+			}
+			if providerErr != nil {
+				return providerErr
+			}
+			cancellation.RefundID = &refund.ID
+		case full && (order.Status == OrderStatusAuthorized || order.Status == OrderStatusPaymentFailed):
+			if err := s.payments.void(ctx, tx, orderID); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Create(cancellation).Error; err != nil {
+			return err
+		}
+		for i := range order.Items {
+			item := &order.Items[i]
+			if cancelled[item.ID] == 0 {
+				continue
+			}
+			item.CancelledQuantity += cancelled[item.ID]
+			if err := tx.Model(item).Update("cancelled_quantity", item.CancelledQuantity).Error; err != nil {
+				return err
+			}
+		}
+		order.CancelledTotal = roundCents(order.CancelledTotal + cancellation.Amount)
+		if full {
+			order.Status = OrderStatusCancelled
+		}
+		if err := tx.Model(order).Select("cancelled_total", "status").Updates(order).Error; err != nil {
+			return err
+		}
+		// What is left may all have been shipped already
+		return updateFulfillmentStatus(tx, order)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range cancellation.Lines {
+		line := &cancellation.Lines[i]
+		if err := s.products.AdjustStock(ctx, line.ProductID, line.Quantity); err != nil {
+			log.Printf("Failed to release %d of product %d for cancellation %d: %v", line.Quantity, line.ProductID, cancellation.ID, err)
+			continue
+		}
+		line.Restocked = true
+		if err := s.db.WithContext(ctx).Model(line).Update("restocked", true).Error; err != nil {
+			log.Printf("Failed to mark cancellation line %d restocked: %v", line.ID, err)
+		}
+	}
+	return cancellation, nil
+}
+
+// buildCancellation checks the requested items against what is neither
+// cancelled, refunded nor in a shipment yet. Without items everything left is
+// cancelled.
+func buildCancellation(order *Order, reason string, items []CancelItemRequest, refunded map[uint]refundedItem, allocated map[uint]int) (*OrderCancellation, error) {
+	left := func(item *OrderItem) int {
+		return min(openQuantity(item, refunded), item.Quantity-item.CancelledQuantity-allocated[item.ID])
+	}
+	if len(items) == 0 {
+		for i := range order.Items {
+			item := &order.Items[i]
+			if quantity := left(item); quantity > 0 {
+				items = append(items, CancelItemRequest{OrderItemID: item.ID, Quantity: quantity})
+			}
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("%w: nothing left to cancel", ErrInvalidCancellation)
+		}
+	}
+
+	cancellation := &OrderCancellation{OrderID: order.ID, Reason: reason}
+	seen := make(map[uint]bool, len(items))
+	for _, request := range items {
+		var item *OrderItem
+		for i := range order.Items {
+			if order.Items[i].ID == request.OrderItemID {
+				item = &order.Items[i]
+			}
+		}
+		if item == nil {
+			return nil, fmt.Errorf("%w: order item %d is not part of order %d", ErrInvalidCancellation, request.OrderItemID, order.ID)
+		}
+		if seen[item.ID] {
+			return nil, fmt.Errorf("%w: order item %d is listed twice", ErrInvalidCancellation, item.ID)
+		}
+		seen[item.ID] = true
+		if left := left(item); request.Quantity <= 0 || request.Quantity > left {
+			return nil, fmt.Errorf("%w: only %d of order item %d can be cancelled", ErrInvalidCancellation, left, item.ID)
+		}
+		cancellation.Amount += itemPaid(order, item) * float64(request.Quantity) / float64(item.Quantity)
+		cancellation.Lines = append(cancellation.Lines, CancellationLine{
+			OrderItemID: item.ID,
+			ProductID:   item.ProductID,
+			Quantity:    request.Quantity,
+		})
+	}
+	cancellation.Amount = roundCents(cancellation.Amount)
+	return cancellation, nil
+}
+
+// GetCancellations returns the cancellations of an order, oldest first.
+func (s *OrderService) GetCancellations(ctx context.Context, orderID uint) ([]OrderCancellation, error) {
+	var cancellations []OrderCancellation
+	if err := s.db.WithContext(ctx).Preload("Lines").Where("order_id = ?", orderID).Order("id").Find(&cancellations).Error; err != nil {
+		return nil, err
+	}
+	return cancellations, nil
+}
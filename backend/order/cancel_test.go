@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBuildCancellation(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     *Order
+		items     []CancelItemRequest
+		refunded  map[uint]refundedItem
+		allocated map[uint]int
+		want      []CancellationLine
+		amount    float64
+		wantErr   bool
+	}{
+		{
+			name: "no items cancels everything",
+			want: []CancellationLine{
+				{OrderItemID: 1, ProductID: 11, Quantity: 2},
+				{OrderItemID: 2, ProductID: 12, Quantity: 2},
+			},
+			amount: 99,
+		},
+		{
+			name:      "no items leaves out allocated units",
+			allocated: map[uint]int{1: 2, 2: 1},
+			want:      []CancellationLine{{OrderItemID: 2, ProductID: 12, Quantity: 1}},
+			amount:    29.7,
+		},
+		{
+			name:     "no items leaves out refunded units",
+			refunded: map[uint]refundedItem{1: {Quantity: 1, Amount: 19.8}},
+			want: []CancellationLine{
+				{OrderItemID: 1, ProductID: 11, Quantity: 1},
+				{OrderItemID: 2, ProductID: 12, Quantity: 2},
+			},
+			amount: 79.2,
+		},
+		{
+			name:  "the amount is what was paid for the units",
+			items: []CancelItemRequest{{OrderItemID: 1, Quantity: 1}, {OrderItemID: 2, Quantity: 1}},
+			want: []CancellationLine{
+				{OrderItemID: 1, ProductID: 11, Quantity: 1},
+				{OrderItemID: 2, ProductID: 12, Quantity: 1},
+			},
+			amount: 49.5,
+		},
+		{
+			name: "the amount is rounded to cents",
+			order: func() *Order {
+				order := &Order{Subtotal: 9.99, DiscountTotal: 1, Total: 8.99, Items: []OrderItem{{ProductID: 11, Quantity: 3, Price: 3.33}}}
+				order.Items[0].ID = 1
+				return order
+			}(),
+			items:  []CancelItemRequest{{OrderItemID: 1, Quantity: 1}},
+			want:   []CancellationLine{{OrderItemID: 1, ProductID: 11, Quantity: 1}},
+			amount: 3,
+		},
+		{
+			name:      "nothing left to cancel",
+			refunded:  map[uint]refundedItem{1: {Quantity: 2, Amount: 39.6}},
+			allocated: map[uint]int{2: 2},
+			wantErr:   true,
+		},
+		{
+			name:      "allocated units cannot be cancelled",
+			items:     []CancelItemRequest{{OrderItemID: 1, Quantity: 2}},
+			allocated: map[uint]int{1: 1},
+			wantErr:   true,
+		},
+		{
+			name:     "refunded units cannot be cancelled",
+			items:    []CancelItemRequest{{OrderItemID: 1, Quantity: 2}},
+			refunded: map[uint]refundedItem{1: {Quantity: 1, Amount: 19.8}},
+			wantErr:  true,
+		},
+		{
+			name:    "zero quantity",
+			items:   []CancelItemRequest{{OrderItemID: 1}},
+			wantErr: true,
+		},
+		{
+			name:    "item listed twice",
+			items:   []CancelItemRequest{{OrderItemID: 1, Quantity: 1}, {OrderItemID: 1, Quantity: 1}},
+			wantErr: true,
+		},
+		{
+			name:    "item of another order",
+			items:   []CancelItemRequest{{OrderItemID: 3, Quantity: 1}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := tt.order
+			if order == nil {
+				order = testOrder()
+			}
+			cancellation, err := buildCancellation(order, "customer request", tt.items, tt.refunded, tt.allocated)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidCancellation) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidCancellation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(cancellation.Lines, tt.want) {
+				t.Errorf("lines %+v, want %+v", cancellation.Lines, tt.want)
+			}
+			if cancellation.Amount != tt.amount {
+				t.Errorf("amount %v, want %v", cancellation.Amount, tt.amount)
+			}
+			if cancellation.OrderID != order.ID || cancellation.Reason != "customer request" {
+				t.Errorf("order %d, reason %q", cancellation.OrderID, cancellation.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"gorm.io/gorm"
+)
+
+// ErrPromotionUnavailable means the cart service refused an applied promotion,
+// e.g. because its usage limit was reached since it was applied.
+var ErrPromotionUnavailable = errors.New("promotion is no longer available")
+
+// OrderDiscount is a promotion that was applied to the cart when the order
+// was placed.
+type OrderDiscount struct {
+	gorm.Model
+	OrderID      uint    `json:"orderId" gorm:"not null;index"`
+	PromotionID  string  `json:"promotionId" gorm:"not null"`
+	Code         string  `json:"code,omitempty"`
+	Description  string  `json:"description"`
+	Amount       float64 `json:"amount" gorm:"not null"`
+	FreeShipping bool    `json:"freeShipping" gorm:"not null;default:false"`
+}
+
+// cartDiscount mirrors a discount line in the cart service response.
+type cartDiscount struct {
+	PromotionID  string  `json:"promotionId"`
+	Code         string  `json:"code"`
+	Description  string  `json:"description"`
+	Amount       float64 `json:"amount"`
+	FreeShipping bool    `json:"freeShipping"`
+}
+
+// redeemPromotions records the use of the applied promotions in the cart
+// service, which enforces the usage limits.
+func (s *OrderService) redeemPromotions(ctx context.Context, userID uint, discounts []cartDiscount) error {
+	if err := s.postPromotions(ctx, "redeem", userID, discounts); err != nil {
+		return fmt.Errorf("failed to redeem promotions: %w", err)
+	}
+	return nil
+}
+
+// releasePromotions gives back the uses recorded by redeemPromotions for an
+// order that was not placed after all.
+func (s *OrderService) releasePromotions(ctx context.Context, userID uint, discounts []cartDiscount) {
+	if err := s.postPromotions(ctx, "release", userID, discounts); err != nil {
+		log.Printf("Failed to release promotions of user %d: %v", userID, err)
+	}
+}
+
+// postPromotions calls a promotions endpoint of the cart service with the
+// promotions of discounts.
+func (s *OrderService) postPromotions(ctx context.Context, action string, userID uint, discounts []cartDiscount) error {
+	if len(discounts) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(discounts))
+	for _, discount := range discounts {
+		ids = append(ids, discount.PromotionID)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"userId": userID, "promotionIds": ids})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/api/promotions/%s", s.cartURL, action)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		var result struct {
+			Error string `json:"error"`
+		}
+		message := fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &result) == nil && result.Error != "" {
+			message = result.Error
+		}
+		// The cart service refuses promotions that are inactive, exhausted
+		// or that the cart is no longer eligible for
+		if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusUnprocessableEntity {
+			return fmt.Errorf("%w: %s", ErrPromotionUnavailable, message)
+		}
+		return errors.New(message)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedeemPromotionsUnavailable(t *testing.T) {
+	const cart = `{"cart": {"items": [{"productId": 1, "quantity": 1, "price": 10}], "subtotal": 10,
+		"discounts": [{"promotionId": "spring", "description": "Spring sale", "amount": 1}],
+		"discountTotal": 1, "total": 9}, "changes": []}`
+	tests := []struct {
+		name        string
+		status      int
+		unavailable bool
+		wantStatus  int
+	}{
+		{name: "usage limit reached", status: http.StatusUnprocessableEntity, unavailable: true, wantStatus: http.StatusConflict},
+		{name: "conflict", status: http.StatusConflict, unavailable: true, wantStatus: http.StatusConflict},
+		{name: "cart service failure", status: http.StatusInternalServerError, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			service, upstream := newTestOrderService(t, db)
+			upstream.Cart = cart
+			upstream.Products = map[uint]productInfo{1: {ID: 1, Name: "Mug", Price: 10, Stock: 5, Weight: 0.5}}
+			upstream.PromotionStatus = tt.status
+			upstream.PromotionError = "coupon usage limit reached"
+			address := Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+
+			_, err := service.CreateOrder(context.Background(), 7, PaymentMethodCOD, "", address, "standard")
+			if err == nil {
+				t.Fatal("order was placed")
+			}
+			if got := errors.Is(err, ErrPromotionUnavailable); got != tt.unavailable {
+				t.Errorf("got %v, want ErrPromotionUnavailable %v", err, tt.unavailable)
+			}
+			var orders int64
+			db.Model(&Order{}).Count(&orders)
+			if orders != 0 || upstream.Adjusted(1) != 0 {
+				t.Errorf("%d orders and stock adjusted by %d, want none", orders, upstream.Adjusted(1))
+			}
+
+			gin.SetMode(gin.TestMode)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			writeOrderError(c, err)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
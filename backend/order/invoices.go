@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Invoice kinds. Credit notes are issued for refunds and correct the invoice
+// of their order.
+const (
+	InvoiceKindInvoice    = "invoice"
+	InvoiceKindCreditNote = "credit_note"
+)
+
+// Document formats served by the invoice endpoints.
+const (
+	InvoiceFormatPDF  = "pdf"
+	InvoiceFormatHTML = "html"
+)
+
+// invoiceNumberPrefixes number each kind in its own sequence.
+var invoiceNumberPrefixes = map[string]string{
+	InvoiceKindInvoice:    "INV-",
+	InvoiceKindCreditNote: "CN-",
+}
+
+var (
+	ErrInvoiceNotFound  = errors.New("invoice not found")
+	ErrInvoiceImmutable = errors.New("invoices cannot be changed once issued")
+)
+
+//go:embed templates/invoice.html templates/invoice.txt
+var invoiceTemplateFiles embed.FS
+
+var invoiceTemplateFuncs = map[string]interface{}{
+	"money":   func(amount float64) string { return fmt.Sprintf("%.2f", amount) },
+	"percent": func(rate float64) string { return fmt.Sprintf("%.2f%%", rate*100) },
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"rule":    func(width int) string { return strings.Repeat("-", width) },
+}
+
+var (
+	invoiceHTMLTemplate = htmltemplate.Must(htmltemplate.New("invoice.html").Funcs(invoiceTemplateFuncs).ParseFS(invoiceTemplateFiles, "templates/invoice.html"))
+	invoiceTextTemplate = texttemplate.Must(texttemplate.New("invoice.txt").Funcs(invoiceTemplateFuncs).ParseFS(invoiceTemplateFiles, "templates/invoice.txt"))
+)
+
+// Invoice is an issued invoice or credit note. The rendered documents are
+// stored as issued and never re-rendered, so they stay the same even when
+// templates or order data change later; Checksum is the SHA-256 of the PDF.
+type Invoice struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	Number    string    `json:"number" gorm:"not null;uniqueIndex"`
+	Kind      string    `json:"kind" gorm:"not null;index"`
+	OrderID   uint      `json:"orderId" gorm:"not null;index"`
+	InvoiceID *uint     `json:"invoiceId,omitempty"`
+	RefundID  *uint     `json:"refundId,omitempty"`
+	Amount    float64   `json:"amount" gorm:"not null"`
+	HTML      string    `json:"-" gorm:"type:text;not null"`
+	PDF       []byte    `json:"-" gorm:"not null"`
+	Checksum  string    `json:"checksum" gorm:"not null"`
+	CreatedAt time.Time `json:"issuedAt"`
+}
+
+func (i *Invoice) BeforeUpdate(tx *gorm.DB) error {
+	return ErrInvoiceImmutable
+}
+
+func (i *Invoice) BeforeDelete(tx *gorm.DB) error {
+	return ErrInvoiceImmutable
+}
+
+// InvoiceSequence holds the last number issued for a kind of invoice.
+type InvoiceSequence struct {
+	Kind string `gorm:"primaryKey"`
+	Last int    `gorm:"not null;default:0"`
+}
+
+// InvoiceSeller is who issues the invoices.
+type InvoiceSeller struct {
+	Name    string
+	Address []string
+	TaxID   string
+}
+
+// invoiceLine is a line of an invoice or credit note. Amount includes taxes.
+type invoiceLine struct {
+	Description string
+	Quantity    int
+	UnitPrice   float64
+	Discount    float64
+	TaxRate     float64
+	Tax         float64
+	Amount      float64
+}
+
+// invoiceDocument is what the invoice templates render.
+type invoiceDocument struct {
+	Seller     InvoiceSeller
+	Title      string
+	Number     string
+	IssuedAt   time.Time
+	Corrects   string
+	Reason     string
+	Order      *Order
+	Lines      []invoiceLine
+	Shipping   float64
+	Adjustment float64
+	TaxTotal   float64
+	Total      float64
+}
+
+type InvoiceService struct {
+	db     *gorm.DB
+	seller InvoiceSeller
+}
+
+func NewInvoiceService(db *gorm.DB, seller InvoiceSeller) *InvoiceService {
+	return &InvoiceService{
+		db:     db,
+		seller: seller,
+	}
+}
+
+// nextInvoiceNumber takes the next number of kind in tx. The sequence row
+// stays locked until tx ends, so numbers have no gaps or duplicates.
+func nextInvoiceNumber(tx *gorm.DB, kind string) (string, error) {
+	sequence := InvoiceSequence{Kind: kind}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&sequence).Error; err != nil {
+		return "", err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&sequence, "kind = ?", kind).Error; err != nil {
+		return "", err
+	}
+	sequence.Last++
+	if err := tx.Model(&sequence).Update("last", sequence.Last).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%06d", invoiceNumberPrefixes[kind], sequence.Last), nil
+}
+
+// invoiceLineFor is the line for share of what was paid for an order item.
+func invoiceLineFor(order *Order, item *OrderItem, quantity int, share float64) invoiceLine {
+	discount := 0.0
+	if order.Subtotal > 0 {
+		discount = order.DiscountTotal * item.Price * float64(item.Quantity) / order.Subtotal
+	}
+	description := item.ProductName
+	if description == "" {
+		// Ordered before product details were kept on order items
+		description = fmt.Sprintf("Product #%d", item.ProductID)
+	}
+	if item.SKU != "" {
+		description += " (" + item.SKU + ")"
+	}
+	if len(item.Options) > 0 {
+		description += ", " + item.Options.String()
+	}
+	return invoiceLine{
+		Description: description,
+		Quantity:    quantity,
+		UnitPrice:   item.Price,
+		Discount:    roundCents(discount * share),
+		TaxRate:     item.TaxRate,
+		Tax:         roundCents(item.TaxAmount * share),
+		Amount:      roundCents(itemPaid(order, item) * share),
+	}
+}
+
+// issueInvoice issues the invoice of an order with its items loaded, for
+// what was charged: everything not cancelled. An order has one invoice, so an
+// existing one is returned as is.
+func (s *InvoiceService) issueInvoice(tx *gorm.DB, order *Order) (*Invoice, error) {
+	var existing Invoice
+	err := tx.Where("order_id = ? AND kind = ?", order.ID, InvoiceKindInvoice).First(&existing).Error
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	document := invoiceDocument{
+		Title:    "Invoice",
+		Order:    order,
+		Shipping: order.ShippingCost,
+		Total:    roundCents(order.Total - order.CancelledTotal),
+	}
+	for i := range order.Items {
+		item := &order.Items[i]
+		quantity := item.Quantity - item.CancelledQuantity
+		if quantity <= 0 {
+			continue
+		}
+		document.Lines = append(document.Lines, invoiceLineFor(order, item, quantity, float64(quantity)/float64(item.Quantity)))
+	}
+	return s.issue(tx, InvoiceKindInvoice, &document, &Invoice{OrderID: order.ID})
+}
+
+// issueCreditNote issues the credit note for a refund of an order with its
+// items loaded. Money refunded beyond the refund lines, such as shipping,
+// shows up as an adjustment.
+func (s *InvoiceService) issueCreditNote(tx *gorm.DB, order *Order, refund *OrderRefund) (*Invoice, error) {
+	invoice := &Invoice{OrderID: order.ID, RefundID: &refund.ID}
+	document := invoiceDocument{
+		Title:  "Credit note",
+		Reason: refund.Reason,
+		Order:  order,
+		Total:  refund.Amount,
+	}
+	var original Invoice
+	err := tx.Where("order_id = ? AND kind = ?", order.ID, InvoiceKindInvoice).First(&original).Error
+	switch {
+	case err == nil:
+		invoice.InvoiceID = &original.ID
+		document.Corrects = original.Number
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+
+	items := make(map[uint]*OrderItem, len(order.Items))
+	for i := range order.Items {
+		items[order.Items[i].ID] = &order.Items[i]
+	}
+	adjustment := refund.Amount
+	for _, line := range refund.Lines {
+		item := items[line.OrderItemID]
+		if item == nil {
+			continue
+		}
+		paid := itemPaid(order, item)
+		if paid == 0 {
+			continue
+		}
+		creditLine := invoiceLineFor(order, item, line.Quantity, line.Amount/paid)
+		creditLine.Amount = line.Amount
+		document.Lines = append(document.Lines, creditLine)
+		adjustment -= line.Amount
+	}
+	document.Adjustment = roundCents(adjustment)
+	return s.issue(tx, InvoiceKindCreditNote, &document, invoice)
+}
+
+// issue numbers, renders and stores a document.
+func (s *InvoiceService) issue(tx *gorm.DB, kind string, document *invoiceDocument, invoice *Invoice) (*Invoice, error) {
+	number, err := nextInvoiceNumber(tx, kind)
+	if err != nil {
+		return nil, err
+	}
+	document.Seller = s.seller
+	document.Number = number
+	document.IssuedAt = time.Now()
+	for _, line := range document.Lines {
+		document.TaxTotal += line.Tax
+	}
+	document.TaxTotal = roundCents(document.TaxTotal)
+
+	var html, text bytes.Buffer
+	if err := invoiceHTMLTemplate.Execute(&html, document); err != nil {
+		return nil, fmt.Errorf("failed to render %s %s: %v", kind, number, err)
+	}
+	if err := invoiceTextTemplate.Execute(&text, document); err != nil {
+		return nil, fmt.Errorf("failed to render %s %s: %v", kind, number, err)
+	}
+	pdf := textPDF(text.String())
+	checksum := sha256.Sum256(pdf)
+
+	invoice.Number = number
+	invoice.Kind = kind
+	invoice.Amount = document.Total
+	invoice.HTML = html.String()
+	invoice.PDF = pdf
+	invoice.Checksum = hex.EncodeToString(checksum[:])
+	invoice.CreatedAt = document.IssuedAt
+	if err := tx.Create(invoice).Error; err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// GetInvoice returns the invoice of an order.
+func (s *InvoiceService) GetInvoice(ctx context.Context, orderID uint) (*Invoice, error) {
+	var invoice Invoice
+	err := s.db.WithContext(ctx).Where("order_id = ? AND kind = ?", orderID, InvoiceKindInvoice).First(&invoice).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: order %d has not been invoiced", ErrInvoiceNotFound, orderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// GetByNumber returns an invoice or credit note by its number.
+func (s *InvoiceService) GetByNumber(ctx context.Context, number string) (*Invoice, error) {
+	var invoice Invoice
+	err := s.db.WithContext(ctx).Where("number = ?", number).First(&invoice).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrInvoiceNotFound, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// GetInvoices returns the invoice and credit notes of an order, oldest first,
+// without their documents.
+func (s *InvoiceService) GetInvoices(ctx context.Context, orderID uint) ([]Invoice, error) {
+	var invoices []Invoice
+	err := s.db.WithContext(ctx).Omit("html", "pdf").Where("order_id = ?", orderID).Order("id").Find(&invoices).Error
+	if err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
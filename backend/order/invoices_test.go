@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestInvoiceLineFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		item     func(item *OrderItem)
+		quantity int
+		share    float64
+		want     invoiceLine
+	}{
+		{
+			name:     "whole item",
+			item:     func(item *OrderItem) { item.ProductName = "Mug" },
+			quantity: 2,
+			share:    1,
+			want:     invoiceLine{Description: "Mug", Quantity: 2, UnitPrice: 20, Discount: 4, TaxRate: 0.1, Tax: 3.6, Amount: 39.6},
+		},
+		{
+			name:     "share of an item",
+			item:     func(item *OrderItem) { item.ProductName = "Mug" },
+			quantity: 1,
+			share:    0.5,
+			want:     invoiceLine{Description: "Mug", Quantity: 1, UnitPrice: 20, Discount: 2, TaxRate: 0.1, Tax: 1.8, Amount: 19.8},
+		},
+		{
+			name: "SKU and options follow the name",
+			item: func(item *OrderItem) {
+				item.ProductName = "Mug"
+				item.SKU = "MUG-1"
+				item.Options = ItemOptions{"size": "L", "color": "blue"}
+			},
+			quantity: 2,
+			share:    1,
+			want:     invoiceLine{Description: "Mug (MUG-1), color: blue, size: L", Quantity: 2, UnitPrice: 20, Discount: 4, TaxRate: 0.1, Tax: 3.6, Amount: 39.6},
+		},
+		{
+			name:     "items without a name show the product ID",
+			item:     func(item *OrderItem) {},
+			quantity: 2,
+			share:    1,
+			want:     invoiceLine{Description: "Product #11", Quantity: 2, UnitPrice: 20, Discount: 4, TaxRate: 0.1, Tax: 3.6, Amount: 39.6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testOrder()
+			item := &order.Items[0]
+			tt.item(item)
+			if got := invoiceLineFor(order, item, tt.quantity, tt.share); got != tt.want {
+				t.Errorf("line %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestItemOptionsString(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ItemOptions
+		want    string
+	}{
+		{name: "no options", want: ""},
+		{name: "one option", options: ItemOptions{"size": "L"}, want: "size: L"},
+		{name: "sorted by name", options: ItemOptions{"size": "L", "color": "blue"}, want: "color: blue, size: L"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
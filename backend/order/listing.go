@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultOrderPageSize = 20
+	MaxOrderPageSize     = 100
+)
+
+// NextCursorHeader carries the cursor of the next page for listings that
+// return a plain array.
+const NextCursorHeader = "X-Next-Cursor"
+
+var ErrInvalidOrderQuery = errors.New("invalid order query")
+
+// orderSortColumns maps the sort keys of order listings to their columns.
+var orderSortColumns = map[string]string{
+	"createdAt": "created_at",
+	"total":     "total",
+}
+
+// orderIncludes maps what can be loaded along with listed orders to their
+// associations. Nothing is loaded unless asked for.
+var orderIncludes = map[string]string{
+	"items":     "Items",
+	"discounts": "Discounts",
+	"taxes":     "Taxes",
+}
+
+// OrderListQuery selects a page of orders. Sort is a key of orderSortColumns,
+// prefixed with "-" for descending order, and Cursor continues after the last
+// order of a previous page with the same sort. Zero values do not filter.
+type OrderListQuery struct {
+	UserID        uint
+	Statuses      []string
+	PaymentMethod string
+	CreatedFrom   *time.Time
+	CreatedTo     *time.Time
+	MinTotal      *float64
+	MaxTotal      *float64
+	Sort          string
+	Cursor        string
+	Limit         int
+	Include       []string
+}
+
+// OrderPage is a page of orders. NextCursor is empty on the last page.
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+// orderCursor is the position after an order in a sorted listing: its sort
+// value and ID, which breaks ties.
+type orderCursor struct {
+	Sort      string     `json:"s"`
+	CreatedAt *time.Time `json:"c,omitempty"`
+	Total     *float64   `json:"t,omitempty"`
+	ID        uint       `json:"id"`
+}
+
+func encodeOrderCursor(sort string, order *Order) string {
+	cursor := orderCursor{Sort: sort, ID: order.ID}
+	switch strings.TrimPrefix(sort, "-") {
+	case "createdAt":
+		cursor.CreatedAt = &order.CreatedAt
+	case "total":
+		cursor.Total = &order.Total
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeOrderCursor reads a cursor and returns the value to continue after.
+func decodeOrderCursor(sort, encoded string) (interface{}, uint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	var cursor orderCursor
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: malformed cursor", ErrInvalidOrderQuery)
+	}
+	if cursor.Sort != sort {
+		return nil, 0, fmt.Errorf("%w: the cursor belongs to a listing sorted by %s", ErrInvalidOrderQuery, cursor.Sort)
+	}
+	// Only the value of the listing's sort is read, so a tampered cursor
+	// cannot compare a column with a value of another type
+	switch strings.TrimPrefix(sort, "-") {
+	case "createdAt":
+		if cursor.CreatedAt != nil {
+			return *cursor.CreatedAt, cursor.ID, nil
+		}
+	case "total":
+		if cursor.Total != nil {
+			return *cursor.Total, cursor.ID, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: malformed cursor", ErrInvalidOrderQuery)
+}
+
+// ListOrders returns a page of orders matching query, paginated by cursor so
+// pages stay stable while new orders come in.
+func (s *OrderService) ListOrders(ctx context.Context, query OrderListQuery) (*OrderPage, error) {
+	if query.Sort == "" {
+		query.Sort = "-createdAt"
+	}
+	desc := strings.HasPrefix(query.Sort, "-")
+	column, ok := orderSortColumns[strings.TrimPrefix(query.Sort, "-")]
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot sort by %q", ErrInvalidOrderQuery, query.Sort)
+	}
+	switch {
+	case query.Limit == 0:
+		query.Limit = DefaultOrderPageSize
+	case query.Limit < 0 || query.Limit > MaxOrderPageSize:
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidOrderQuery, MaxOrderPageSize)
+	}
+
+	db := s.db.WithContext(ctx).Model(&Order{})
+	if query.UserID != 0 {
+		db = db.Where("user_id = ?", query.UserID)
+	}
+	if len(query.Statuses) > 0 {
+		db = db.Where("status IN ?", query.Statuses)
+	}
+	if query.PaymentMethod != "" {
+		db = db.Where("payment_method = ?", query.PaymentMethod)
+	}
+	if query.CreatedFrom != nil {
+		db = db.Where("created_at >= ?", *query.CreatedFrom)
+	}
+	if query.CreatedTo != nil {
+		db = db.Where("created_at < ?", *query.CreatedTo)
+	}
+	if query.MinTotal != nil {
+		db = db.Where("total >= ?", *query.MinTotal)
+	}
+	if query.MaxTotal != nil {
+		db = db.Where("total <= ?", *query.MaxTotal)
+	}
+	for _, include := range query.Include {
+		association, ok := orderIncludes[include]
+		if !ok {
+			return nil, fmt.Errorf("%w: cannot include %q", ErrInvalidOrderQuery, include)
+		}
+		db = db.Preload(association)
+	}
+
+	direction, after := "ASC", ">"
+	if desc {
+		direction, after = "DESC", "<"
+	}
+	if query.Cursor != "" {
+		value, id, err := decodeOrderCursor(query.Sort, query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, after), value, id)
+	}
+
+	orders := []Order{}
+	// One extra order tells whether there is a next page
+	err := db.Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)).Limit(query.Limit + 1).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	page := &OrderPage{Orders: orders}
+	if len(orders) > query.Limit {
+		page.Orders = orders[:query.Limit]
+		page.NextCursor = encodeOrderCursor(query.Sort, &page.Orders[query.Limit-1])
+	}
+	return page, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOrderCursor(t *testing.T) {
+	order := &Order{Total: 104.5}
+	order.ID = 42
+	order.CreatedAt = time.Date(2024, 5, 1, 10, 30, 0, 123456789, time.UTC)
+	encode := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	tests := []struct {
+		name    string
+		sort    string
+		cursor  string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "newest first", sort: "-createdAt", cursor: encodeOrderCursor("-createdAt", order), want: order.CreatedAt},
+		{name: "oldest first", sort: "createdAt", cursor: encodeOrderCursor("createdAt", order), want: order.CreatedAt},
+		{name: "by total", sort: "-total", cursor: encodeOrderCursor("-total", order), want: order.Total},
+		{name: "another sort", sort: "createdAt", cursor: encodeOrderCursor("-createdAt", order), wantErr: true},
+		{name: "another sort column", sort: "-createdAt", cursor: encodeOrderCursor("-total", order), wantErr: true},
+		{name: "not base64", sort: "-createdAt", cursor: "not a cursor!", wantErr: true},
+		{name: "not JSON", sort: "-createdAt", cursor: encode("[1, 2"), wantErr: true},
+		{name: "no value", sort: "-createdAt", cursor: encode(`{"s":"-createdAt","id":42}`), wantErr: true},
+		{name: "value of another sort", sort: "-total", cursor: encode(`{"s":"-total","c":"2024-05-01T10:30:00Z","id":42}`), wantErr: true},
+		{name: "value of the wrong type", sort: "-total", cursor: encode(`{"s":"-total","t":"cheap","id":42}`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, id, err := decodeOrderCursor(tt.sort, tt.cursor)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidOrderQuery) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidOrderQuery)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id != order.ID {
+				t.Errorf("id %d, want %d", id, order.ID)
+			}
+			switch want := tt.want.(type) {
+			case time.Time:
+				if got, ok := value.(time.Time); !ok || !got.Equal(want) {
+					t.Errorf("value %v, want %v", value, want)
+				}
+			default:
+				if value != want {
+					t.Errorf("value %v, want %v", value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseOrderListQuery(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	ten, fifty := 10.0, 50.5
+
+	tests := []struct {
+		name    string
+		query   string
+		want    OrderListQuery
+		wantErr bool
+	}{
+		{name: "no filters", query: "", want: OrderListQuery{}},
+		{
+			name:  "filters",
+			query: "?status=paid,shipped&paymentMethod=card&sort=-total&cursor=abc&limit=5&include=items,taxes&minTotal=10&maxTotal=50.5",
+			want: OrderListQuery{
+				Statuses:      []string{"paid", "shipped"},
+				PaymentMethod: "card",
+				Sort:          "-total",
+				Cursor:        "abc",
+				Limit:         5,
+				Include:       []string{"items", "taxes"},
+				MinTotal:      &ten,
+				MaxTotal:      &fifty,
+			},
+		},
+		{
+			name:  "timestamps",
+			query: "?createdFrom=2024-05-01T00:00:00Z&createdTo=2024-05-31T12:00:00Z",
+			want:  OrderListQuery{CreatedFrom: &from, CreatedTo: &to},
+		},
+		{
+			// A date as createdTo includes the whole day
+			name:  "dates",
+			query: "?createdFrom=2024-05-01&createdTo=2024-05-31",
+			want:  OrderListQuery{CreatedFrom: &from, CreatedTo: timePtr(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))},
+		},
+		{name: "invalid limit", query: "?limit=ten", wantErr: true},
+		{name: "invalid createdFrom", query: "?createdFrom=yesterday", wantErr: true},
+		{name: "invalid createdTo", query: "?createdTo=2024-13-01", wantErr: true},
+		{name: "invalid minTotal", query: "?minTotal=cheap", wantErr: true},
+		{name: "invalid maxTotal", query: "?maxTotal=1,000", wantErr: true},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/orders"+tt.query, nil)
+			got, err := parseOrderListQuery(c)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidOrderQuery) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidOrderQuery)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equalOrderListQuery(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListOrdersInvalidQuery(t *testing.T) {
+	db := testDB(t)
+	service, _ := newTestOrderService(t, db)
+	first := createTestOrder(t, db, OrderStatusPaid, "card")
+	createTestOrder(t, db, OrderStatusPaid, "card")
+	encode := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	tests := []struct {
+		name  string
+		query OrderListQuery
+	}{
+		{name: "malformed cursor", query: OrderListQuery{Cursor: "not a cursor!"}},
+		{name: "cursor of another sort", query: OrderListQuery{Sort: "-total", Cursor: encodeOrderCursor("-createdAt", first)}},
+		{name: "tampered cursor", query: OrderListQuery{Sort: "-total", Cursor: encode(`{"s":"-total","c":"2024-05-01T10:30:00Z","id":1}`)}},
+		{name: "unknown sort", query: OrderListQuery{Sort: "status"}},
+		{name: "limit too large", query: OrderListQuery{Limit: MaxOrderPageSize + 1}},
+		{name: "negative limit", query: OrderListQuery{Limit: -1}},
+		{name: "unknown include", query: OrderListQuery{Include: []string{"payments"}}},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.ListOrders(context.Background(), tt.query)
+			if !errors.Is(err, ErrInvalidOrderQuery) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidOrderQuery)
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			writeOrderError(c, err)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+
+	// A cursor from a previous page continues after its last order
+	page, err := service.ListOrders(context.Background(), OrderListQuery{Sort: "createdAt", Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to list orders: %v", err)
+	}
+	if len(page.Orders) != 1 || page.Orders[0].ID != first.ID || page.NextCursor == "" {
+		t.Fatalf("got %d orders and cursor %q, want order %d and a cursor", len(page.Orders), page.NextCursor, first.ID)
+	}
+	page, err = service.ListOrders(context.Background(), OrderListQuery{Sort: "createdAt", Limit: 1, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("failed to list the next page: %v", err)
+	}
+	if len(page.Orders) != 1 || page.Orders[0].ID == first.ID || page.NextCursor != "" {
+		t.Errorf("got %d orders and cursor %q, want the second order and no cursor", len(page.Orders), page.NextCursor)
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func equalOrderListQuery(a, b OrderListQuery) bool {
+	equalTime := func(a, b *time.Time) bool {
+		return (a == nil) == (b == nil) && (a == nil || a.Equal(*b))
+	}
+	equalFloat := func(a, b *float64) bool {
+		return (a == nil) == (b == nil) && (a == nil || *a == *b)
+	}
+	equalStrings := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return a.UserID == b.UserID && a.PaymentMethod == b.PaymentMethod && a.Sort == b.Sort &&
+		a.Cursor == b.Cursor && a.Limit == b.Limit &&
+		equalStrings(a.Statuses, b.Statuses) && equalStrings(a.Include, b.Include) &&
+		equalTime(a.CreatedFrom, b.CreatedFrom) && equalTime(a.CreatedTo, b.CreatedTo) &&
+		equalFloat(a.MinTotal, b.MinTotal) && equalFloat(a.MaxTotal, b.MaxTotal)
+}
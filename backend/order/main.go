@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +20,7 @@ import (
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type OrderItem struct {
@@ -23,38 +29,129 @@ type OrderItem struct {
 	ProductID uint    `json:"productId" gorm:"not null"`
 	Quantity  int     `json:"quantity" gorm:"not null"`
 	Price     float64 `json:"price" gorm:"not null"`
+	TaxClass  string  `json:"taxClass" gorm:"not null;default:''"`
+	TaxRate   float64 `json:"taxRate" gorm:"not null;default:0"`
+	TaxAmount float64 `json:"taxAmount" gorm:"not null;default:0"`
+	// CancelledQuantity is the part of Quantity that was cancelled
+	CancelledQuantity int `json:"cancelledQuantity" gorm:"not null;default:0"`
+
+	// The product as it was bought, kept when the catalog changes later
+	ProductName string      `json:"productName" gorm:"not null;default:''"`
+	SKU         string      `json:"sku" gorm:"not null;default:''"`
+	Image       string      `json:"image" gorm:"not null;default:''"`
+	Options     ItemOptions `json:"options" gorm:"type:jsonb;not null;default:'{}'"`
+}
+
+// Order statuses. Orders paid through a payment provider start out
+// authorized and become paid once the payment is captured; cash on delivery
+// orders start out pending. Shipments then move them to shipped and delivered.
+const (
+	OrderStatusPending       = "pending"
+	OrderStatusAuthorized    = "authorized"
+	OrderStatusPaid          = "paid"
+	OrderStatusPaymentFailed = "payment_failed"
+	OrderStatusCancelled     = "cancelled"
+
+	OrderStatusPartiallyRefunded = "partially_refunded"
+	OrderStatusRefunded          = "refunded"
+
+	OrderStatusPartiallyShipped = "partially_shipped"
+	OrderStatusShipped          = "shipped"
+	OrderStatusDelivered        = "delivered"
+)
+
+// managedStatuses are only reached through payments, refunds, cancellations
+// and shipments, not set directly.
+var managedStatuses = map[string]bool{
+	OrderStatusAuthorized:        true,
+	OrderStatusPaid:              true,
+	OrderStatusPaymentFailed:     true,
+	OrderStatusPartiallyRefunded: true,
+	OrderStatusRefunded:          true,
+	OrderStatusCancelled:         true,
+	OrderStatusPartiallyShipped:  true,
+	OrderStatusShipped:           true,
+	OrderStatusDelivered:         true,
 }
 
 type Order struct {
 	gorm.Model
-	UserID        uint        `json:"userId" gorm:"not null"`
-	Items         []OrderItem `json:"items" gorm:"foreignKey:OrderID"`
-	Total         float64     `json:"total" gorm:"not null"`
-	Status        string      `json:"status" gorm:"not null;default:'pending'"`
-	PaymentMethod string      `json:"paymentMethod" gorm:"not null"`
-	Address       string      `json:"address" gorm:"not null"`
+	UserID         uint            `json:"userId" gorm:"not null;index"`
+	Items          []OrderItem     `json:"items" gorm:"foreignKey:OrderID"`
+	Subtotal       float64         `json:"subtotal" gorm:"not null;default:0"`
+	Discounts      []OrderDiscount `json:"discounts" gorm:"foreignKey:OrderID"`
+	DiscountTotal  float64         `json:"discountTotal" gorm:"not null;default:0"`
+	FreeShipping   bool            `json:"freeShipping" gorm:"not null;default:false"`
+	ShippingMethod string          `json:"shippingMethod" gorm:"not null;default:''"`
+	ShippingCost   float64         `json:"shippingCost" gorm:"not null;default:0"`
+	Taxes          []OrderTax      `json:"taxes" gorm:"foreignKey:OrderID"`
+	TaxTotal       float64         `json:"taxTotal" gorm:"not null;default:0"`
+	Total          float64         `json:"total" gorm:"not null"`
+	RefundedTotal  float64         `json:"refundedTotal" gorm:"not null;default:0"`
+	CancelledTotal float64         `json:"cancelledTotal" gorm:"not null;default:0"`
+	Status         string          `json:"status" gorm:"not null;default:'pending';index"`
+	PaymentMethod  string          `json:"paymentMethod" gorm:"not null"`
+	Address        Address         `json:"address" gorm:"embedded;embeddedPrefix:address_"`
+}
+
+// models are the tables of the order service.
+var models = []interface{}{
+	&Order{}, &OrderItem{}, &OrderDiscount{}, &OrderTax{}, &TaxRule{}, &Payment{}, &WebhookEvent{},
+	&OrderRefund{}, &RefundLine{}, &OrderReturn{}, &ReturnItem{}, &ReturnEvent{}, &OrderCancellation{},
+	&CancellationLine{}, &Shipment{}, &ShipmentItem{}, &ShipmentEvent{}, &Invoice{}, &InvoiceSequence{},
+}
+
+// CartChangedError is returned by CreateOrder when revalidating the cart
+// changed prices or quantities. The shopper has to review the cart first.
+type CartChangedError struct {
+	Changes []json.RawMessage
+}
+
+func (e *CartChangedError) Error() string {
+	return "cart changed during revalidation, please review before checkout"
 }
 
 type OrderService struct {
-	db            *gorm.DB
-	cartURL       string
-	productsURL   string
-	featureURL    string
+	db          *gorm.DB
+	cartURL     string
+	productsURL string
+	featureURL  string
+	products    *productClient
+	shipping    *ShippingService
+	taxes       *TaxService
+	payments    *PaymentService
+	invoices    *InvoiceService
+	// returnWindow is how long after delivery items can be returned
+	returnWindow time.Duration
 }
 
-func NewOrderService(db *gorm.DB, cartURL, productsURL, featureURL string) *OrderService {
+func NewOrderService(db *gorm.DB, cartURL, productsURL, featureURL string, products *productClient, shipping *ShippingService, taxes *TaxService, payments *PaymentService, invoices *InvoiceService, returnWindow time.Duration) *OrderService {
 	return &OrderService{
-		db:            db,
-		cartURL:       cartURL,
-		productsURL:   productsURL,
-		featureURL:    featureURL,
+		db:           db,
+		cartURL:      cartURL,
+		productsURL:  productsURL,
+		featureURL:   featureURL,
+		products:     products,
+		shipping:     shipping,
+		taxes:        taxes,
+		payments:     payments,
+		invoices:     invoices,
+		returnWindow: returnWindow,
 	}
 }
 
-func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMethod, address string) (*Order, error) {
-	// Get cart
-	cartURL := fmt.Sprintf("%s/api/cart/%d", s.cartURL, userID)
-	resp, err := http.Get(cartURL)
+// CreateOrder turns the user's cart into an order shipped to address with
+// shippingMethod. Without a shipping method the cheapest available one is used.
+// Unless paid cash on delivery, the total is authorized with paymentToken
+// before the order is stored.
+func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMethod, paymentToken string, address Address, shippingMethod string) (*Order, error) {
+	if err := address.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Get cart, revalidated against current prices and stock
+	cartURL := fmt.Sprintf("%s/api/cart/%d/revalidate", s.cartURL, userID)
+	resp, err := http.Post(cartURL, "application/json", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch cart: %v", err)
 	}
@@ -63,25 +160,54 @@ func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMeth
 	if resp.StatusCode == http.StatusNotFound {
 		return nil, fmt.Errorf("cart not found")
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch cart: unexpected status %d", resp.StatusCode)
+	}
 
-	var cart struct {
-		Items []struct {
-			ProductID uint    `json:"productId"`
-			Quantity  int     `json:"quantity"`
-			Price     float64 `json:"price"`
-		} `json:"items"`
-		Total float64 `json:"total"`
+	var revalidated struct {
+		Cart struct {
+			Items []struct {
+				ProductID uint    `json:"productId"`
+				Quantity  int     `json:"quantity"`
+				Price     float64 `json:"price"`
+			} `json:"items"`
+			Subtotal      float64        `json:"subtotal"`
+			Discounts     []cartDiscount `json:"discounts"`
+			DiscountTotal float64        `json:"discountTotal"`
+			FreeShipping  bool           `json:"freeShipping"`
+			Total         float64        `json:"total"`
+		} `json:"cart"`
+		Changes []json.RawMessage `json:"changes"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&cart); err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(&revalidated); err != nil {
 		return nil, fmt.Errorf("failed to decode cart: %v", err)
 	}
 
+	// Prices or stock changed since the shopper last saw the cart
+	if len(revalidated.Changes) > 0 {
+		return nil, &CartChangedError{Changes: revalidated.Changes}
+	}
+	cart := revalidated.Cart
+
 	if len(cart.Items) == 0 {
 		return nil, fmt.Errorf("cart is empty")
 	}
 
+	shippingItems := make([]ShippingItem, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		shippingItems = append(shippingItems, ShippingItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	shippingRate, err := s.chooseShipping(ctx, shippingMethod, address, shippingItems, cart.Total)
+	if err != nil {
+		return nil, err
+	}
+	// A free shipping promotion waives whichever method was chosen
+	if cart.FreeShipping {
+		shippingRate.Cost = 0
+	}
+
 	// Check if COD is enabled if payment method is COD
-	if paymentMethod == "cod" {
+	if paymentMethod == PaymentMethodCOD {
 		codEnabled, err := s.isFeatureEnabled(ctx, "enableCodPayment")
 		if err != nil {
 			return nil, fmt.Errorf("failed to check COD feature: %v", err)
@@ -91,6 +217,70 @@ func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMeth
 		}
 	}
 
+	// Fetch all products in one batch
+	productIDs := make([]uint, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	products, err := s.products.GetMany(ctx, productIDs, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tax each line on its share of the order discounts
+	taxLines := make([]taxLine, 0, len(cart.Items))
+	variants := make(map[string]map[string]bool)
+	for _, item := range cart.Items {
+		lookup := products[item.ProductID]
+		if lookup.Err != nil {
+			return nil, fmt.Errorf("product %d: %w", item.ProductID, lookup.Err)
+		}
+		if _, ok := variants[lookup.Product.Category]; !ok {
+			variants[lookup.Product.Category], err = s.products.VariantAttributes(ctx, lookup.Product.Category)
+			if err != nil {
+				return nil, err
+			}
+		}
+		amount := item.Price * float64(item.Quantity)
+		if cart.Subtotal > 0 {
+			amount -= cart.DiscountTotal * amount / cart.Subtotal
+		}
+		taxLines = append(taxLines, taxLine{TaxClass: lookup.Product.taxClass(), Amount: amount})
+	}
+	taxes, err := s.taxes.Calculate(ctx, address, taxLines)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate taxes: %v", err)
+	}
+
+	total := math.Round((cart.Total+taxes.Exclusive+shippingRate.Cost)*100) / 100
+	status := OrderStatusPending
+	var authorization *Payment
+	placed := false
+	switch {
+	case paymentMethod == PaymentMethodCOD:
+		// Collected in cash on delivery
+	case total == 0:
+		// Nothing to charge, e.g. when promotions cover the whole order
+		status = OrderStatusPaid
+	default:
+		authorization, err = s.payments.Authorize(ctx, PaymentRequest{
+			UserID: userID,
+			Method: paymentMethod,
+			Token:  paymentToken,
+			Amount: total,
+		})
+		if err != nil {
+			return nil, err
+		}
+		status = OrderStatusAuthorized
+		// Release the authorization unless the order gets placed
+		defer func() {
+			if !placed {
+				s.payments.release(ctx, authorization)
+			}
+		}()
+	}
+
 	// Validate stock and create order
 	tx := s.db.Begin()
 	if tx.Error != nil {
@@ -98,11 +288,17 @@ func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMeth
 	}
 
 	order := &Order{
-		UserID:        userID,
-		Total:         cart.Total,
-		Status:        "pending",
-		PaymentMethod: paymentMethod,
-		Address:       address,
+		UserID:         userID,
+		Subtotal:       cart.Subtotal,
+		DiscountTotal:  cart.DiscountTotal,
+		FreeShipping:   cart.FreeShipping,
+		ShippingMethod: shippingRate.Method,
+		ShippingCost:   shippingRate.Cost,
+		TaxTotal:       taxes.Total,
+		Total:          total,
+		Status:         status,
+		PaymentMethod:  paymentMethod,
+		Address:        address,
 	}
 
 	if err := tx.Create(order).Error; err != nil {
@@ -110,61 +306,104 @@ func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMeth
 		return nil, err
 	}
 
-	// Create order items and update stock
-	for _, item := range cart.Items {
-		// Check stock
-		productURL := fmt.Sprintf("%s/api/products/%d", s.productsURL, item.ProductID)
-		resp, err := http.Get(productURL)
-		if err != nil {
+	if authorization != nil {
+		authorization.OrderID = order.ID
+		if err := tx.Create(authorization).Error; err != nil {
 			tx.Rollback()
-			return nil, fmt.Errorf("failed to fetch product: %v", err)
+			return nil, err
 		}
-		defer resp.Body.Close()
+	}
 
-		var product struct {
-			Stock int `json:"stock"`
+	// Carry the applied promotions into the order
+	for _, discount := range cart.Discounts {
+		orderDiscount := OrderDiscount{
+			OrderID:      order.ID,
+			PromotionID:  discount.PromotionID,
+			Code:         discount.Code,
+			Description:  discount.Description,
+			Amount:       discount.Amount,
+			FreeShipping: discount.FreeShipping,
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+		if err := tx.Create(&orderDiscount).Error; err != nil {
 			tx.Rollback()
-			return nil, fmt.Errorf("failed to decode product: %v", err)
+			return nil, err
 		}
+		order.Discounts = append(order.Discounts, orderDiscount)
+	}
 
-		if product.Stock < item.Quantity {
+	for _, orderTax := range taxes.Breakdown {
+		orderTax.OrderID = order.ID
+		if err := tx.Create(&orderTax).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		order.Taxes = append(order.Taxes, orderTax)
+	}
+
+	// Create order items and update stock, which is returned unless the
+	// order gets placed
+	var reserved []OrderItem
+	defer func() {
+		if !placed {
+			s.restock(ctx, reserved)
+		}
+	}()
+	for i, item := range cart.Items {
+		// Check stock
+		lookup := products[item.ProductID]
+		if lookup.Product.Stock < item.Quantity {
 			tx.Rollback()
 			return nil, fmt.Errorf("insufficient stock for product %d", item.ProductID)
 		}
 
 		// Create order item
 		orderItem := OrderItem{
-			OrderID:   order.ID,
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-			Price:     item.Price,
+			OrderID:     order.ID,
+			ProductID:   item.ProductID,
+			ProductName: lookup.Product.Name,
+			SKU:         lookup.Product.SKU,
+			Image:       lookup.Product.Image,
+			Options:     lookup.Product.options(variants[lookup.Product.Category]),
+			Quantity:    item.Quantity,
+			Price:       item.Price,
+			TaxClass:    taxLines[i].TaxClass,
+			TaxRate:     taxes.Lines[i].Rate,
+			TaxAmount:   taxes.Lines[i].Amount,
 		}
 		if err := tx.Create(&orderItem).Error; err != nil {
 			tx.Rollback()
 			return nil, err
 		}
+		order.Items = append(order.Items, orderItem)
 
 		// Update stock
-		updateURL := fmt.Sprintf("%s/api/products/%d/stock", s.productsURL, item.ProductID)
-		req, err := http.NewRequest("PUT", updateURL, nil)
-		if err != nil {
+		if err := s.products.AdjustStock(ctx, item.ProductID, -item.Quantity); err != nil {
 			tx.Rollback()
-			return nil, fmt.Errorf("failed to create stock update request: %v", err)
+			return nil, err
 		}
-		q := req.URL.Query()
-		q.Add("quantity", fmt.Sprintf("-%d", item.Quantity))
-		req.URL.RawQuery = q.Encode()
+		reserved = append(reserved, orderItem)
+	}
 
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
+	// Orders with nothing to charge are paid already, so they are invoiced now
+	if order.Status == OrderStatusPaid {
+		if _, err := s.invoices.issueInvoice(tx, order); err != nil {
 			tx.Rollback()
-			return nil, fmt.Errorf("failed to update stock: %v", err)
+			return nil, err
 		}
-		resp.Body.Close()
 	}
 
+	// Count the promotion usage, which is given back unless the order gets
+	// placed; fails if a usage limit was reached meanwhile
+	if err := s.redeemPromotions(ctx, userID, cart.Discounts); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer func() {
+		if !placed {
+			s.releasePromotions(ctx, userID, cart.Discounts)
+		}
+	}()
+
 	// Clear cart
 	clearURL := fmt.Sprintf("%s/api/cart/%d", s.cartURL, userID)
 	req, err := http.NewRequest("DELETE", clearURL, nil)
@@ -182,28 +421,107 @@ func (s *OrderService) CreateOrder(ctx context.Context, userID uint, paymentMeth
 	if err := tx.Commit().Error; err != nil {
 		return nil, err
 	}
+	placed = true
+
+	if authorization != nil && s.payments.autoCapture {
+		captured, err := s.payments.Capture(ctx, order.ID)
+		if err != nil {
+			// The order stays authorized and can be captured later
+			log.Printf("Failed to capture payment for order %d: %v", order.ID, err)
+		} else {
+			order.Status = captured.Status
+		}
+	}
 
 	return order, nil
 }
 
-func (s *OrderService) GetOrder(ctx context.Context, orderID uint) (*Order, error) {
+// chooseShipping prices the requested shipping method, or picks the cheapest
+// one when none was requested.
+func (s *OrderService) chooseShipping(ctx context.Context, method string, address Address, items []ShippingItem, subtotal float64) (*ShippingRate, error) {
+	if method != "" {
+		return s.shipping.QuoteMethod(ctx, method, address, items, subtotal)
+	}
+	rates, err := s.shipping.Quote(ctx, address, items, subtotal)
+	if err != nil {
+		return nil, err
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: no shipping method serves %s", ErrShippingUnavailable, address.Country)
+	}
+	return &rates[0], nil
+}
+
+// restock returns the quantities of items to stock, logging what could not be
+// returned.
+func (s *OrderService) restock(ctx context.Context, items []OrderItem) {
+	for _, item := range items {
+		if err := s.products.AdjustStock(ctx, item.ProductID, item.Quantity); err != nil {
+			log.Printf("Failed to return %d of product %d to stock: %v", item.Quantity, item.ProductID, err)
+		}
+	}
+}
+
+// lockOrder loads an order with its items and locks it for the rest of tx.
+func lockOrder(tx *gorm.DB, orderID uint) (*Order, error) {
 	var order Order
-	if err := s.db.Preload("Items").First(&order, orderID).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").First(&order, orderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrOrderNotFound
+		}
 		return nil, err
 	}
 	return &order, nil
 }
 
-func (s *OrderService) GetUserOrders(ctx context.Context, userID uint) ([]Order, error) {
-	var orders []Order
-	if err := s.db.Preload("Items").Where("user_id = ?", userID).Find(&orders).Error; err != nil {
+func (s *OrderService) GetOrder(ctx context.Context, orderID uint) (*Order, error) {
+	var order Order
+	if err := s.db.Preload("Items").Preload("Discounts").Preload("Taxes").First(&order, orderID).Error; err != nil {
 		return nil, err
 	}
-	return orders, nil
+	return &order, nil
 }
 
+// codPayableStatuses are the statuses in which a cash on delivery order can be
+// marked paid. Once shipping started the order keeps its shipping status.
+var codPayableStatuses = map[string]bool{
+	OrderStatusPending:          true,
+	OrderStatusPartiallyShipped: true,
+	OrderStatusShipped:          true,
+	OrderStatusDelivered:        true,
+}
+
+// UpdateOrderStatus sets the status of an order. Payment statuses follow the
+// payment provider, so only cash on delivery orders can be marked paid here,
+// which records the cash as their payment and invoices them, and orders are
+// cancelled with CancelOrder.
 func (s *OrderService) UpdateOrderStatus(ctx context.Context, orderID uint, status string) error {
-	return s.db.Model(&Order{}).Where("id = ?", orderID).Update("status", status).Error
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if status != OrderStatusPaid || order.PaymentMethod != PaymentMethodCOD {
+			if managedStatuses[status] {
+				return fmt.Errorf("%w: %s cannot be set directly", ErrInvalidOrderState, status)
+			}
+			return tx.Model(order).Update("status", status).Error
+		}
+
+		if !codPayableStatuses[order.Status] {
+			return fmt.Errorf("%w: a %s order cannot be marked paid", ErrInvalidOrderState, order.Status)
+		}
+		if err := s.payments.recordCashPayment(tx, order); err != nil {
+			return err
+		}
+		if order.Status == OrderStatusPending {
+			if err := tx.Model(order).Update("status", status).Error; err != nil {
+				return err
+			}
+		}
+		_, err = s.invoices.issueInvoice(tx, order)
+		return err
+	})
 }
 
 func (s *OrderService) isFeatureEnabled(ctx context.Context, featureName string) (bool, error) {
@@ -242,16 +560,55 @@ func main() {
 	}
 
 	// Auto-migrate the schema
-	if err := db.AutoMigrate(&Order{}, &OrderItem{}); err != nil {
+	if err := db.AutoMigrate(models...); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
+	if err := migrateLegacyAddress(db); err != nil {
+		log.Fatalf("Failed to migrate order addresses: %v", err)
+	}
 
 	// Initialize order service
+	products := newProductClient(os.Getenv("PRODUCTS_SERVICE_URL"), getEnvDuration("PRODUCT_CACHE_TTL", 5*time.Second))
+	rateProviders, err := loadRateProviders()
+	if err != nil {
+		log.Fatalf("Failed to load shipping methods: %v", err)
+	}
+	shippingService := NewShippingService(rateProviders, products)
+	taxService := NewTaxService(db)
+	paymentProvider, err := NewPaymentProvider(os.Getenv("PAYMENT_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Failed to set up payments: %v", err)
+	}
+	// The seller address lines are separated by semicolons
+	seller := InvoiceSeller{Name: os.Getenv("INVOICE_SELLER_NAME"), TaxID: os.Getenv("INVOICE_SELLER_TAX_ID")}
+	if seller.Name == "" {
+		seller.Name = "E-Commerce Platform"
+	}
+	for _, line := range strings.Split(os.Getenv("INVOICE_SELLER_ADDRESS"), ";") {
+		if line = strings.TrimSpace(line); line != "" {
+			seller.Address = append(seller.Address, line)
+		}
+	}
+	invoiceService := NewInvoiceService(db, seller)
+	paymentService := NewPaymentService(db, paymentProvider, getEnvBool("PAYMENT_AUTO_CAPTURE", true), invoiceService)
+	webhookService := NewWebhookService(
+		db,
+		paymentProvider.Name(),
+		os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+		getEnvDuration("PAYMENT_WEBHOOK_TOLERANCE", 5*time.Minute),
+		invoiceService,
+	)
 	service := NewOrderService(
 		db,
 		os.Getenv("CART_SERVICE_URL"),
 		os.Getenv("PRODUCTS_SERVICE_URL"),
 		os.Getenv("FEATURE_TOGGLE_URL"),
+		products,
+		shippingService,
+		taxService,
+		paymentService,
+		invoiceService,
+		getEnvDuration("ORDER_RETURN_WINDOW", 30*24*time.Hour),
 	)
 
 	// Initialize Gin router
@@ -260,22 +617,65 @@ func main() {
 	// API routes
 	r.POST("/api/orders", func(c *gin.Context) {
 		var input struct {
-			UserID        uint   `json:"userId" binding:"required"`
-			PaymentMethod string `json:"paymentMethod" binding:"required"`
-			Address       string `json:"address" binding:"required"`
+			UserID         uint    `json:"userId" binding:"required"`
+			PaymentMethod  string  `json:"paymentMethod" binding:"required"`
+			PaymentToken   string  `json:"paymentToken"`
+			Address        Address `json:"address" binding:"required"`
+			ShippingMethod string  `json:"shippingMethod"`
 		}
 		if err := c.BindJSON(&input); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 			return
 		}
-		order, err := service.CreateOrder(c.Request.Context(), input.UserID, input.PaymentMethod, input.Address)
+		order, err := service.CreateOrder(c.Request.Context(), input.UserID, input.PaymentMethod, input.PaymentToken, input.Address, input.ShippingMethod)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			writeOrderError(c, err)
 			return
 		}
 		c.JSON(http.StatusCreated, order)
 	})
 
+	r.POST("/api/shipping/quote", func(c *gin.Context) {
+		var input struct {
+			Address  Address        `json:"address" binding:"required"`
+			Items    []ShippingItem `json:"items" binding:"required"`
+			Subtotal float64        `json:"subtotal"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		rates, err := shippingService.Quote(c.Request.Context(), input.Address, input.Items, input.Subtotal)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"rates": rates})
+	})
+
+	r.GET("/api/admin/tax-rules", func(c *gin.Context) {
+		rules, err := taxService.GetRules(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tax rules"})
+			return
+		}
+		c.JSON(http.StatusOK, rules)
+	})
+
+	r.PUT("/api/admin/tax-rules", func(c *gin.Context) {
+		var rules []TaxRule
+		if err := c.BindJSON(&rules); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		rules, err := taxService.SetRules(c.Request.Context(), rules)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, rules)
+	})
+
 	r.GET("/api/orders/:id", func(c *gin.Context) {
 		orderID := uint(parseUint(c.Param("id")))
 		order, err := service.GetOrder(c.Request.Context(), orderID)
@@ -286,14 +686,337 @@ func main() {
 		c.JSON(http.StatusOK, order)
 	})
 
+	r.GET("/api/orders/:id/payments", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		payments, err := paymentService.GetPayments(c.Request.Context(), orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+			return
+		}
+		c.JSON(http.StatusOK, payments)
+	})
+
+	r.POST("/api/orders/:id/capture", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		order, err := paymentService.Capture(c.Request.Context(), orderID)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, order)
+	})
+
+	// Invoices are served as PDF downloads, or as HTML with ?format=html
+	serveInvoice := func(c *gin.Context, invoice *Invoice) {
+		switch c.DefaultQuery("format", InvoiceFormatPDF) {
+		case InvoiceFormatPDF:
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+			c.Data(http.StatusOK, "application/pdf", invoice.PDF)
+		case InvoiceFormatHTML:
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(invoice.HTML))
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format parameter"})
+		}
+	}
+
+	r.GET("/api/orders/:id/invoice", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		invoice, err := invoiceService.GetInvoice(c.Request.Context(), orderID)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		serveInvoice(c, invoice)
+	})
+
+	r.GET("/api/orders/:id/invoices", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		invoices, err := invoiceService.GetInvoices(c.Request.Context(), orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invoices"})
+			return
+		}
+		c.JSON(http.StatusOK, invoices)
+	})
+
+	r.GET("/api/invoices/:number", func(c *gin.Context) {
+		invoice, err := invoiceService.GetByNumber(c.Request.Context(), c.Param("number"))
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		serveInvoice(c, invoice)
+	})
+
+	r.POST("/api/orders/:id/refunds", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		var input RefundRequest
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		refund, err := service.RefundOrder(c.Request.Context(), orderID, input)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, refund)
+	})
+
+	r.GET("/api/orders/:id/refunds", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		refunds, err := service.GetRefunds(c.Request.Context(), orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch refunds"})
+			return
+		}
+		c.JSON(http.StatusOK, refunds)
+	})
+
+	r.POST("/api/orders/:id/cancel", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		var input struct {
+			Reason string              `json:"reason" binding:"required"`
+			Items  []CancelItemRequest `json:"items"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		cancellation, err := service.CancelOrder(c.Request.Context(), orderID, input.Reason, input.Items)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, cancellation)
+	})
+
+	r.GET("/api/orders/:id/cancellations", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		cancellations, err := service.GetCancellations(c.Request.Context(), orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cancellations"})
+			return
+		}
+		c.JSON(http.StatusOK, cancellations)
+	})
+
+	r.POST("/api/orders/:id/shipments", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		var input struct {
+			Carrier        string                `json:"carrier" binding:"required"`
+			TrackingNumber string                `json:"trackingNumber"`
+			Items          []ShipmentItemRequest `json:"items"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		shipment, err := service.CreateShipment(c.Request.Context(), orderID, input.Carrier, input.TrackingNumber, input.Items)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, shipment)
+	})
+
+	r.GET("/api/orders/:id/shipments", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		shipments, err := service.GetShipments(c.Request.Context(), orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shipments"})
+			return
+		}
+		c.JSON(http.StatusOK, shipments)
+	})
+
+	r.GET("/api/shipments/:shipmentId", func(c *gin.Context) {
+		shipment, err := service.GetShipment(c.Request.Context(), uint(parseUint(c.Param("shipmentId"))))
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, shipment)
+	})
+
+	r.POST("/api/shipments/:shipmentId/events", func(c *gin.Context) {
+		var input struct {
+			Status   string `json:"status" binding:"required"`
+			Location string `json:"location"`
+			Note     string `json:"note"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		shipment, err := service.AddShipmentEvent(c.Request.Context(), uint(parseUint(c.Param("shipmentId"))), input.Status, input.Location, input.Note)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, shipment)
+	})
+
+	r.POST("/api/orders/:id/returns", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		var input struct {
+			UserID uint                `json:"userId" binding:"required"`
+			Reason string              `json:"reason" binding:"required"`
+			Note   string              `json:"note"`
+			Items  []ReturnItemRequest `json:"items" binding:"required"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		ret, err := service.RequestReturn(c.Request.Context(), orderID, input.UserID, input.Reason, input.Note, input.Items)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, ret)
+	})
+
+	r.GET("/api/orders/:id/returns", func(c *gin.Context) {
+		orderID := uint(parseUint(c.Param("id")))
+		returns, err := service.GetOrderReturns(c.Request.Context(), orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch returns"})
+			return
+		}
+		c.JSON(http.StatusOK, returns)
+	})
+
+	r.GET("/api/returns/:returnId", func(c *gin.Context) {
+		ret, err := service.GetReturn(c.Request.Context(), uint(parseUint(c.Param("returnId"))))
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, ret)
+	})
+
+	// Return actions take an optional note for the history
+	returnAction := func(apply func(context.Context, uint, string) (*OrderReturn, error)) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			var input struct {
+				Note string `json:"note"`
+			}
+			if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+				return
+			}
+			ret, err := apply(c.Request.Context(), uint(parseUint(c.Param("returnId"))), input.Note)
+			if err != nil {
+				writeOrderError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, ret)
+		}
+	}
+	r.POST("/api/returns/:returnId/approve", returnAction(service.ApproveReturn))
+	r.POST("/api/returns/:returnId/reject", returnAction(service.RejectReturn))
+	r.POST("/api/returns/:returnId/receive", returnAction(service.ReceiveReturn))
+	r.POST("/api/returns/:returnId/refund", returnAction(func(ctx context.Context, returnID uint, _ string) (*OrderReturn, error) {
+		return service.RefundReturn(ctx, returnID)
+	}))
+
+	r.POST("/api/payments/webhook", func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		event, duplicate, err := webhookService.Receive(c.Request.Context(), c.GetHeader(WebhookSignatureHeader), body)
+		if err != nil && event != nil {
+			// Stored but could not be applied; redelivery or replay retries it
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "id": event.ID})
+			return
+		}
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": event.ID, "status": event.Status, "duplicate": duplicate})
+	})
+
+	r.GET("/api/admin/payments/webhooks", func(c *gin.Context) {
+		limit := int(parseUint(c.DefaultQuery("limit", "50")))
+		if limit <= 0 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+			return
+		}
+		events, err := webhookService.GetEvents(c.Request.Context(), c.Query("status"), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook events"})
+			return
+		}
+		c.JSON(http.StatusOK, events)
+	})
+
+	r.POST("/api/admin/payments/webhooks/:id/replay", func(c *gin.Context) {
+		id := uint(parseUint(c.Param("id")))
+		event, err := webhookService.Replay(c.Request.Context(), id)
+		if err != nil && event != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "event": event})
+			return
+		}
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, event)
+	})
+
+	r.GET("/api/orders", func(c *gin.Context) {
+		query, err := parseOrderListQuery(c)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		if userID := c.Query("userId"); userID != "" {
+			query.UserID = uint(parseUint(userID))
+		}
+		page, err := service.ListOrders(c.Request.Context(), query)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, page)
+	})
+
+	// Lists a user's orders as a plain array; the cursor of the next page is
+	// returned in a header
 	r.GET("/api/orders/user/:userId", func(c *gin.Context) {
-		userID := uint(parseUint(c.Param("userId")))
-		orders, err := service.GetUserOrders(c.Request.Context(), userID)
+		query, err := parseOrderListQuery(c)
+		if err != nil {
+			writeOrderError(c, err)
+			return
+		}
+		query.UserID = uint(parseUint(c.Param("userId")))
+		page, err := service.ListOrders(c.Request.Context(), query)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
+			writeOrderError(c, err)
 			return
 		}
-		c.JSON(http.StatusOK, orders)
+		if page.NextCursor != "" {
+			c.Header(NextCursorHeader, page.NextCursor)
+		}
+		c.JSON(http.StatusOK, page.Orders)
+	})
+
+	r.GET("/api/orders/stats/co-purchases", func(c *gin.Context) {
+		top := int(parseUint(c.DefaultQuery("top", "20")))
+		if top <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid top parameter"})
+			return
+		}
+		pairs, err := service.GetCoPurchases(c.Request.Context(), top)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute co-purchases"})
+			return
+		}
+		c.JSON(http.StatusOK, pairs)
 	})
 
 	r.PUT("/api/orders/:id/status", func(c *gin.Context) {
@@ -306,7 +1029,7 @@ func main() {
 			return
 		}
 		if err := service.UpdateOrderStatus(c.Request.Context(), orderID, input.Status); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+			writeOrderError(c, err)
 			return
 		}
 		c.Status(http.StatusOK)
@@ -337,6 +1060,92 @@ func main() {
 	}
 }
 
+func writeOrderError(c *gin.Context, err error) {
+	var changed *CartChangedError
+	switch {
+	case errors.As(err, &changed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "changes": changed.Changes})
+	case errors.Is(err, ErrInvalidAddress), errors.Is(err, ErrInvalidShipment), errors.Is(err, ErrInvalidTaxRule):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrShippingUnavailable):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOutOfStock), errors.Is(err, ErrPromotionUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrProductNotFound), errors.Is(err, ErrProductDeleted):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidSignature):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidWebhook), errors.Is(err, ErrInvalidRefund), errors.Is(err, ErrInvalidReturn),
+		errors.Is(err, ErrInvalidCancellation), errors.Is(err, ErrInvalidOrderQuery):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOrderNotFound), errors.Is(err, ErrWebhookNotFound), errors.Is(err, ErrReturnNotFound),
+		errors.Is(err, ErrShipmentNotFound), errors.Is(err, ErrInvoiceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidOrderState):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPaymentDeclined):
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrPaymentFailed), errors.Is(err, ErrUnknownAuthorization):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// parseOrderListQuery reads the filters, sort and page of an order listing
+// from the query string. Dates are RFC 3339 timestamps or plain dates, with
+// createdTo including the whole day.
+func parseOrderListQuery(c *gin.Context) (OrderListQuery, error) {
+	query := OrderListQuery{
+		PaymentMethod: c.Query("paymentMethod"),
+		Sort:          c.Query("sort"),
+		Cursor:        c.Query("cursor"),
+	}
+	if status := c.Query("status"); status != "" {
+		query.Statuses = strings.Split(status, ",")
+	}
+	if include := c.Query("include"); include != "" {
+		query.Include = strings.Split(include, ",")
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return query, fmt.Errorf("%w: invalid limit %q", ErrInvalidOrderQuery, limit)
+		}
+		query.Limit = n
+	}
+	for param, target := range map[string]**time.Time{"createdFrom": &query.CreatedFrom, "createdTo": &query.CreatedTo} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			day, dayErr := time.Parse("2006-01-02", value)
+			if dayErr != nil {
+				return query, fmt.Errorf("%w: invalid %s %q", ErrInvalidOrderQuery, param, value)
+			}
+			t = day
+			if param == "createdTo" {
+				t = day.AddDate(0, 0, 1)
+			}
+		}
+		*target = &t
+	}
+	for param, target := range map[string]**float64{"minTotal": &query.MinTotal, "maxTotal": &query.MaxTotal} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		total, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return query, fmt.Errorf("%w: invalid %s %q", ErrInvalidOrderQuery, param, value)
+		}
+		*target = &total
+	}
+	return query, nil
+}
+
 func parseUint(s string) uint64 {
 	var result uint64
 	_, err := fmt.Sscanf(s, "%d", &result)
@@ -344,4 +1153,30 @@ func parseUint(s string) uint64 {
 		return 0
 	}
 	return result
-} 
\ No newline at end of file
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB returns a database for one test: a schema of its own in the database
+// in TEST_DATABASE_URL, given as keyword/value pairs, with the tables
+// migrated and dropped when the test ends. Tests that need a database are
+// skipped without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("failed to create schema %s: %v", schema, err)
+	}
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("failed to migrate the test database: %v", err)
+	}
+	return db
+}
+
+// testUpstream stands in for the cart, products and feature toggle services
+// the order service calls. It serves Cart from the revalidation endpoint and
+// keeps what was done to the cart, promotions and stock.
+type testUpstream struct {
+	Cart     string
+	Products map[uint]productInfo
+	// PromotionStatus and PromotionError answer promotion redemptions
+	PromotionStatus int
+	PromotionError  string
+
+	mu       sync.Mutex
+	adjusted map[uint]int
+	actions  []string
+}
+
+func (u *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var id uint
+	var action string
+	path := r.Method + " " + r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/revalidate"):
+		w.Write([]byte(u.Cart))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/cart/"):
+		u.record(path)
+		w.WriteHeader(http.StatusNoContent)
+	case scanPath(r.URL.Path, "/api/promotions/%s", &action):
+		u.record(path)
+		if action == "redeem" && u.PromotionStatus != 0 {
+			w.WriteHeader(u.PromotionStatus)
+			fmt.Fprintf(w, `{"error": %q}`, u.PromotionError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "POST /api/products/batch":
+		var req struct {
+			IDs []uint `json:"ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var batch struct {
+			Products []productInfo `json:"products"`
+			Missing  []uint        `json:"missing"`
+		}
+		for _, id := range req.IDs {
+			if product, ok := u.Products[id]; ok {
+				batch.Products = append(batch.Products, product)
+			} else {
+				batch.Missing = append(batch.Missing, id)
+			}
+		}
+		json.NewEncoder(w).Encode(batch)
+	case strings.HasPrefix(r.URL.Path, "/api/categories/"):
+		w.Write([]byte(`[]`))
+	case strings.HasPrefix(r.URL.Path, "/api/flags/"):
+		w.Write([]byte(`{"enabled": true}`))
+	case r.Method == http.MethodPut && scanPath(r.URL.Path, "/api/products/%d/stock", &id):
+		quantity, err := strconv.Atoi(r.URL.Query().Get("quantity"))
+		if err != nil {
+			http.Error(w, "invalid quantity", http.StatusBadRequest)
+			return
+		}
+		u.mu.Lock()
+		u.adjusted[id] += quantity
+		u.mu.Unlock()
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func scanPath(path, format string, value interface{}) bool {
+	_, err := fmt.Sscanf(path, format, value)
+	return err == nil
+}
+
+func (u *testUpstream) record(action string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.actions = append(u.actions, action)
+}
+
+// Adjusted returns how much the stock of a product was changed.
+func (u *testUpstream) Adjusted(id uint) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.adjusted[id]
+}
+
+// Actions returns the cart and promotion calls made so far.
+func (u *testUpstream) Actions() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.actions...)
+}
+
+// newTestOrderService returns an order service on db that pays through the
+// fake provider and calls the returned testUpstream.
+func newTestOrderService(t *testing.T, db *gorm.DB) (*OrderService, *testUpstream) {
+	t.Helper()
+	upstream := &testUpstream{adjusted: make(map[uint]int)}
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	rateProviders, err := loadRateProviders()
+	if err != nil {
+		t.Fatalf("failed to load shipping methods: %v", err)
+	}
+	invoices := NewInvoiceService(db, InvoiceSeller{Name: "Test Shop"})
+	payments := NewPaymentService(db, NewFakePaymentProvider(), true, invoices)
+	client := newProductClient(server.URL, time.Second)
+	service := NewOrderService(db, server.URL, server.URL, server.URL, client, NewShippingService(rateProviders, client), NewTaxService(db), payments, invoices, 30*24*time.Hour)
+	return service, upstream
+}
+
+// createTestOrder stores testOrder with the given status and payment method.
+func createTestOrder(t *testing.T, db *gorm.DB, status, paymentMethod string) *Order {
+	t.Helper()
+	order := testOrder()
+	order.ID = 0
+	for i := range order.Items {
+		order.Items[i].ID = 0
+	}
+	order.UserID = 7
+	order.Status = status
+	order.PaymentMethod = paymentMethod
+	order.Address = Address{Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"}
+	if err := db.Create(order).Error; err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+	return order
+}
+
+func TestCreateOrder(t *testing.T) {
+	const paidCart = `{"cart": {"items": [{"productId": 1, "quantity": 2, "price": 10}], "subtotal": 20, "total": 20}, "changes": []}`
+	const freeCart = `{"cart": {"items": [{"productId": 1, "quantity": 2, "price": 10}], "subtotal": 20,
+		"discounts": [{"promotionId": "spring", "description": "Free mugs", "amount": 20, "freeShipping": true}],
+		"discountTotal": 20, "freeShipping": true, "total": 0}, "changes": []}`
+	tests := []struct {
+		name          string
+		cart          string
+		paymentMethod string
+		wantStatus    string
+		wantInvoices  int
+	}{
+		{name: "nothing to charge is paid and invoiced", cart: freeCart, paymentMethod: "card", wantStatus: OrderStatusPaid, wantInvoices: 1},
+		{name: "card payment is captured and invoiced", cart: paidCart, paymentMethod: "card", wantStatus: OrderStatusPaid, wantInvoices: 1},
+		{name: "cash on delivery is pending", cart: paidCart, paymentMethod: PaymentMethodCOD, wantStatus: OrderStatusPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			service, upstream := newTestOrderService(t, db)
+			upstream.Cart = tt.cart
+			upstream.Products = map[uint]productInfo{1: {ID: 1, Name: "Mug", Price: 10, Stock: 5, Weight: 0.5}}
+			ctx := context.Background()
+			address := Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+
+			order, err := service.CreateOrder(ctx, 7, tt.paymentMethod, "tok_visa", address, "standard")
+			if err != nil {
+				t.Fatalf("failed to create order: %v", err)
+			}
+			if order.Status != tt.wantStatus {
+				t.Errorf("status %s, want %s", order.Status, tt.wantStatus)
+			}
+			invoices, err := service.invoices.GetInvoices(ctx, order.ID)
+			if err != nil {
+				t.Fatalf("failed to load invoices: %v", err)
+			}
+			if len(invoices) != tt.wantInvoices {
+				t.Errorf("%d invoices, want %d", len(invoices), tt.wantInvoices)
+			}
+			if got := upstream.Adjusted(1); got != -2 {
+				t.Errorf("stock adjusted by %d, want -2", got)
+			}
+		})
+	}
+}
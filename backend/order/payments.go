@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+const (
+	PaymentAuthorize = "authorize"
+	PaymentCapture   = "capture"
+	PaymentVoid      = "void"
+	PaymentRefund    = "refund"
+
+	PaymentSucceeded = "succeeded"
+	PaymentFailed    = "failed"
+)
+
+// PaymentMethodCOD is paid in cash on delivery and never goes through a
+// payment provider.
+const PaymentMethodCOD = "cod"
+
+var (
+	ErrPaymentDeclined      = errors.New("payment was declined")
+	ErrPaymentFailed        = errors.New("payment provider error")
+	ErrOrderNotFound        = errors.New("order not found")
+	ErrInvalidOrderState    = errors.New("operation not allowed in the current order status")
+	ErrUnknownAuthorization = errors.New("unknown payment authorization")
+)
+
+// Payment is one call to the payment provider for an order. Every attempt is
+// recorded, including failed ones, so the table is the payment history.
+// Reference is the provider's authorization reference, which later captures,
+// voids and refunds of the same payment share.
+type Payment struct {
+	gorm.Model
+	OrderID   uint    `json:"orderId" gorm:"not null;index"`
+	Provider  string  `json:"provider" gorm:"not null"`
+	Operation string  `json:"operation" gorm:"not null"`
+	Reference string  `json:"reference" gorm:"not null;default:'';index"`
+	Amount    float64 `json:"amount" gorm:"not null"`
+	Status    string  `json:"status" gorm:"not null"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// PaymentRequest asks a provider to authorize an amount. Token is the
+// provider-specific payment credential collected by the client.
+type PaymentRequest struct {
+	UserID uint
+	Method string
+	Token  string
+	Amount float64
+}
+
+// PaymentProvider charges a payment in two steps: Authorize reserves the
+// amount and returns a reference, Capture collects it. An authorization that
+// is not captured can be voided, and captured money refunded, in part or in
+// full. A refusal by the provider is reported as ErrPaymentDeclined.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, req PaymentRequest) (string, error)
+	Capture(ctx context.Context, reference string, amount float64) error
+	Void(ctx context.Context, reference string) error
+	Refund(ctx context.Context, reference string, amount float64) (string, error)
+}
+
+// NewPaymentProvider returns the provider configured by name.
+func NewPaymentProvider(name string) (PaymentProvider, error) {
+	switch name {
+	case "", "fake":
+		return NewFakePaymentProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
+
+// fakeAuthorization is the state of one payment at the fake provider.
+type fakeAuthorization struct {
+	amount   float64
+	captured float64
+	refunded float64
+	voided   bool
+}
+
+// FakePaymentProvider is an in-process provider for local development and
+// testing. It approves every payment except those with a token of
+// FakeTokenDeclined, and keeps its state in memory.
+type FakePaymentProvider struct {
+	mu             sync.Mutex
+	authorizations map[string]*fakeAuthorization
+}
+
+// FakeTokenDeclined makes the fake provider decline the authorization.
+const FakeTokenDeclined = "tok_declined"
+
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{authorizations: make(map[string]*fakeAuthorization)}
+}
+
+func (p *FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakePaymentProvider) Authorize(ctx context.Context, req PaymentRequest) (string, error) {
+	if req.Token == FakeTokenDeclined {
+		return "", fmt.Errorf("%w: card declined", ErrPaymentDeclined)
+	}
+	if req.Amount <= 0 {
+		return "", fmt.Errorf("%w: amount must be positive", ErrPaymentFailed)
+	}
+	reference, err := newPaymentReference("fake_auth_")
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authorizations[reference] = &fakeAuthorization{amount: req.Amount}
+	return reference, nil
+}
+
+func (p *FakePaymentProvider) Capture(ctx context.Context, reference string, amount float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	auth, ok := p.authorizations[reference]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: %s", ErrUnknownAuthorization, reference)
+	case auth.voided:
+		return fmt.Errorf("%w: authorization was voided", ErrPaymentFailed)
+	case auth.captured > 0:
+		return fmt.Errorf("%w: authorization was already captured", ErrPaymentFailed)
+	case amount <= 0 || amount > auth.amount:
+		return fmt.Errorf("%w: capture amount must be positive and at most %.2f", ErrPaymentFailed, auth.amount)
+	}
+	auth.captured = amount
+	return nil
+}
+
+func (p *FakePaymentProvider) Void(ctx context.Context, reference string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	auth, ok := p.authorizations[reference]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: %s", ErrUnknownAuthorization, reference)
+	case auth.captured > 0:
+		return fmt.Errorf("%w: captured payments must be refunded", ErrPaymentFailed)
+	}
+	auth.voided = true
+	return nil
+}
+
+func (p *FakePaymentProvider) Refund(ctx context.Context, reference string, amount float64) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	auth, ok := p.authorizations[reference]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("%w: %s", ErrUnknownAuthorization, reference)
+	case amount <= 0 || amount > auth.captured-auth.refunded+0.005:
+		return "", fmt.Errorf("%w: refund amount must be positive and at most the captured amount not yet refunded", ErrPaymentFailed)
+	}
+	refundReference, err := newPaymentReference("fake_refund_")
+	if err != nil {
+		return "", err
+	}
+	auth.refunded += amount
+	return refundReference, nil
+}
+
+func newPaymentReference(prefix string) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// PaymentService runs order payments through the provider and records every
+// attempt. With autoCapture the payment is captured right after the order is
+// placed; otherwise it stays authorized until captured explicitly. Captured
+// orders are invoiced.
+type PaymentService struct {
+	db          *gorm.DB
+	provider    PaymentProvider
+	autoCapture bool
+	invoices    *InvoiceService
+}
+
+func NewPaymentService(db *gorm.DB, provider PaymentProvider, autoCapture bool, invoices *InvoiceService) *PaymentService {
+	return &PaymentService{
+		db:          db,
+		provider:    provider,
+		autoCapture: autoCapture,
+		invoices:    invoices,
+	}
+}
+
+// Authorize reserves the order total with the provider before the order is
+// stored, so a declined payment leaves nothing behind.
+func (s *PaymentService) Authorize(ctx context.Context, req PaymentRequest) (*Payment, error) {
+	reference, err := s.provider.Authorize(ctx, req)
+	if err != nil {
+		if errors.Is(err, ErrPaymentDeclined) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrPaymentFailed, err)
+	}
+	return &Payment{
+		Provider:  s.provider.Name(),
+		Operation: PaymentAuthorize,
+		Reference: reference,
+		Amount:    req.Amount,
+		Status:    PaymentSucceeded,
+	}, nil
+}
+
+// release voids an authorization whose order could not be placed.
+func (s *PaymentService) release(ctx context.Context, authorization *Payment) {
+	if err := s.provider.Void(ctx, authorization.Reference); err != nil {
+		log.Printf("Failed to void payment authorization %s: %v", authorization.Reference, err)
+	}
+}
+
+// Capture collects the authorized payment of an order, marks it paid and
+// issues its invoice. The order row stays locked while the provider is called
+// so the payment is not captured twice.
+func (s *PaymentService) Capture(ctx context.Context, orderID uint) (*Order, error) {
+	var order *Order
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = lockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if order.Status != OrderStatusAuthorized {
+			return fmt.Errorf("%w: cannot capture a %s order", ErrInvalidOrderState, order.Status)
+		}
+		authorization, err := s.authorization(tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		// Items cancelled before the capture are not charged
+		capture := Payment{
+			OrderID:   orderID,
+			Provider:  s.provider.Name(),
+			Operation: PaymentCapture,
+			Reference: authorization.Reference,
+			Amount:    roundCents(authorization.Amount - order.CancelledTotal),
+			Status:    PaymentSucceeded,
+		}
+		captureErr := s.provider.Capture(ctx, authorization.Reference, capture.Amount)
+		if captureErr != nil {
+			capture.Status = PaymentFailed
+			capture.Error = captureErr.Error()
+		}
+		if err := tx.Create(&capture).Error; err != nil {
+			return err
+		}
+		if captureErr != nil {
+			return nil
+		}
+		order.Status = OrderStatusPaid
+		if err := tx.Model(order).Update("status", order.Status).Error; err != nil {
+			return err
+		}
+		_, err = s.invoices.issueInvoice(tx, order)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != OrderStatusPaid {
+		return nil, fmt.Errorf("%w: capture failed for order %d", ErrPaymentFailed, orderID)
+	}
+	return order, nil
+}
+
+// void releases the authorization of an order and records the attempt in tx.
+func (s *PaymentService) void(ctx context.Context, tx *gorm.DB, orderID uint) error {
+	authorization, err := s.authorization(tx, orderID)
+	if err != nil {
+		return err
+	}
+	payment := Payment{
+		OrderID:   orderID,
+		Provider:  s.provider.Name(),
+		Operation: PaymentVoid,
+		Reference: authorization.Reference,
+		Amount:    authorization.Amount,
+		Status:    PaymentSucceeded,
+	}
+	voidErr := s.provider.Void(ctx, authorization.Reference)
+	if voidErr != nil {
+		payment.Status = PaymentFailed
+		payment.Error = voidErr.Error()
+	}
+	if err := tx.Create(&payment).Error; err != nil {
+		return err
+	}
+	if voidErr != nil {
+		return fmt.Errorf("%w: %v", ErrPaymentFailed, voidErr)
+	}
+	return nil
+}
+
+// authorization returns the successful authorization of an order.
+func (s *PaymentService) authorization(tx *gorm.DB, orderID uint) (*Payment, error) {
+	var payment Payment
+	err := tx.Where("order_id = ? AND operation = ? AND status = ?", orderID, PaymentAuthorize, PaymentSucceeded).
+		Order("id DESC").First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: order %d has no payment authorization", ErrInvalidOrderState, orderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// capturedAmount is the total successfully captured for an order.
+func (s *PaymentService) capturedAmount(tx *gorm.DB, orderID uint) (float64, error) {
+	var captured float64
+	err := tx.Model(&Payment{}).
+		Where("order_id = ? AND operation = ? AND status = ?", orderID, PaymentCapture, PaymentSucceeded).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&captured).Error
+	return roundCents(captured), err
+}
+
+// recordCashPayment records the cash collected for a cash on delivery order as
+// its capture, so it is refunded like any other payment. Items cancelled before
+// the order was paid are not charged.
+func (s *PaymentService) recordCashPayment(tx *gorm.DB, order *Order) error {
+	captured, err := s.capturedAmount(tx, order.ID)
+	if err != nil {
+		return err
+	}
+	if captured > 0 {
+		return fmt.Errorf("%w: order %d was already paid", ErrInvalidOrderState, order.ID)
+	}
+	return tx.Create(&Payment{
+		OrderID:   order.ID,
+		Provider:  PaymentMethodCOD,
+		Operation: PaymentCapture,
+		Amount:    roundCents(order.Total - order.CancelledTotal),
+		Status:    PaymentSucceeded,
+	}).Error
+}
+
+// paidInCash reports whether the payment of an order was collected on
+// delivery rather than through the provider.
+func (s *PaymentService) paidInCash(tx *gorm.DB, orderID uint) (bool, error) {
+	var count int64
+	err := tx.Model(&Payment{}).
+		Where("order_id = ? AND operation = ? AND status = ? AND provider = ?", orderID, PaymentCapture, PaymentSucceeded, PaymentMethodCOD).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// refund gives back amount of the captured payment of an order and records
+// the attempt in tx. It returns the provider's refund reference. Cash is paid
+// back outside any provider, so such refunds are only recorded.
+func (s *PaymentService) refund(ctx context.Context, tx *gorm.DB, orderID uint, amount float64) (string, error) {
+	cash, err := s.paidInCash(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if cash {
+		reference, err := newPaymentReference("cod_refund_")
+		if err != nil {
+			return "", err
+		}
+		return reference, tx.Create(&Payment{
+			OrderID:   orderID,
+			Provider:  PaymentMethodCOD,
+			Operation: PaymentRefund,
+			Reference: reference,
+			Amount:    amount,
+			Status:    PaymentSucceeded,
+		}).Error
+	}
+
+	authorization, err := s.authorization(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	payment := Payment{
+		OrderID:   orderID,
+		Provider:  s.provider.Name(),
+		Operation: PaymentRefund,
+		Reference: authorization.Reference,
+		Amount:    amount,
+		Status:    PaymentSucceeded,
+	}
+	reference, refundErr := s.provider.Refund(ctx, authorization.Reference, amount)
+	if refundErr != nil {
+		payment.Status = PaymentFailed
+		payment.Error = refundErr.Error()
+	}
+	if err := tx.Create(&payment).Error; err != nil {
+		return "", err
+	}
+	if refundErr != nil {
+		return "", fmt.Errorf("%w: %v", ErrPaymentFailed, refundErr)
+	}
+	return reference, nil
+}
+
+// GetPayments returns the payment history of an order, oldest first.
+func (s *PaymentService) GetPayments(ctx context.Context, orderID uint) ([]Payment, error) {
+	var payments []Payment
+	if err := s.db.WithContext(ctx).Where("order_id = ?", orderID).Order("id").Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFakePaymentProvider(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFakePaymentProvider()
+
+	if _, err := provider.Authorize(ctx, PaymentRequest{Token: FakeTokenDeclined, Amount: 10}); !errors.Is(err, ErrPaymentDeclined) {
+		t.Errorf("declined token: got %v, want %v", err, ErrPaymentDeclined)
+	}
+	if _, err := provider.Authorize(ctx, PaymentRequest{Token: "tok_visa"}); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("no amount: got %v, want %v", err, ErrPaymentFailed)
+	}
+	authorize := func() string {
+		t.Helper()
+		reference, err := provider.Authorize(ctx, PaymentRequest{Token: "tok_visa", Amount: 100})
+		if err != nil {
+			t.Fatalf("failed to authorize: %v", err)
+		}
+		return reference
+	}
+
+	captured := authorize()
+	if err := provider.Capture(ctx, captured, 100.01); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("capture over the authorization: got %v, want %v", err, ErrPaymentFailed)
+	}
+	if err := provider.Capture(ctx, captured, 80); err != nil {
+		t.Fatalf("failed to capture: %v", err)
+	}
+	if err := provider.Capture(ctx, captured, 20); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("second capture: got %v, want %v", err, ErrPaymentFailed)
+	}
+	if err := provider.Void(ctx, captured); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("void after capture: got %v, want %v", err, ErrPaymentFailed)
+	}
+	if _, err := provider.Refund(ctx, captured, 50); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+	if _, err := provider.Refund(ctx, captured, 30); err != nil {
+		t.Fatalf("failed to refund the rest: %v", err)
+	}
+	if _, err := provider.Refund(ctx, captured, 0.01); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("refund beyond the capture: got %v, want %v", err, ErrPaymentFailed)
+	}
+
+	voided := authorize()
+	if err := provider.Void(ctx, voided); err != nil {
+		t.Fatalf("failed to void: %v", err)
+	}
+	if err := provider.Capture(ctx, voided, 100); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("capture after void: got %v, want %v", err, ErrPaymentFailed)
+	}
+	if _, err := provider.Refund(ctx, voided, 10); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("refund of nothing captured: got %v, want %v", err, ErrPaymentFailed)
+	}
+
+	if err := provider.Capture(ctx, "unknown", 10); !errors.Is(err, ErrUnknownAuthorization) {
+		t.Errorf("unknown reference: got %v, want %v", err, ErrUnknownAuthorization)
+	}
+}
+
+func TestPaymentCapture(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFakePaymentProvider()
+
+	tests := []struct {
+		name string
+		// known is whether the provider holds the authorization
+		known      bool
+		status     string
+		wantErr    error
+		wantStatus string
+		// wantLog is the operation and status of each payment, oldest first
+		wantLog      []string
+		wantInvoices int
+	}{
+		{
+			name: "authorized order", known: true, status: OrderStatusAuthorized, wantStatus: OrderStatusPaid,
+			wantLog:      []string{PaymentAuthorize + " " + PaymentSucceeded, PaymentCapture + " " + PaymentSucceeded},
+			wantInvoices: 1,
+		},
+		{
+			name: "provider error", status: OrderStatusAuthorized, wantErr: ErrPaymentFailed, wantStatus: OrderStatusAuthorized,
+			wantLog: []string{PaymentAuthorize + " " + PaymentSucceeded, PaymentCapture + " " + PaymentFailed},
+		},
+		{
+			name: "paid order", known: true, status: OrderStatusPaid, wantErr: ErrInvalidOrderState, wantStatus: OrderStatusPaid,
+			wantLog: []string{PaymentAuthorize + " " + PaymentSucceeded},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			invoices := NewInvoiceService(db, InvoiceSeller{Name: "Test Shop"})
+			payments := NewPaymentService(db, provider, false, invoices)
+			order := createTestOrder(t, db, tt.status, "card")
+			reference := "unknown"
+			if tt.known {
+				var err error
+				reference, err = provider.Authorize(ctx, PaymentRequest{Token: "tok_visa", Amount: order.Total})
+				if err != nil {
+					t.Fatalf("failed to authorize: %v", err)
+				}
+			}
+			authorization := Payment{OrderID: order.ID, Provider: provider.Name(), Operation: PaymentAuthorize, Reference: reference, Amount: order.Total, Status: PaymentSucceeded}
+			if err := db.Create(&authorization).Error; err != nil {
+				t.Fatalf("failed to create authorization: %v", err)
+			}
+
+			_, err := payments.Capture(ctx, order.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			var stored Order
+			if err := db.First(&stored, order.ID).Error; err != nil || stored.Status != tt.wantStatus {
+				t.Errorf("order %s, %v; want %s", stored.Status, err, tt.wantStatus)
+			}
+			history, err := payments.GetPayments(ctx, order.ID)
+			if err != nil {
+				t.Fatalf("failed to load payments: %v", err)
+			}
+			got := make([]string, 0, len(history))
+			for _, payment := range history {
+				got = append(got, payment.Operation+" "+payment.Status)
+			}
+			if !reflect.DeepEqual(got, tt.wantLog) {
+				t.Errorf("payments %v, want %v", got, tt.wantLog)
+			}
+			issued, err := invoices.GetInvoices(ctx, order.ID)
+			if err != nil {
+				t.Fatalf("failed to load invoices: %v", err)
+			}
+			if len(issued) != tt.wantInvoices {
+				t.Errorf("%d invoices, want %d", len(issued), tt.wantInvoices)
+			}
+		})
+	}
+}
+
+func TestCreateOrderDeclined(t *testing.T) {
+	db := testDB(t)
+	service, upstream := newTestOrderService(t, db)
+	upstream.Cart = `{"cart": {"items": [{"productId": 1, "quantity": 2, "price": 10}], "subtotal": 20, "total": 20}, "changes": []}`
+	upstream.Products = map[uint]productInfo{1: {ID: 1, Name: "Mug", Price: 10, Stock: 5, Weight: 0.5}}
+	address := Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+
+	_, err := service.CreateOrder(context.Background(), 7, "card", FakeTokenDeclined, address, "standard")
+	if !errors.Is(err, ErrPaymentDeclined) {
+		t.Fatalf("got %v, want %v", err, ErrPaymentDeclined)
+	}
+	var orders, payments int64
+	db.Model(&Order{}).Count(&orders)
+	db.Model(&Payment{}).Count(&payments)
+	if orders != 0 || payments != 0 || upstream.Adjusted(1) != 0 {
+		t.Errorf("%d orders, %d payments and stock adjusted by %d, want none", orders, payments, upstream.Adjusted(1))
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeOrderError(c, err)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("status %d, want %d", w.Code, http.StatusPaymentRequired)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPDFString(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{name: "plain text", line: "Total 12.50", want: "Total 12.50"},
+		{name: "parentheses and backslashes are escaped", line: `(a) \ b`, want: `\(a\) \\ b`},
+		{name: "tabs become spaces", line: "a\tb", want: "a    b"},
+		{name: "control characters are dropped", line: "a\x00b\x1bc\x7f", want: "abc"},
+		{name: "Latin-1 as octal", line: "café", want: `caf\351`},
+		{name: "euro sign", line: "€5", want: `\2005`},
+		{name: "other characters are replaced", line: "a→b 日", want: "a?b ?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pdfString(tt.line); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextPDF(t *testing.T) {
+	lines := func(n int) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "line %d\n", i)
+		}
+		return b.String()
+	}
+	tests := []struct {
+		name  string
+		text  string
+		pages int
+	}{
+		{name: "empty text", text: "", pages: 1},
+		{name: "short text", text: "Invoice INV000001\nTotal (EUR) 12.50\n", pages: 1},
+		{name: "a full page", text: lines(pdfLinesPerPage), pages: 1},
+		{name: "one line more", text: lines(pdfLinesPerPage + 1), pages: 2},
+		{name: "several pages", text: lines(2*pdfLinesPerPage + 5), pages: 3},
+	}
+	xrefEntry := regexp.MustCompile(`(?m)^(\d{10}) 00000 n $`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdf := textPDF(tt.text)
+			if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+				t.Fatalf("not a PDF file:\n%s", pdf)
+			}
+			if count := fmt.Sprintf("/Count %d ", tt.pages); !bytes.Contains(pdf, []byte(count)) {
+				t.Errorf("page tree has no %q", count)
+			}
+
+			// Every object is where the cross-reference table says it is
+			entries := xrefEntry.FindAllSubmatch(pdf, -1)
+			if want := 3 + 2*tt.pages; len(entries) != want {
+				t.Fatalf("%d objects, want %d", len(entries), want)
+			}
+			for i, entry := range entries {
+				offset, _ := strconv.Atoi(string(entry[1]))
+				if header := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(pdf[offset:], []byte(header)) {
+					t.Errorf("object %d is not at offset %d", i+1, offset)
+				}
+			}
+			start := bytes.LastIndex(pdf, []byte("startxref\n"))
+			var xref int
+			fmt.Sscanf(string(pdf[start+len("startxref\n"):]), "%d", &xref)
+			if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+				t.Errorf("startxref %d does not point at the cross-reference table", xref)
+			}
+		})
+	}
+}
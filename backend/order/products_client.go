@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// productBatchSize matches the products service limit per batch request.
+const productBatchSize = 100
+
+// productInfo is the subset of the products service response the order service needs.
+type productInfo struct {
+	ID         uint                   `json:"ID"`
+	Name       string                 `json:"name"`
+	SKU        string                 `json:"sku"`
+	Image      string                 `json:"image"`
+	Price      float64                `json:"price"`
+	Stock      int                    `json:"stock"`
+	Weight     float64                `json:"weight"`
+	TaxClass   string                 `json:"taxClass"`
+	Category   string                 `json:"category"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// taxClass returns the product's tax class, defaulting for products saved
+// before tax classes existed.
+func (p productInfo) taxClass() string {
+	if p.TaxClass == "" {
+		return DefaultTaxClass
+	}
+	return p.TaxClass
+}
+
+// options returns the product's variant attributes, e.g. color and size, as
+// the options of an order item. variants names the variant attributes of the
+// product's category.
+func (p productInfo) options(variants map[string]bool) ItemOptions {
+	options := ItemOptions{}
+	for name, value := range p.Attributes {
+		if !variants[name] {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			options[name] = v
+		case float64:
+			options[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			options[name] = strconv.FormatBool(v)
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// ItemOptions holds the variant options of an order item as a JSONB column.
+type ItemOptions map[string]string
+
+func (o ItemOptions) Value() (driver.Value, error) {
+	if o == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (o *ItemOptions) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, o)
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	default:
+		return fmt.Errorf("unsupported JSON column type %T", value)
+	}
+}
+
+// String lists the options sorted by name, e.g. "color: red, size: M".
+func (o ItemOptions) String() string {
+	names := make([]string, 0, len(o))
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %s", name, o[name])
+	}
+	return b.String()
+}
+
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrProductDeleted  = errors.New("product is no longer available")
+	ErrOutOfStock      = errors.New("not enough stock")
+)
+
+// productLookup is the outcome of looking up one product: either the product
+// or ErrProductNotFound / ErrProductDeleted.
+type productLookup struct {
+	Product productInfo
+	Err     error
+}
+
+type cachedLookup struct {
+	lookup  productLookup
+	expires time.Time
+}
+
+type cachedVariants struct {
+	variants map[string]bool
+	expires  time.Time
+}
+
+// productClient fetches products from the products service in batches and
+// keeps the results for a short time to absorb repeated lookups.
+type productClient struct {
+	baseURL string
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	cache    map[uint]cachedLookup
+	variants map[string]cachedVariants
+}
+
+func newProductClient(baseURL string, ttl time.Duration) *productClient {
+	return &productClient{
+		baseURL:  baseURL,
+		ttl:      ttl,
+		cache:    make(map[uint]cachedLookup),
+		variants: make(map[string]cachedVariants),
+	}
+}
+
+// GetMany returns a lookup for every id. Cached entries are used unless fresh
+// is set; everything else is fetched with as few requests as possible.
+func (c *productClient) GetMany(ctx context.Context, ids []uint, fresh bool) (map[uint]productLookup, error) {
+	lookups := make(map[uint]productLookup, len(ids))
+	var missing []uint
+
+	now := time.Now()
+	c.mu.Lock()
+	for _, id := range ids {
+		if entry, ok := c.cache[id]; ok && !fresh && now.Before(entry.expires) {
+			lookups[id] = entry.lookup
+			continue
+		}
+		missing = append(missing, id)
+	}
+	c.mu.Unlock()
+
+	for start := 0; start < len(missing); start += productBatchSize {
+		end := start + productBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		fetched, err := c.fetchBatch(ctx, missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		expires := time.Now().Add(c.ttl)
+		c.mu.Lock()
+		for id, lookup := range fetched {
+			lookups[id] = lookup
+			c.cache[id] = cachedLookup{lookup: lookup, expires: expires}
+		}
+		c.mu.Unlock()
+	}
+	c.evictExpired(now)
+	return lookups, nil
+}
+
+func (c *productClient) evictExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entry := range c.cache {
+		if now.After(entry.expires) {
+			delete(c.cache, id)
+		}
+	}
+}
+
+func (c *productClient) fetchBatch(ctx context.Context, ids []uint) (map[uint]productLookup, error) {
+	body, err := json.Marshal(map[string][]uint{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("%s/api/products/batch", c.baseURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create products request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch products: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch products: unexpected status %d", resp.StatusCode)
+	}
+
+	var batch struct {
+		Products []productInfo `json:"products"`
+		Deleted  []uint        `json:"deleted"`
+		Missing  []uint        `json:"missing"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to decode products: %v", err)
+	}
+
+	lookups := make(map[uint]productLookup, len(ids))
+	for _, product := range batch.Products {
+		lookups[product.ID] = productLookup{Product: product}
+	}
+	for _, id := range batch.Deleted {
+		lookups[id] = productLookup{Err: ErrProductDeleted}
+	}
+	for _, id := range batch.Missing {
+		lookups[id] = productLookup{Err: ErrProductNotFound}
+	}
+	return lookups, nil
+}
+
+// VariantAttributes returns the names of the variant attributes in the
+// attribute schema of a category.
+func (c *productClient) VariantAttributes(ctx context.Context, category string) (map[string]bool, error) {
+	if category == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.variants[category]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.variants, nil
+	}
+
+	schemaURL := fmt.Sprintf("%s/api/categories/%s/attributes", c.baseURL, url.PathEscape(category))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, schemaURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attribute schema request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch attribute schema: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch attribute schema: unexpected status %d", resp.StatusCode)
+	}
+	var definitions []struct {
+		Name    string `json:"name"`
+		Variant bool   `json:"variant"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&definitions); err != nil {
+		return nil, fmt.Errorf("failed to decode attribute schema: %v", err)
+	}
+
+	variants := make(map[string]bool)
+	for _, definition := range definitions {
+		if definition.Variant {
+			variants[definition.Name] = true
+		}
+	}
+	c.mu.Lock()
+	c.variants[category] = cachedVariants{variants: variants, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return variants, nil
+}
+
+// AdjustStock adds delta to the stock of a product, or takes it away when
+// negative. The products service refuses to take stock below zero.
+func (c *productClient) AdjustStock(ctx context.Context, productID uint, delta int) error {
+	url := fmt.Sprintf("%s/api/products/%d/stock?quantity=%d", c.baseURL, productID, delta)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create stock update request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to update stock: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("%w for product %d", ErrOutOfStock, productID)
+	case http.StatusNotFound:
+		return fmt.Errorf("product %d: %w", productID, ErrProductNotFound)
+	default:
+		return fmt.Errorf("failed to update stock: unexpected status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "context"
+
+// CoPurchase counts how many orders contain both ProductID and RelatedProductID.
+type CoPurchase struct {
+	ProductID        uint  `json:"productId"`
+	RelatedProductID uint  `json:"relatedProductId"`
+	Count            int64 `json:"count"`
+}
+
+// GetCoPurchases returns, for every product, the top related products by the
+// number of non-cancelled orders they appear in together.
+func (s *OrderService) GetCoPurchases(ctx context.Context, top int) ([]CoPurchase, error) {
+	var pairs []CoPurchase
+	err := s.db.WithContext(ctx).Raw(`
+		SELECT product_id, related_product_id, count
+		FROM (
+			SELECT a.product_id AS product_id,
+				b.product_id AS related_product_id,
+				COUNT(DISTINCT a.order_id) AS count,
+				ROW_NUMBER() OVER (
+					PARTITION BY a.product_id
+					ORDER BY COUNT(DISTINCT a.order_id) DESC, b.product_id
+				) AS rank
+			FROM order_items a
+			JOIN order_items b ON b.order_id = a.order_id AND b.product_id <> a.product_id
+			JOIN orders o ON o.id = a.order_id
+			WHERE a.deleted_at IS NULL
+				AND b.deleted_at IS NULL
+				AND o.deleted_at IS NULL
+				AND o.status <> 'cancelled'
+			GROUP BY a.product_id, b.product_id
+		) ranked
+		WHERE rank <= ?
+		ORDER BY product_id, count DESC`, top).
+		Scan(&pairs).Error
+	if err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidRefund = errors.New("invalid refund")
+
+// refundReasons are the accepted refund reason codes.
+var refundReasons = map[string]bool{
+	"customer_request": true,
+	"damaged":          true,
+	"defective":        true,
+	"wrong_item":       true,
+	"not_received":     true,
+	"duplicate":        true,
+	"fraud":            true,
+	"other":            true,
+}
+
+// OrderRefund is money given back for an order, either for specific lines or
+// as a lump sum. Reference is the provider's reference for the refund.
+type OrderRefund struct {
+	gorm.Model
+	OrderID   uint         `json:"orderId" gorm:"not null;index"`
+	Amount    float64      `json:"amount" gorm:"not null"`
+	Reason    string       `json:"reason" gorm:"not null"`
+	Note      string       `json:"note,omitempty"`
+	Reference string       `json:"reference" gorm:"not null;default:''"`
+	Lines     []RefundLine `json:"lines" gorm:"foreignKey:RefundID"`
+}
+
+// RefundLine is the part of a refund for one order item. Restocked reports
+// whether the quantity made it back into stock.
+type RefundLine struct {
+	gorm.Model
+	RefundID    uint    `json:"refundId" gorm:"not null;index"`
+	OrderItemID uint    `json:"orderItemId" gorm:"not null;index"`
+	ProductID   uint    `json:"productId" gorm:"not null"`
+	Quantity    int     `json:"quantity" gorm:"not null"`
+	Amount      float64 `json:"amount" gorm:"not null"`
+	Restock     bool    `json:"restock" gorm:"not null;default:false"`
+	Restocked   bool    `json:"restocked" gorm:"not null;default:false"`
+}
+
+// RefundRequest asks for a refund. Without lines and amount the whole
+// remaining captured amount is refunded for all items. Amount on its own is
+// a lump sum, and alongside lines an extra amount such as shipping. Restock
+// is the default for lines that do not say.
+type RefundRequest struct {
+	Reason  string              `json:"reason"`
+	Note    string              `json:"note"`
+	Amount  float64             `json:"amount"`
+	Restock bool                `json:"restock"`
+	Lines   []RefundLineRequest `json:"lines"`
+}
+
+// RefundLineRequest refunds quantity units of an order item. Amount defaults
+// to what was paid for those units.
+type RefundLineRequest struct {
+	OrderItemID uint    `json:"orderItemId"`
+	Quantity    int     `json:"quantity"`
+	Amount      float64 `json:"amount"`
+	Restock     *bool   `json:"restock"`
+}
+
+// itemPaid is what the customer paid for an order item: its price after its
+// share of the discounts, plus its share of the taxes added on top.
+func itemPaid(order *Order, item *OrderItem) float64 {
+	paid := item.Price * float64(item.Quantity)
+	if order.Subtotal > 0 {
+		paid -= order.DiscountTotal * paid / order.Subtotal
+	}
+	exclusiveTax := order.Total - (order.Subtotal - order.DiscountTotal) - order.ShippingCost
+	if exclusiveTax > 0 && order.TaxTotal > 0 {
+		paid += exclusiveTax * item.TaxAmount / order.TaxTotal
+	}
+	return roundCents(paid)
+}
+
+// refundedItem is what has been refunded for an order item so far, apart
+// from refunds for cancelled items, which count as cancelled instead.
+type refundedItem struct {
+	Quantity int
+	Amount   float64
+}
+
+// openQuantity is how much of an order item is neither cancelled nor
+// refunded.
+func openQuantity(item *OrderItem, refunded map[uint]refundedItem) int {
+	return item.Quantity - item.CancelledQuantity - refunded[item.ID].Quantity
+}
+
+func refundedItems(tx *gorm.DB, orderID uint) (map[uint]refundedItem, error) {
+	var rows []struct {
+		OrderItemID uint
+		Quantity    int
+		Amount      float64
+	}
+	err := tx.Model(&RefundLine{}).
+		Select("refund_lines.order_item_id, SUM(refund_lines.quantity) AS quantity, SUM(refund_lines.amount) AS amount").
+		Joins("JOIN order_refunds ON order_refunds.id = refund_lines.refund_id").
+		Where("order_refunds.order_id = ?", orderID).
+		Where("order_refunds.id NOT IN (?)", tx.Model(&OrderCancellation{}).Select("refund_id").Where("refund_id IS NOT NULL")).
+		Group("refund_lines.order_item_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	refunded := make(map[uint]refundedItem, len(rows))
+	for _, row := range rows {
+		refunded[row.OrderItemID] = refundedItem{Quantity: row.Quantity, Amount: row.Amount}
+	}
+	return refunded, nil
+}
+
+// RefundOrder refunds captured money for an order through the payment
+// provider and puts refunded quantities flagged for restocking back into
+// stock. Refunds never exceed the captured amount, per item what was paid
+// for it, or the quantities ordered.
+func (s *OrderService) RefundOrder(ctx context.Context, orderID uint, req RefundRequest) (*OrderRefund, error) {
+	if !refundReasons[req.Reason] {
+		return nil, fmt.Errorf("%w: unknown reason %q", ErrInvalidRefund, req.Reason)
+	}
+	if req.Amount < 0 {
+		return nil, fmt.Errorf("%w: amount must not be negative", ErrInvalidRefund)
+	}
+
+	var refund *OrderRefund
+	var refundErr error
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		// A failed refund is committed to keep it in the payment history
+		refund, refundErr, err = s.refundLocked(ctx, tx, order, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if refundErr != nil {
+		return nil, refundErr
+	}
+
+	for i := range refund.Lines {
+		line := &refund.Lines[i]
+		if !line.Restock || line.Quantity == 0 {
+			continue
+		}
+		if err := s.products.AdjustStock(ctx, line.ProductID, line.Quantity); err != nil {
+			log.Printf("Failed to restock %d of product %d for refund %d: %v", line.Quantity, line.ProductID, refund.ID, err)
+			continue
+		}
+		line.Restocked = true
+		if err := s.db.WithContext(ctx).Model(line).Update("restocked", true).Error; err != nil {
+			log.Printf("Failed to mark refund line %d restocked: %v", line.ID, err)
+		}
+	}
+	return refund, nil
+}
+
+// buildRefundLines turns the requested lines into refund lines, checking
+// them against what is left to refund per item. A full refund covers every
+// item that is not refunded yet.
+func buildRefundLines(order *Order, req RefundRequest, refunded map[uint]refundedItem) ([]RefundLine, error) {
+	items := make(map[uint]*OrderItem, len(order.Items))
+	for i := range order.Items {
+		items[order.Items[i].ID] = &order.Items[i]
+	}
+
+	requested := req.Lines
+	if len(requested) == 0 && req.Amount == 0 {
+		for i := range order.Items {
+			item := &order.Items[i]
+			if quantity := openQuantity(item, refunded); quantity > 0 {
+				requested = append(requested, RefundLineRequest{OrderItemID: item.ID, Quantity: quantity})
+			}
+		}
+	}
+
+	lines := make([]RefundLine, 0, len(requested))
+	seen := make(map[uint]bool, len(requested))
+	for _, lineReq := range requested {
+		item, ok := items[lineReq.OrderItemID]
+		if !ok {
+			return nil, fmt.Errorf("%w: order item %d is not part of order %d", ErrInvalidRefund, lineReq.OrderItemID, order.ID)
+		}
+		if seen[item.ID] {
+			return nil, fmt.Errorf("%w: order item %d is listed twice", ErrInvalidRefund, item.ID)
+		}
+		seen[item.ID] = true
+
+		done := refunded[item.ID]
+		paid := itemPaid(order, item)
+		// Cancelled units were refunded or never charged
+		leftQuantity := openQuantity(item, refunded)
+		leftAmount := roundCents(paid*float64(item.Quantity-item.CancelledQuantity)/float64(item.Quantity) - done.Amount)
+		switch {
+		case lineReq.Quantity < 0 || lineReq.Quantity > leftQuantity:
+			return nil, fmt.Errorf("%w: only %d of order item %d can be refunded", ErrInvalidRefund, leftQuantity, item.ID)
+		case lineReq.Amount < 0 || lineReq.Amount > leftAmount:
+			return nil, fmt.Errorf("%w: at most %.2f can be refunded for order item %d", ErrInvalidRefund, leftAmount, item.ID)
+		case lineReq.Quantity == 0 && lineReq.Amount == 0:
+			return nil, fmt.Errorf("%w: order item %d needs a quantity or an amount", ErrInvalidRefund, item.ID)
+		}
+
+		amount := lineReq.Amount
+		if amount == 0 {
+			// The last units take whatever is left so rounding adds up
+			amount = roundCents(paid * float64(lineReq.Quantity) / float64(item.Quantity))
+			if lineReq.Quantity == leftQuantity || amount > leftAmount {
+				amount = leftAmount
+			}
+		}
+		restock := req.Restock
+		if lineReq.Restock != nil {
+			restock = *lineReq.Restock
+		}
+		lines = append(lines, RefundLine{
+			OrderItemID: item.ID,
+			ProductID:   item.ProductID,
+			Quantity:    lineReq.Quantity,
+			Amount:      amount,
+			Restock:     restock,
+		})
+	}
+	return lines, nil
+}
+
+// GetRefunds returns the refunds of an order, oldest first.
+func (s *OrderService) GetRefunds(ctx context.Context, orderID uint) ([]OrderRefund, error) {
+	var refunds []OrderRefund
+	if err := s.db.WithContext(ctx).Preload("Lines").Where("order_id = ?", orderID).Order("id").Find(&refunds).Error; err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// refundLocked refunds money for an order locked in tx and issues a credit
+// note for it. A refusal by the payment provider is returned as providerErr,
+// after the failed attempt was recorded in tx; err reports everything else.
+func (s *OrderService) refundLocked(ctx context.Context, tx *gorm.DB, order *Order, req RefundRequest) (refund *OrderRefund, providerErr error, err error) {
+	captured, err := s.payments.capturedAmount(tx, order.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if captured == 0 {
+		return nil, nil, fmt.Errorf("%w: order %d has no captured payment", ErrInvalidOrderState, order.ID)
+	}
+	refunded, err := refundedItems(tx, order.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines, err := buildRefundLines(order, req, refunded)
+	if err != nil {
+		return nil, nil, err
+	}
+	amount := req.Amount
+	for _, line := range lines {
+		amount += line.Amount
+	}
+	amount = roundCents(amount)
+	remaining := roundCents(captured - order.RefundedTotal)
+	if len(req.Lines) == 0 && req.Amount == 0 {
+		amount = remaining
+	}
+	switch {
+	case amount <= 0:
+		return nil, nil, fmt.Errorf("%w: nothing left to refund", ErrInvalidRefund)
+	case amount > remaining:
+		return nil, nil, fmt.Errorf("%w: %.2f exceeds the %.2f left of the captured amount", ErrInvalidRefund, amount, remaining)
+	}
+
+	reference, err := s.payments.refund(ctx, tx, order.ID, amount)
+	if errors.Is(err, ErrPaymentFailed) {
+		return nil, err, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refund = &OrderRefund{
+		OrderID:   order.ID,
+		Amount:    amount,
+		Reason:    req.Reason,
+		Note:      req.Note,
+		Reference: reference,
+		Lines:     lines,
+	}
+	if err := tx.Create(refund).Error; err != nil {
+		return nil, nil, err
+	}
+	// RefundedTotal keeps track of partial refunds; the status only says so
+	// while nothing was shipped, as shipped and delivered must stay visible
+	order.RefundedTotal = roundCents(order.RefundedTotal + amount)
+	switch {
+	case order.RefundedTotal >= captured:
+		order.Status = OrderStatusRefunded
+	case order.Status == OrderStatusPaid:
+		order.Status = OrderStatusPartiallyRefunded
+	}
+	if err := tx.Model(order).Select("refunded_total", "status").Updates(order).Error; err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.invoices.issueCreditNote(tx, order, refund); err != nil {
+		return nil, nil, err
+	}
+	return refund, nil, nil
+}
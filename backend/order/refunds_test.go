@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testOrder is an order of two items with a 10.00 discount, 10% tax added on
+// top and 5.00 shipping: 36.00 + 3.60 tax paid for item 1 and 54.00 + 5.40
+// for item 2.
+func testOrder() *Order {
+	order := &Order{
+		Subtotal:      100,
+		DiscountTotal: 10,
+		ShippingCost:  5,
+		TaxTotal:      9,
+		Total:         104,
+		Items: []OrderItem{
+			{ProductID: 11, Quantity: 2, Price: 20, TaxRate: 0.1, TaxAmount: 3.6},
+			{ProductID: 12, Quantity: 2, Price: 30, TaxRate: 0.1, TaxAmount: 5.4},
+		},
+	}
+	order.ID = 1
+	order.Items[0].ID = 1
+	order.Items[1].ID = 2
+	return order
+}
+
+func TestItemPaid(t *testing.T) {
+	order := testOrder()
+	tests := []struct {
+		name  string
+		order *Order
+		item  *OrderItem
+		want  float64
+	}{
+		{name: "discount share plus exclusive tax", order: order, item: &order.Items[0], want: 39.6},
+		{name: "second item", order: order, item: &order.Items[1], want: 59.4},
+		{
+			name:  "inclusive tax is already in the price",
+			order: &Order{Subtotal: 50, ShippingCost: 5, TaxTotal: 8.33, Total: 55},
+			item:  &OrderItem{Quantity: 1, Price: 50, TaxAmount: 8.33},
+			want:  50,
+		},
+		{
+			name:  "no discount and no tax",
+			order: &Order{Subtotal: 30, Total: 30},
+			item:  &OrderItem{Quantity: 3, Price: 10},
+			want:  30,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := itemPaid(tt.order, tt.item); got != tt.want {
+				t.Errorf("paid %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRefundLines(t *testing.T) {
+	no := false
+	tests := []struct {
+		name      string
+		cancelled int
+		req       RefundRequest
+		refunded  map[uint]refundedItem
+		want      []RefundLine
+		wantErr   bool
+	}{
+		{
+			name: "full refund covers every item",
+			req:  RefundRequest{Restock: true},
+			want: []RefundLine{
+				{OrderItemID: 1, ProductID: 11, Quantity: 2, Amount: 39.6, Restock: true},
+				{OrderItemID: 2, ProductID: 12, Quantity: 2, Amount: 59.4, Restock: true},
+			},
+		},
+		{
+			name:     "full refund skips what was refunded",
+			refunded: map[uint]refundedItem{1: {Quantity: 2, Amount: 39.6}},
+			want:     []RefundLine{{OrderItemID: 2, ProductID: 12, Quantity: 2, Amount: 59.4}},
+		},
+		{
+			name: "full refund skips cancelled units",
+			// Item 1 had one of its two units cancelled
+			cancelled: 1,
+			want: []RefundLine{
+				{OrderItemID: 1, ProductID: 11, Quantity: 1, Amount: 19.8},
+				{OrderItemID: 2, ProductID: 12, Quantity: 2, Amount: 59.4},
+			},
+		},
+		{
+			name: "a unit is refunded at what was paid for it",
+			req:  RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 2, Quantity: 1}}},
+			want: []RefundLine{{OrderItemID: 2, ProductID: 12, Quantity: 1, Amount: 29.7}},
+		},
+		{
+			name:     "the last unit takes whatever is left",
+			req:      RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Quantity: 1}}},
+			refunded: map[uint]refundedItem{1: {Quantity: 1, Amount: 19.79}},
+			want:     []RefundLine{{OrderItemID: 1, ProductID: 11, Quantity: 1, Amount: 19.81}},
+		},
+		{
+			name: "an amount without a quantity",
+			req:  RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Amount: 5}}},
+			want: []RefundLine{{OrderItemID: 1, ProductID: 11, Amount: 5}},
+		},
+		{
+			name: "lines override the restock default",
+			req: RefundRequest{Restock: true, Lines: []RefundLineRequest{
+				{OrderItemID: 1, Quantity: 1, Restock: &no},
+				{OrderItemID: 2, Quantity: 1},
+			}},
+			want: []RefundLine{
+				{OrderItemID: 1, ProductID: 11, Quantity: 1, Amount: 19.8},
+				{OrderItemID: 2, ProductID: 12, Quantity: 1, Amount: 29.7, Restock: true},
+			},
+		},
+		{
+			name:     "more units than are left",
+			req:      RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Quantity: 2}}},
+			refunded: map[uint]refundedItem{1: {Quantity: 1, Amount: 19.8}},
+			wantErr:  true,
+		},
+		{
+			name:      "cancelled units cannot be refunded",
+			cancelled: 1,
+			req:       RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Quantity: 2}}},
+			wantErr:   true,
+		},
+		{
+			name:    "more money than was paid",
+			req:     RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Amount: 39.61}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative quantity",
+			req:     RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Quantity: -1}}},
+			wantErr: true,
+		},
+		{
+			name:    "neither quantity nor amount",
+			req:     RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "item listed twice",
+			req:     RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 1, Quantity: 1}, {OrderItemID: 1, Quantity: 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "item of another order",
+			req:     RefundRequest{Lines: []RefundLineRequest{{OrderItemID: 3, Quantity: 1}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testOrder()
+			order.Items[0].CancelledQuantity = tt.cancelled
+			lines, err := buildRefundLines(order, tt.req, tt.refunded)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRefund) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidRefund)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(lines, tt.want) {
+				t.Errorf("lines %+v, want %+v", lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefundCashOnDelivery(t *testing.T) {
+	db := testDB(t)
+	service, upstream := newTestOrderService(t, db)
+	ctx := context.Background()
+	order := createTestOrder(t, db, OrderStatusPending, PaymentMethodCOD)
+
+	if _, err := service.RefundOrder(ctx, order.ID, RefundRequest{Reason: "customer_request"}); !errors.Is(err, ErrInvalidOrderState) {
+		t.Fatalf("refunding an unpaid order: got %v, want %v", err, ErrInvalidOrderState)
+	}
+	if err := service.UpdateOrderStatus(ctx, order.ID, OrderStatusPaid); err != nil {
+		t.Fatalf("failed to mark the order paid: %v", err)
+	}
+	if err := service.UpdateOrderStatus(ctx, order.ID, OrderStatusPaid); !errors.Is(err, ErrInvalidOrderState) {
+		t.Fatalf("marking the order paid twice: got %v, want %v", err, ErrInvalidOrderState)
+	}
+
+	refund, err := service.RefundOrder(ctx, order.ID, RefundRequest{
+		Reason:  "damaged",
+		Restock: true,
+		Lines:   []RefundLineRequest{{OrderItemID: order.Items[0].ID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("failed to refund one unit: %v", err)
+	}
+	if refund.Amount != 19.8 {
+		t.Errorf("refunded %v, want 19.8", refund.Amount)
+	}
+	if got := upstream.Adjusted(order.Items[0].ProductID); got != 1 {
+		t.Errorf("restocked %d, want 1", got)
+	}
+	if _, err := service.RefundOrder(ctx, order.ID, RefundRequest{Reason: "customer_request"}); err != nil {
+		t.Fatalf("failed to refund the rest: %v", err)
+	}
+
+	refunded, err := service.GetOrder(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to load the order: %v", err)
+	}
+	if refunded.Status != OrderStatusRefunded || refunded.RefundedTotal != order.Total {
+		t.Errorf("status %s, refunded %v; want %s, %v", refunded.Status, refunded.RefundedTotal, OrderStatusRefunded, order.Total)
+	}
+	payments, err := service.payments.GetPayments(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to load the payments: %v", err)
+	}
+	var history []string
+	for _, payment := range payments {
+		history = append(history, fmt.Sprintf("%s %s %.2f %s", payment.Provider, payment.Operation, payment.Amount, payment.Status))
+	}
+	want := []string{
+		"cod capture 104.00 succeeded",
+		"cod refund 19.80 succeeded",
+		"cod refund 84.20 succeeded",
+	}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("payments %q, want %q", history, want)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Return statuses. A return is requested by the customer, approved or
+// rejected, received back in the warehouse and finally refunded.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunded  = "refunded"
+)
+
+var (
+	ErrInvalidReturn  = errors.New("invalid return")
+	ErrReturnNotFound = errors.New("return not found")
+)
+
+// OrderReturn is a return merchandise authorization for items of an order.
+// History records every status change.
+type OrderReturn struct {
+	gorm.Model
+	OrderID  uint          `json:"orderId" gorm:"not null;index"`
+	UserID   uint          `json:"userId" gorm:"not null;index"`
+	Status   string        `json:"status" gorm:"not null;default:'requested';index"`
+	Reason   string        `json:"reason" gorm:"not null"`
+	Note     string        `json:"note,omitempty"`
+	RefundID *uint         `json:"refundId,omitempty"`
+	Items    []ReturnItem  `json:"items" gorm:"foreignKey:ReturnID"`
+	History  []ReturnEvent `json:"history" gorm:"foreignKey:ReturnID"`
+}
+
+// ReturnItem is a quantity of an order item being returned.
+type ReturnItem struct {
+	gorm.Model
+	ReturnID    uint `json:"returnId" gorm:"not null;index"`
+	OrderItemID uint `json:"orderItemId" gorm:"not null;index"`
+	ProductID   uint `json:"productId" gorm:"not null"`
+	Quantity    int  `json:"quantity" gorm:"not null"`
+	Restocked   bool `json:"restocked" gorm:"not null;default:false"`
+}
+
+// ReturnEvent is one entry in the history of a return.
+type ReturnEvent struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	ReturnID  uint      `json:"returnId" gorm:"not null;index"`
+	Status    string    `json:"status" gorm:"not null"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReturnItemRequest asks to return quantity units of an order item.
+type ReturnItemRequest struct {
+	OrderItemID uint `json:"orderItemId"`
+	Quantity    int  `json:"quantity"`
+}
+
+// unreturnableStatuses are order statuses in which nothing can be returned,
+// because it was never paid for or has already been given back.
+var unreturnableStatuses = map[string]bool{
+	OrderStatusPending:       true,
+	OrderStatusAuthorized:    true,
+	OrderStatusPaymentFailed: true,
+	OrderStatusCancelled:     true,
+	OrderStatusRefunded:      true,
+}
+
+// openReturnStatuses hold items that are on their way back but not refunded.
+var openReturnStatuses = []string{ReturnRequested, ReturnApproved, ReturnReceived}
+
+// RequestReturn opens a return for delivered items of one of the user's paid
+// orders, within the return window counted from when they were delivered.
+func (s *OrderService) RequestReturn(ctx context.Context, orderID, userID uint, reason, note string, items []ReturnItemRequest) (*OrderReturn, error) {
+	if !refundReasons[reason] {
+		return nil, fmt.Errorf("%w: unknown reason %q", ErrInvalidReturn, reason)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: no items to return", ErrInvalidReturn)
+	}
+
+	var ret *OrderReturn
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if order.UserID != userID {
+			return ErrOrderNotFound
+		}
+		if unreturnableStatuses[order.Status] {
+			return fmt.Errorf("%w: a %s order cannot be returned", ErrInvalidOrderState, order.Status)
+		}
+		// Cash on delivery orders can be delivered before they are paid
+		captured, err := s.payments.capturedAmount(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if captured == 0 {
+			return fmt.Errorf("%w: order %d has not been paid", ErrInvalidOrderState, orderID)
+		}
+		deliveries, err := deliveredShipmentItems(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return fmt.Errorf("%w: nothing of order %d has been delivered yet", ErrInvalidReturn, orderID)
+		}
+		delivered := make(map[uint]int, len(deliveries))
+		for _, delivery := range deliveries {
+			if s.returnWindow > 0 && time.Since(delivery.DeliveredAt) > s.returnWindow {
+				continue
+			}
+			delivered[delivery.OrderItemID] += delivery.Quantity
+		}
+		if len(delivered) == 0 {
+			return fmt.Errorf("%w: the return window of order %d has closed", ErrInvalidReturn, orderID)
+		}
+
+		returnable, err := returnableQuantities(tx, order, delivered)
+		if err != nil {
+			return err
+		}
+		productIDs := make(map[uint]uint, len(order.Items))
+		for _, item := range order.Items {
+			productIDs[item.ID] = item.ProductID
+		}
+
+		ret = &OrderReturn{OrderID: orderID, UserID: userID, Status: ReturnRequested, Reason: reason, Note: note}
+		for _, item := range items {
+			productID, ok := productIDs[item.OrderItemID]
+			switch {
+			case !ok:
+				return fmt.Errorf("%w: order item %d is not part of order %d", ErrInvalidReturn, item.OrderItemID, orderID)
+			case item.Quantity <= 0 || item.Quantity > returnable[item.OrderItemID]:
+				return fmt.Errorf("%w: only %d of order item %d can be returned", ErrInvalidReturn, returnable[item.OrderItemID], item.OrderItemID)
+			}
+			returnable[item.OrderItemID] -= item.Quantity
+			ret.Items = append(ret.Items, ReturnItem{OrderItemID: item.OrderItemID, ProductID: productID, Quantity: item.Quantity})
+		}
+		ret.History = []ReturnEvent{{Status: ReturnRequested, Note: note}}
+		return tx.Create(ret).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// deliveredShipmentItem is a quantity of an order item in a delivered
+// shipment.
+type deliveredShipmentItem struct {
+	OrderItemID uint
+	Quantity    int
+	DeliveredAt time.Time
+}
+
+// deliveredShipmentItems returns the items of the delivered shipments of an
+// order with when they were delivered.
+func deliveredShipmentItems(tx *gorm.DB, orderID uint) ([]deliveredShipmentItem, error) {
+	var items []deliveredShipmentItem
+	err := tx.Model(&ShipmentItem{}).
+		Select("shipment_items.order_item_id, shipment_items.quantity, shipments.delivered_at").
+		Joins("JOIN shipments ON shipments.id = shipment_items.shipment_id").
+		Where("shipments.order_id = ? AND shipments.deleted_at IS NULL AND shipments.status = ?", orderID, ShipmentDelivered).
+		Scan(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// returnableQuantities is, per order item, the quantity out of delivered that
+// is neither cancelled, refunded nor already part of an open return.
+func returnableQuantities(tx *gorm.DB, order *Order, delivered map[uint]int) (map[uint]int, error) {
+	refunded, err := refundedItems(tx, order.ID)
+	if err != nil {
+		return nil, err
+	}
+	var open []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err = tx.Model(&ReturnItem{}).
+		Select("return_items.order_item_id, SUM(return_items.quantity) AS quantity").
+		Joins("JOIN order_returns ON order_returns.id = return_items.return_id").
+		Where("order_returns.order_id = ? AND order_returns.status IN ?", order.ID, openReturnStatuses).
+		Group("return_items.order_item_id").
+		Scan(&open).Error
+	if err != nil {
+		return nil, err
+	}
+
+	returnable := make(map[uint]int, len(order.Items))
+	for i := range order.Items {
+		item := &order.Items[i]
+		returnable[item.ID] = min(openQuantity(item, refunded), delivered[item.ID])
+	}
+	for _, row := range open {
+		returnable[row.OrderItemID] -= row.Quantity
+	}
+	return returnable, nil
+}
+
+// transitionReturn moves a return from one of the from statuses to to and
+// records it in the history.
+func (s *OrderService) transitionReturn(ctx context.Context, returnID uint, from []string, to, note string) (*OrderReturn, error) {
+	var ret OrderReturn
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").First(&ret, returnID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrReturnNotFound
+			}
+			return err
+		}
+		allowed := false
+		for _, status := range from {
+			allowed = allowed || ret.Status == status
+		}
+		if !allowed {
+			return fmt.Errorf("%w: return %d is %s", ErrInvalidOrderState, returnID, ret.Status)
+		}
+		ret.Status = to
+		if err := tx.Model(&ret).Update("status", to).Error; err != nil {
+			return err
+		}
+		return tx.Create(&ReturnEvent{ReturnID: returnID, Status: to, Note: note}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func (s *OrderService) ApproveReturn(ctx context.Context, returnID uint, note string) (*OrderReturn, error) {
+	if _, err := s.transitionReturn(ctx, returnID, []string{ReturnRequested}, ReturnApproved, note); err != nil {
+		return nil, err
+	}
+	return s.GetReturn(ctx, returnID)
+}
+
+func (s *OrderService) RejectReturn(ctx context.Context, returnID uint, note string) (*OrderReturn, error) {
+	if _, err := s.transitionReturn(ctx, returnID, []string{ReturnRequested, ReturnApproved}, ReturnRejected, note); err != nil {
+		return nil, err
+	}
+	return s.GetReturn(ctx, returnID)
+}
+
+// ReceiveReturn marks an approved return as received and refunds it.
+func (s *OrderService) ReceiveReturn(ctx context.Context, returnID uint, note string) (*OrderReturn, error) {
+	if _, err := s.transitionReturn(ctx, returnID, []string{ReturnApproved}, ReturnReceived, note); err != nil {
+		return nil, err
+	}
+	return s.RefundReturn(ctx, returnID)
+}
+
+// RefundReturn refunds the items of a received return and then puts them
+// back into stock. It is run when the return is received and can be retried
+// if that refund failed, so items are only restocked once they are refunded.
+func (s *OrderService) RefundReturn(ctx context.Context, returnID uint) (*OrderReturn, error) {
+	ret, err := s.GetReturn(ctx, returnID)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Status != ReturnReceived {
+		return nil, fmt.Errorf("%w: return %d is %s", ErrInvalidOrderState, returnID, ret.Status)
+	}
+
+	lines := make([]RefundLineRequest, 0, len(ret.Items))
+	for _, item := range ret.Items {
+		lines = append(lines, RefundLineRequest{OrderItemID: item.OrderItemID, Quantity: item.Quantity})
+	}
+	// The return items are restocked below rather than through the refund
+	refund, err := s.RefundOrder(ctx, ret.OrderID, RefundRequest{
+		Reason: ret.Reason,
+		Note:   fmt.Sprintf("Return %d", returnID),
+		Lines:  lines,
+	})
+	if err != nil {
+		event := ReturnEvent{ReturnID: returnID, Status: ReturnReceived, Note: "Refund failed: " + err.Error()}
+		if recordErr := s.db.WithContext(ctx).Create(&event).Error; recordErr != nil {
+			log.Printf("Failed to record refund failure of return %d: %v", returnID, recordErr)
+		}
+		return nil, err
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&OrderReturn{}).Where("id = ?", returnID).
+			Updates(map[string]interface{}{"status": ReturnRefunded, "refund_id": refund.ID}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&ReturnEvent{ReturnID: returnID, Status: ReturnRefunded, Note: fmt.Sprintf("Refund %d", refund.ID)}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range ret.Items {
+		if err := s.products.AdjustStock(ctx, item.ProductID, item.Quantity); err != nil {
+			log.Printf("Failed to restock %d of product %d for return %d: %v", item.Quantity, item.ProductID, returnID, err)
+			continue
+		}
+		if err := s.db.WithContext(ctx).Model(&item).Update("restocked", true).Error; err != nil {
+			log.Printf("Failed to mark return item %d restocked: %v", item.ID, err)
+		}
+	}
+	return s.GetReturn(ctx, returnID)
+}
+
+func (s *OrderService) GetReturn(ctx context.Context, returnID uint) (*OrderReturn, error) {
+	var ret OrderReturn
+	err := s.db.WithContext(ctx).Preload("Items").Preload("History", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(&ret, returnID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrReturnNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// GetOrderReturns returns the returns of an order, oldest first.
+func (s *OrderService) GetOrderReturns(ctx context.Context, orderID uint) ([]OrderReturn, error) {
+	var returns []OrderReturn
+	err := s.db.WithContext(ctx).Preload("Items").Preload("History", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where("order_id = ?", orderID).Order("id").Find(&returns).Error
+	if err != nil {
+		return nil, err
+	}
+	return returns, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// deliverTestOrder stores a delivered shipment of everything in order.
+func deliverTestOrder(t *testing.T, db *gorm.DB, order *Order, deliveredAt time.Time) {
+	t.Helper()
+	shipment := Shipment{OrderID: order.ID, Status: ShipmentDelivered, ShippedAt: &deliveredAt, DeliveredAt: &deliveredAt}
+	for _, item := range order.Items {
+		shipment.Items = append(shipment.Items, ShipmentItem{OrderItemID: item.ID, ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	if err := db.Create(&shipment).Error; err != nil {
+		t.Fatalf("failed to create shipment: %v", err)
+	}
+	if err := db.Model(order).Update("status", OrderStatusDelivered).Error; err != nil {
+		t.Fatalf("failed to mark the order delivered: %v", err)
+	}
+}
+
+func TestRequestReturn(t *testing.T) {
+	tests := []struct {
+		name        string
+		deliveredAt time.Duration
+		unpaid      bool
+		userID      uint
+		items       []ReturnItemRequest
+		wantErr     error
+	}{
+		{name: "delivered units", items: []ReturnItemRequest{{OrderItemID: 0, Quantity: 2}, {OrderItemID: 1, Quantity: 1}}},
+		{name: "unpaid cash on delivery order", unpaid: true, items: []ReturnItemRequest{{OrderItemID: 0, Quantity: 1}}, wantErr: ErrInvalidOrderState},
+		{name: "return window closed", deliveredAt: 31 * 24 * time.Hour, items: []ReturnItemRequest{{OrderItemID: 0, Quantity: 1}}, wantErr: ErrInvalidReturn},
+		{name: "more than was delivered", items: []ReturnItemRequest{{OrderItemID: 0, Quantity: 3}}, wantErr: ErrInvalidReturn},
+		{name: "item listed twice", items: []ReturnItemRequest{{OrderItemID: 0, Quantity: 2}, {OrderItemID: 0, Quantity: 1}}, wantErr: ErrInvalidReturn},
+		{name: "order of another user", userID: 8, items: []ReturnItemRequest{{OrderItemID: 0, Quantity: 1}}, wantErr: ErrOrderNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			service, _ := newTestOrderService(t, db)
+			ctx := context.Background()
+			order := createTestOrder(t, db, OrderStatusPending, PaymentMethodCOD)
+			deliverTestOrder(t, db, order, time.Now().Add(-tt.deliveredAt))
+			if !tt.unpaid {
+				if err := service.UpdateOrderStatus(ctx, order.ID, OrderStatusPaid); err != nil {
+					t.Fatalf("failed to mark the order paid: %v", err)
+				}
+			}
+			userID := order.UserID
+			if tt.userID != 0 {
+				userID = tt.userID
+			}
+			// Items are given by their index in the order
+			items := make([]ReturnItemRequest, len(tt.items))
+			for i, item := range tt.items {
+				items[i] = ReturnItemRequest{OrderItemID: order.Items[item.OrderItemID].ID, Quantity: item.Quantity}
+			}
+
+			ret, err := service.RequestReturn(ctx, order.ID, userID, "damaged", "", items)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ret.Status != ReturnRequested || len(ret.Items) != len(items) {
+				t.Errorf("return %+v", ret)
+			}
+		})
+	}
+}
+
+func TestReceiveReturn(t *testing.T) {
+	db := testDB(t)
+	service, upstream := newTestOrderService(t, db)
+	ctx := context.Background()
+	order := createTestOrder(t, db, OrderStatusPending, PaymentMethodCOD)
+	deliverTestOrder(t, db, order, time.Now())
+	if err := service.UpdateOrderStatus(ctx, order.ID, OrderStatusPaid); err != nil {
+		t.Fatalf("failed to mark the order paid: %v", err)
+	}
+	item := order.Items[0]
+
+	requestApproved := func() *OrderReturn {
+		t.Helper()
+		ret, err := service.RequestReturn(ctx, order.ID, order.UserID, "damaged", "", []ReturnItemRequest{{OrderItemID: item.ID, Quantity: 1}})
+		if err != nil {
+			t.Fatalf("failed to request a return: %v", err)
+		}
+		if _, err := service.ApproveReturn(ctx, ret.ID, ""); err != nil {
+			t.Fatalf("failed to approve the return: %v", err)
+		}
+		return ret
+	}
+
+	// Receiving the goods refunds them and only then restocks them
+	ret, err := service.ReceiveReturn(ctx, requestApproved().ID, "")
+	if err != nil {
+		t.Fatalf("failed to receive the return: %v", err)
+	}
+	if ret.Status != ReturnRefunded || ret.RefundID == nil || !ret.Items[0].Restocked {
+		t.Errorf("status %s, refund %v, restocked %v; want refunded and restocked", ret.Status, ret.RefundID, ret.Items[0].Restocked)
+	}
+	if got := upstream.Adjusted(item.ProductID); got != 1 {
+		t.Errorf("restocked %d, want 1", got)
+	}
+	refunds, err := service.GetRefunds(ctx, order.ID)
+	if err != nil || len(refunds) != 1 || refunds[0].Amount != 19.8 {
+		t.Fatalf("refunds %+v, %v; want one of 19.8", refunds, err)
+	}
+
+	// A refund that fails leaves the goods out of stock until it is retried
+	pending := requestApproved()
+	if _, err := service.RefundOrder(ctx, order.ID, RefundRequest{Reason: "other"}); err != nil {
+		t.Fatalf("failed to refund the rest of the order: %v", err)
+	}
+	if _, err := service.ReceiveReturn(ctx, pending.ID, ""); !errors.Is(err, ErrInvalidRefund) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidRefund)
+	}
+	ret, err = service.GetReturn(ctx, pending.ID)
+	if err != nil {
+		t.Fatalf("failed to load the return: %v", err)
+	}
+	if ret.Status != ReturnReceived || ret.Items[0].Restocked {
+		t.Errorf("status %s, restocked %v; want received and not restocked", ret.Status, ret.Items[0].Restocked)
+	}
+	if got := upstream.Adjusted(item.ProductID); got != 1 {
+		t.Errorf("restocked %d, want 1", got)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Shipment statuses. A shipment is packed (pending), handed to the carrier
+// (shipped), scanned along the way and finally delivered. Exceptions such as
+// a failed delivery attempt can still end in delivery.
+const (
+	ShipmentPending        = "pending"
+	ShipmentShipped        = "shipped"
+	ShipmentInTransit      = "in_transit"
+	ShipmentOutForDelivery = "out_for_delivery"
+	ShipmentException      = "exception"
+	ShipmentDelivered      = "delivered"
+	ShipmentCancelled      = "cancelled"
+)
+
+var ErrShipmentNotFound = errors.New("shipment not found")
+
+// shipmentTransitions lists the statuses a shipment can move to from each
+// status. Carriers report in_transit repeatedly, once per scan.
+var shipmentTransitions = map[string][]string{
+	ShipmentPending:        {ShipmentShipped, ShipmentCancelled},
+	ShipmentShipped:        {ShipmentInTransit, ShipmentOutForDelivery, ShipmentException, ShipmentDelivered},
+	ShipmentInTransit:      {ShipmentInTransit, ShipmentOutForDelivery, ShipmentException, ShipmentDelivered},
+	ShipmentOutForDelivery: {ShipmentInTransit, ShipmentException, ShipmentDelivered},
+	ShipmentException:      {ShipmentInTransit, ShipmentOutForDelivery, ShipmentDelivered},
+}
+
+// shippableStatuses are the order statuses in which items can be put into
+// new shipments: paid for, or cash on delivery.
+var shippableStatuses = map[string]bool{
+	OrderStatusPending:           true,
+	OrderStatusPaid:              true,
+	OrderStatusPartiallyRefunded: true,
+	OrderStatusPartiallyShipped:  true,
+}
+
+// fulfillmentStatuses are the order statuses that shipments move an order
+// out of. Cancelled, refunded and unpaid orders keep their status. Partial
+// refunds only show in the status until items ship; from then on the status
+// follows the shipments and RefundedTotal alone records the refunds, so
+// neither overwrites the other.
+var fulfillmentStatuses = map[string]bool{
+	OrderStatusPending:           true,
+	OrderStatusPaid:              true,
+	OrderStatusPartiallyRefunded: true,
+	OrderStatusPartiallyShipped:  true,
+	OrderStatusShipped:           true,
+	OrderStatusDelivered:         true,
+}
+
+// Shipment is a parcel with some of the items of an order. History records
+// every status event reported for it.
+type Shipment struct {
+	gorm.Model
+	OrderID        uint            `json:"orderId" gorm:"not null;index"`
+	Carrier        string          `json:"carrier" gorm:"not null;default:''"`
+	TrackingNumber string          `json:"trackingNumber" gorm:"not null;default:'';index"`
+	Status         string          `json:"status" gorm:"not null;default:'pending';index"`
+	ShippedAt      *time.Time      `json:"shippedAt,omitempty"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	Items          []ShipmentItem  `json:"items" gorm:"foreignKey:ShipmentID"`
+	History        []ShipmentEvent `json:"history" gorm:"foreignKey:ShipmentID"`
+}
+
+// ShipmentItem is a quantity of an order item in a shipment.
+type ShipmentItem struct {
+	gorm.Model
+	ShipmentID  uint `json:"shipmentId" gorm:"not null;index"`
+	OrderItemID uint `json:"orderItemId" gorm:"not null;index"`
+	ProductID   uint `json:"productId" gorm:"not null"`
+	Quantity    int  `json:"quantity" gorm:"not null"`
+}
+
+// ShipmentEvent is one entry in the history of a shipment, as reported by
+// the carrier or the warehouse.
+type ShipmentEvent struct {
+	ID         uint      `json:"id" gorm:"primarykey"`
+	ShipmentID uint      `json:"shipmentId" gorm:"not null;index"`
+	Status     string    `json:"status" gorm:"not null"`
+	Location   string    `json:"location,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ShipmentItemRequest puts quantity units of an order item into a shipment.
+type ShipmentItemRequest struct {
+	OrderItemID uint `json:"orderItemId"`
+	Quantity    int  `json:"quantity"`
+}
+
+// shipmentQuantities is, per order item, the quantity in shipments with one of
+// statuses.
+func shipmentQuantities(tx *gorm.DB, orderID uint, statuses []string) (map[uint]int, error) {
+	var rows []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err := tx.Model(&ShipmentItem{}).
+		Select("shipment_items.order_item_id, SUM(shipment_items.quantity) AS quantity").
+		Joins("JOIN shipments ON shipments.id = shipment_items.shipment_id").
+		Where("shipments.order_id = ? AND shipments.deleted_at IS NULL AND shipments.status IN ?", orderID, statuses).
+		Group("shipment_items.order_item_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	quantities := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		quantities[row.OrderItemID] = row.Quantity
+	}
+	return quantities, nil
+}
+
+// allocatedQuantities is, per order item, the quantity already put into a
+// shipment that was not cancelled.
+func allocatedQuantities(tx *gorm.DB, orderID uint) (map[uint]int, error) {
+	return shipmentQuantities(tx, orderID, []string{
+		ShipmentPending, ShipmentShipped, ShipmentInTransit, ShipmentOutForDelivery, ShipmentException, ShipmentDelivered,
+	})
+}
+
+// CreateShipment puts items of an order into a new pending shipment, or
+// everything not shipped yet without items. Cancelled quantities and
+// quantities in other shipments cannot be shipped.
+func (s *OrderService) CreateShipment(ctx context.Context, orderID uint, carrier, trackingNumber string, items []ShipmentItemRequest) (*Shipment, error) {
+	var shipment *Shipment
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order, err := lockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+		if !shippableStatuses[order.Status] {
+			return fmt.Errorf("%w: a %s order cannot be shipped", ErrInvalidOrderState, order.Status)
+		}
+		allocated, err := allocatedQuantities(tx, orderID)
+		if err != nil {
+			return err
+		}
+		left := func(item *OrderItem) int {
+			return item.Quantity - item.CancelledQuantity - allocated[item.ID]
+		}
+
+		if len(items) == 0 {
+			for i := range order.Items {
+				if quantity := left(&order.Items[i]); quantity > 0 {
+					items = append(items, ShipmentItemRequest{OrderItemID: order.Items[i].ID, Quantity: quantity})
+				}
+			}
+			if len(items) == 0 {
+				return fmt.Errorf("%w: nothing left to ship", ErrInvalidShipment)
+			}
+		}
+
+		shipment = &Shipment{
+			OrderID:        orderID,
+			Carrier:        strings.TrimSpace(carrier),
+			TrackingNumber: strings.TrimSpace(trackingNumber),
+			Status:         ShipmentPending,
+		}
+		seen := make(map[uint]bool, len(items))
+		for _, request := range items {
+			var item *OrderItem
+			for i := range order.Items {
+				if order.Items[i].ID == request.OrderItemID {
+					item = &order.Items[i]
+				}
+			}
+			if item == nil {
+				return fmt.Errorf("%w: order item %d is not part of order %d", ErrInvalidShipment, request.OrderItemID, orderID)
+			}
+			if seen[item.ID] {
+				return fmt.Errorf("%w: order item %d is listed twice", ErrInvalidShipment, item.ID)
+			}
+			seen[item.ID] = true
+			if request.Quantity <= 0 || request.Quantity > left(item) {
+				return fmt.Errorf("%w: only %d of order item %d can be shipped", ErrInvalidShipment, left(item), item.ID)
+			}
+			shipment.Items = append(shipment.Items, ShipmentItem{
+				OrderItemID: item.ID,
+				ProductID:   item.ProductID,
+				Quantity:    request.Quantity,
+			})
+		}
+		shipment.History = []ShipmentEvent{{Status: ShipmentPending}}
+		return tx.Create(shipment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shipment, nil
+}
+
+// AddShipmentEvent moves a shipment to status, recording where it happened,
+// and derives the status of its order from all of the order's shipments.
+func (s *OrderService) AddShipmentEvent(ctx context.Context, shipmentID uint, status, location, note string) (*Shipment, error) {
+	var shipment Shipment
+	if err := s.db.WithContext(ctx).First(&shipment, shipmentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShipmentNotFound
+		}
+		return nil, err
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The order is locked before the shipment, like everywhere else
+		order, err := lockOrder(tx, shipment.OrderID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&shipment, shipmentID).Error; err != nil {
+			return err
+		}
+		allowed := false
+		for _, next := range shipmentTransitions[shipment.Status] {
+			allowed = allowed || next == status
+		}
+		if !allowed {
+			return fmt.Errorf("%w: shipment %d cannot go from %s to %s", ErrInvalidOrderState, shipmentID, shipment.Status, status)
+		}
+
+		now := time.Now()
+		shipment.Status = status
+		switch status {
+		case ShipmentShipped:
+			shipment.ShippedAt = &now
+		case ShipmentDelivered:
+			shipment.DeliveredAt = &now
+		}
+		if err := tx.Model(&shipment).Select("status", "shipped_at", "delivered_at").Updates(&shipment).Error; err != nil {
+			return err
+		}
+		event := ShipmentEvent{ShipmentID: shipmentID, Status: status, Location: strings.TrimSpace(location), Note: note}
+		if err := tx.Create(&event).Error; err != nil {
+			return err
+		}
+		return updateFulfillmentStatus(tx, order)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetShipment(ctx, shipmentID)
+}
+
+// updateFulfillmentStatus derives the status of an order locked in tx from
+// its shipments: delivered once everything not cancelled was delivered,
+// shipped once it all left the warehouse, and partially shipped before that.
+func updateFulfillmentStatus(tx *gorm.DB, order *Order) error {
+	if !fulfillmentStatuses[order.Status] {
+		return nil
+	}
+	shipped, err := shipmentQuantities(tx, order.ID, []string{
+		ShipmentShipped, ShipmentInTransit, ShipmentOutForDelivery, ShipmentException, ShipmentDelivered,
+	})
+	if err != nil {
+		return err
+	}
+	delivered, err := shipmentQuantities(tx, order.ID, []string{ShipmentDelivered})
+	if err != nil {
+		return err
+	}
+
+	anyShipped, allShipped, allDelivered := false, true, true
+	for _, item := range order.Items {
+		wanted := item.Quantity - item.CancelledQuantity
+		if wanted <= 0 {
+			continue
+		}
+		anyShipped = anyShipped || shipped[item.ID] > 0
+		allShipped = allShipped && shipped[item.ID] >= wanted
+		allDelivered = allDelivered && delivered[item.ID] >= wanted
+	}
+
+	status := order.Status
+	switch {
+	case !anyShipped:
+		return nil
+	case allDelivered:
+		status = OrderStatusDelivered
+	case allShipped:
+		status = OrderStatusShipped
+	default:
+		status = OrderStatusPartiallyShipped
+	}
+	if status == order.Status {
+		return nil
+	}
+	order.Status = status
+	return tx.Model(order).Update("status", status).Error
+}
+
+func (s *OrderService) GetShipment(ctx context.Context, shipmentID uint) (*Shipment, error) {
+	var shipment Shipment
+	err := s.db.WithContext(ctx).Preload("Items").Preload("History", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(&shipment, shipmentID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrShipmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &shipment, nil
+}
+
+// GetShipments returns the shipments of an order, oldest first.
+func (s *OrderService) GetShipments(ctx context.Context, orderID uint) ([]Shipment, error) {
+	var shipments []Shipment
+	err := s.db.WithContext(ctx).Preload("Items").Preload("History", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where("order_id = ?", orderID).Order("id").Find(&shipments).Error
+	if err != nil {
+		return nil, err
+	}
+	return shipments, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	RateTypeFlat     = "flat"
+	RateTypeWeight   = "weight"
+	RateTypeFreeOver = "free_over"
+)
+
+var (
+	ErrShippingUnavailable = errors.New("shipping method is not available for this order")
+	ErrInvalidShipment     = errors.New("invalid shipping request")
+)
+
+// ShipmentRequest describes what is being shipped where. Weight is the total
+// in kilograms and Subtotal the merchandise value after discounts.
+type ShipmentRequest struct {
+	Address  Address
+	Weight   float64
+	Subtotal float64
+}
+
+// ShippingRate is one shipping option offered for a shipment.
+type ShippingRate struct {
+	Method        string  `json:"method"`
+	Label         string  `json:"label"`
+	Cost          float64 `json:"cost"`
+	EstimatedDays int     `json:"estimatedDays,omitempty"`
+}
+
+// RateProvider prices one shipping method. Quote reports false when the
+// method is not offered for the shipment, e.g. outside its countries or
+// below its threshold.
+type RateProvider interface {
+	Method() string
+	Quote(req ShipmentRequest) (ShippingRate, bool)
+}
+
+// rateBase holds what every provider shares: how the method is presented
+// and where it ships.
+type rateBase struct {
+	method        string
+	label         string
+	estimatedDays int
+	countries     map[string]bool
+}
+
+func (b rateBase) Method() string {
+	return b.method
+}
+
+func (b rateBase) ships(address Address) bool {
+	return len(b.countries) == 0 || b.countries[address.Country]
+}
+
+func (b rateBase) rate(cost float64) ShippingRate {
+	return ShippingRate{Method: b.method, Label: b.label, Cost: cost, EstimatedDays: b.estimatedDays}
+}
+
+// FlatRateProvider charges the same amount for every shipment.
+type FlatRateProvider struct {
+	rateBase
+	cost float64
+}
+
+func (p *FlatRateProvider) Quote(req ShipmentRequest) (ShippingRate, bool) {
+	if !p.ships(req.Address) {
+		return ShippingRate{}, false
+	}
+	return p.rate(p.cost), true
+}
+
+// WeightBracket prices shipments up to MaxWeight kilograms. Brackets are in
+// ascending order; a final MaxWeight of zero matches any weight.
+type WeightBracket struct {
+	MaxWeight float64 `json:"maxWeight"`
+	Cost      float64 `json:"cost"`
+}
+
+// WeightTableProvider charges by the first bracket the shipment weight fits.
+// Shipments heavier than every bracket are not offered the method.
+type WeightTableProvider struct {
+	rateBase
+	brackets []WeightBracket
+}
+
+func (p *WeightTableProvider) Quote(req ShipmentRequest) (ShippingRate, bool) {
+	if !p.ships(req.Address) {
+		return ShippingRate{}, false
+	}
+	for _, bracket := range p.brackets {
+		if bracket.MaxWeight == 0 || req.Weight <= bracket.MaxWeight {
+			return p.rate(bracket.Cost), true
+		}
+	}
+	return ShippingRate{}, false
+}
+
+// FreeOverThresholdProvider ships for free once the subtotal reaches the
+// threshold, and is not offered below it.
+type FreeOverThresholdProvider struct {
+	rateBase
+	threshold float64
+}
+
+func (p *FreeOverThresholdProvider) Quote(req ShipmentRequest) (ShippingRate, bool) {
+	if !p.ships(req.Address) || req.Subtotal < p.threshold {
+		return ShippingRate{}, false
+	}
+	return p.rate(0), true
+}
+
+// ShippingMethodConfig is the JSON form of one shipping method in
+// SHIPPING_METHODS. Fields apply according to Type.
+type ShippingMethodConfig struct {
+	Method        string          `json:"method"`
+	Label         string          `json:"label"`
+	Type          string          `json:"type"`
+	EstimatedDays int             `json:"estimatedDays"`
+	Countries     []string        `json:"countries"`
+	Cost          float64         `json:"cost"`
+	Brackets      []WeightBracket `json:"brackets"`
+	Threshold     float64         `json:"threshold"`
+}
+
+// defaultShippingMethods is used when SHIPPING_METHODS is not set.
+var defaultShippingMethods = []ShippingMethodConfig{
+	{Method: "standard", Label: "Standard shipping", Type: RateTypeFlat, EstimatedDays: 5, Cost: 4.99},
+	{Method: "express", Label: "Express shipping", Type: RateTypeWeight, EstimatedDays: 2, Brackets: []WeightBracket{
+		{MaxWeight: 1, Cost: 9.99},
+		{MaxWeight: 5, Cost: 14.99},
+		{MaxWeight: 20, Cost: 24.99},
+	}},
+	{Method: "free", Label: "Free shipping", Type: RateTypeFreeOver, EstimatedDays: 7, Threshold: 50},
+}
+
+// NewRateProvider builds the provider for one configured method.
+func NewRateProvider(config ShippingMethodConfig) (RateProvider, error) {
+	if config.Method == "" {
+		return nil, fmt.Errorf("shipping method name is required")
+	}
+	base := rateBase{
+		method:        config.Method,
+		label:         config.Label,
+		estimatedDays: config.EstimatedDays,
+		countries:     make(map[string]bool, len(config.Countries)),
+	}
+	if base.label == "" {
+		base.label = config.Method
+	}
+	for _, country := range config.Countries {
+		base.countries[strings.ToUpper(country)] = true
+	}
+
+	switch config.Type {
+	case RateTypeFlat:
+		return &FlatRateProvider{rateBase: base, cost: config.Cost}, nil
+	case RateTypeWeight:
+		if len(config.Brackets) == 0 {
+			return nil, fmt.Errorf("shipping method %q needs weight brackets", config.Method)
+		}
+		for i, bracket := range config.Brackets {
+			catchAll := bracket.MaxWeight == 0
+			if catchAll && i != len(config.Brackets)-1 {
+				return nil, fmt.Errorf("shipping method %q has a catch-all bracket before the last", config.Method)
+			}
+			if !catchAll && i > 0 && bracket.MaxWeight <= config.Brackets[i-1].MaxWeight {
+				return nil, fmt.Errorf("shipping method %q needs brackets in ascending weight order", config.Method)
+			}
+		}
+		return &WeightTableProvider{rateBase: base, brackets: config.Brackets}, nil
+	case RateTypeFreeOver:
+		return &FreeOverThresholdProvider{rateBase: base, threshold: config.Threshold}, nil
+	default:
+		return nil, fmt.Errorf("shipping method %q has unknown type %q", config.Method, config.Type)
+	}
+}
+
+// loadRateProviders reads the shipping methods from SHIPPING_METHODS, a JSON
+// array of ShippingMethodConfig, falling back to the defaults.
+func loadRateProviders() ([]RateProvider, error) {
+	configs := defaultShippingMethods
+	if value := os.Getenv("SHIPPING_METHODS"); value != "" {
+		configs = nil
+		if err := json.Unmarshal([]byte(value), &configs); err != nil {
+			return nil, fmt.Errorf("invalid SHIPPING_METHODS: %v", err)
+		}
+	}
+
+	providers := make([]RateProvider, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		provider, err := NewRateProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		if seen[provider.Method()] {
+			return nil, fmt.Errorf("duplicate shipping method %q", provider.Method())
+		}
+		seen[provider.Method()] = true
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// ShippingItem is a product and quantity to be shipped.
+type ShippingItem struct {
+	ProductID uint `json:"productId"`
+	Quantity  int  `json:"quantity"`
+}
+
+type ShippingService struct {
+	providers []RateProvider
+	products  *productClient
+}
+
+func NewShippingService(providers []RateProvider, products *productClient) *ShippingService {
+	return &ShippingService{
+		providers: providers,
+		products:  products,
+	}
+}
+
+// Quote returns the shipping methods available for the items, cheapest
+// first. Weights come from the products service.
+func (s *ShippingService) Quote(ctx context.Context, address Address, items []ShippingItem, subtotal float64) ([]ShippingRate, error) {
+	if err := address.Validate(); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: no items to ship", ErrInvalidShipment)
+	}
+
+	ids := make([]uint, 0, len(items))
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("%w: quantity for product %d must be positive", ErrInvalidShipment, item.ProductID)
+		}
+		ids = append(ids, item.ProductID)
+	}
+	products, err := s.products.GetMany(ctx, ids, false)
+	if err != nil {
+		return nil, err
+	}
+	weight := 0.0
+	for _, item := range items {
+		lookup := products[item.ProductID]
+		if lookup.Err != nil {
+			return nil, fmt.Errorf("product %d: %w", item.ProductID, lookup.Err)
+		}
+		weight += lookup.Product.Weight * float64(item.Quantity)
+	}
+
+	return s.quoteShipment(ShipmentRequest{Address: address, Weight: weight, Subtotal: subtotal}), nil
+}
+
+func (s *ShippingService) quoteShipment(req ShipmentRequest) []ShippingRate {
+	rates := make([]ShippingRate, 0, len(s.providers))
+	for _, provider := range s.providers {
+		if rate, ok := provider.Quote(req); ok {
+			rate.Cost = math.Round(rate.Cost*100) / 100
+			rates = append(rates, rate)
+		}
+	}
+	sort.SliceStable(rates, func(i, j int) bool { return rates[i].Cost < rates[j].Cost })
+	return rates
+}
+
+// QuoteMethod prices a single method for the items, failing with
+// ErrShippingUnavailable if it is not offered.
+func (s *ShippingService) QuoteMethod(ctx context.Context, method string, address Address, items []ShippingItem, subtotal float64) (*ShippingRate, error) {
+	rates, err := s.Quote(ctx, address, items, subtotal)
+	if err != nil {
+		return nil, err
+	}
+	for _, rate := range rates {
+		if rate.Method == method {
+			return &rate, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrShippingUnavailable, method)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRateProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ShippingMethodConfig
+		wantErr bool
+	}{
+		{name: "flat", config: ShippingMethodConfig{Method: "standard", Type: RateTypeFlat, Cost: 5}},
+		{name: "free over", config: ShippingMethodConfig{Method: "free", Type: RateTypeFreeOver, Threshold: 50}},
+		{
+			name: "weight with a catch-all",
+			config: ShippingMethodConfig{Method: "express", Type: RateTypeWeight, Brackets: []WeightBracket{
+				{MaxWeight: 1, Cost: 10}, {MaxWeight: 0, Cost: 30},
+			}},
+		},
+		{name: "no name", config: ShippingMethodConfig{Type: RateTypeFlat}, wantErr: true},
+		{name: "unknown type", config: ShippingMethodConfig{Method: "pigeon", Type: "carrier"}, wantErr: true},
+		{name: "weight without brackets", config: ShippingMethodConfig{Method: "express", Type: RateTypeWeight}, wantErr: true},
+		{
+			name: "catch-all before the last bracket",
+			config: ShippingMethodConfig{Method: "express", Type: RateTypeWeight, Brackets: []WeightBracket{
+				{MaxWeight: 0, Cost: 30}, {MaxWeight: 1, Cost: 10},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "brackets out of order",
+			config: ShippingMethodConfig{Method: "express", Type: RateTypeWeight, Brackets: []WeightBracket{
+				{MaxWeight: 5, Cost: 15}, {MaxWeight: 1, Cost: 10},
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewRateProvider(tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got provider %+v, want an error", provider)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if provider.Method() != tt.config.Method {
+				t.Errorf("method %q, want %q", provider.Method(), tt.config.Method)
+			}
+		})
+	}
+}
+
+func TestLoadRateProviders(t *testing.T) {
+	t.Setenv("SHIPPING_METHODS", "")
+	providers, err := loadRateProviders()
+	if err != nil || len(providers) != len(defaultShippingMethods) {
+		t.Fatalf("%d providers, %v; want the %d defaults", len(providers), err, len(defaultShippingMethods))
+	}
+
+	t.Setenv("SHIPPING_METHODS", `[{"method": "standard", "type": "flat", "cost": 5}, {"method": "standard", "type": "flat", "cost": 6}]`)
+	if _, err := loadRateProviders(); err == nil {
+		t.Error("duplicate methods were accepted")
+	}
+	t.Setenv("SHIPPING_METHODS", `{"method": "standard"}`)
+	if _, err := loadRateProviders(); err == nil {
+		t.Error("invalid JSON was accepted")
+	}
+}
+
+func TestQuoteShipment(t *testing.T) {
+	configs := append([]ShippingMethodConfig{
+		{Method: "domestic", Type: RateTypeFlat, Cost: 2.499, Countries: []string{"us"}},
+	}, defaultShippingMethods...)
+	providers := make([]RateProvider, 0, len(configs))
+	for _, config := range configs {
+		provider, err := NewRateProvider(config)
+		if err != nil {
+			t.Fatalf("failed to build %s: %v", config.Method, err)
+		}
+		providers = append(providers, provider)
+	}
+	service := NewShippingService(providers, nil)
+	us := Address{Country: "US"}
+	de := Address{Country: "DE"}
+
+	tests := []struct {
+		name string
+		req  ShipmentRequest
+		want map[string]float64
+	}{
+		{
+			name: "light and cheap",
+			req:  ShipmentRequest{Address: us, Weight: 0.5, Subtotal: 20},
+			want: map[string]float64{"domestic": 2.5, "standard": 4.99, "express": 9.99},
+		},
+		{
+			name: "free over the threshold",
+			req:  ShipmentRequest{Address: us, Weight: 3, Subtotal: 50},
+			want: map[string]float64{"free": 0, "domestic": 2.5, "standard": 4.99, "express": 14.99},
+		},
+		{
+			name: "too heavy for express",
+			req:  ShipmentRequest{Address: us, Weight: 25, Subtotal: 20},
+			want: map[string]float64{"domestic": 2.5, "standard": 4.99},
+		},
+		{
+			name: "outside the countries of a method",
+			req:  ShipmentRequest{Address: de, Weight: 1, Subtotal: 20},
+			want: map[string]float64{"standard": 4.99, "express": 9.99},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rates := service.quoteShipment(tt.req)
+			got := make(map[string]float64, len(rates))
+			for i, rate := range rates {
+				got[rate.Method] = rate.Cost
+				if i > 0 && rate.Cost < rates[i-1].Cost {
+					t.Errorf("rates %+v are not cheapest first", rates)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rates %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShippingQuote(t *testing.T) {
+	ctx := context.Background()
+	providers, err := loadRateProviders()
+	if err != nil {
+		t.Fatalf("failed to load shipping methods: %v", err)
+	}
+	var requests int32
+	service := NewShippingService(providers, newProductClient(batchServer(t, &requests), time.Minute))
+	address := Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+
+	// Four of product 1 weigh 3 kg
+	rate, err := service.QuoteMethod(ctx, "express", address, []ShippingItem{{ProductID: 1, Quantity: 4}}, 40)
+	if err != nil || rate.Cost != 14.99 {
+		t.Fatalf("rate %+v, %v; want express at 14.99", rate, err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		address Address
+		items   []ShippingItem
+		wantErr error
+	}{
+		{name: "not offered", method: "free", address: address, items: []ShippingItem{{ProductID: 1, Quantity: 1}}, wantErr: ErrShippingUnavailable},
+		{name: "invalid address", method: "standard", address: Address{Country: "US"}, items: []ShippingItem{{ProductID: 1, Quantity: 1}}, wantErr: ErrInvalidAddress},
+		{name: "no items", method: "standard", address: address, wantErr: ErrInvalidShipment},
+		{name: "no quantity", method: "standard", address: address, items: []ShippingItem{{ProductID: 1}}, wantErr: ErrInvalidShipment},
+		{name: "deleted product", method: "standard", address: address, items: []ShippingItem{{ProductID: 2, Quantity: 1}}, wantErr: ErrProductDeleted},
+		{name: "missing product", method: "standard", address: address, items: []ShippingItem{{ProductID: 3, Quantity: 1}}, wantErr: ErrProductNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.QuoteMethod(ctx, tt.method, tt.address, tt.items, 40)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
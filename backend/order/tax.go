@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// DefaultTaxClass is assumed for products that do not name a tax class.
+const DefaultTaxClass = "standard"
+
+var ErrInvalidTaxRule = errors.New("invalid tax rule")
+
+// TaxRule is one tax levied in a jurisdiction. An empty Region applies to the
+// whole country and an empty TaxClass to every product. Rules sharing a Name
+// are alternatives: only the most specific one matching a line applies, so a
+// reduced class or a regional rate can override the country-wide default.
+// Inclusive taxes are already part of catalog prices and are extracted from
+// them; exclusive taxes are added on top.
+type TaxRule struct {
+	gorm.Model
+	Country   string  `json:"country" gorm:"not null;index"`
+	Region    string  `json:"region" gorm:"not null;default:''"`
+	TaxClass  string  `json:"taxClass" gorm:"not null;default:''"`
+	Name      string  `json:"name" gorm:"not null"`
+	Rate      float64 `json:"rate" gorm:"not null"`
+	Inclusive bool    `json:"inclusive" gorm:"not null;default:false"`
+}
+
+// specificity ranks matching rules of the same name; a region match beats a
+// class match, which beats a country-wide rule for all classes.
+func (r *TaxRule) specificity() int {
+	score := 0
+	if r.Region != "" {
+		score += 2
+	}
+	if r.TaxClass != "" {
+		score++
+	}
+	return score
+}
+
+func (r *TaxRule) matches(address Address, taxClass string) bool {
+	return r.Country == address.Country &&
+		(r.Region == "" || r.Region == address.Region) &&
+		(r.TaxClass == "" || r.TaxClass == taxClass)
+}
+
+// OrderTax is one line of the tax breakdown of an order: the total of a
+// named tax across all items.
+type OrderTax struct {
+	gorm.Model
+	OrderID   uint    `json:"orderId" gorm:"not null;index"`
+	Name      string  `json:"name" gorm:"not null"`
+	Rate      float64 `json:"rate" gorm:"not null"`
+	Inclusive bool    `json:"inclusive" gorm:"not null;default:false"`
+	Amount    float64 `json:"amount" gorm:"not null"`
+}
+
+// taxLine is an order line to be taxed. Amount is the line total after its
+// share of the order discounts.
+type taxLine struct {
+	TaxClass string
+	Amount   float64
+}
+
+// lineTax is the tax charged on one taxLine.
+type lineTax struct {
+	Rate   float64
+	Amount float64
+}
+
+// TaxResult is the tax on a set of lines. Exclusive is the part that is not
+// already included in the prices and has to be added to the total.
+type TaxResult struct {
+	Lines     []lineTax
+	Breakdown []OrderTax
+	Total     float64
+	Exclusive float64
+}
+
+type TaxService struct {
+	db *gorm.DB
+}
+
+func NewTaxService(db *gorm.DB) *TaxService {
+	return &TaxService{db: db}
+}
+
+func (s *TaxService) GetRules(ctx context.Context) ([]TaxRule, error) {
+	var rules []TaxRule
+	if err := s.db.WithContext(ctx).Order("country, region, name, tax_class").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SetRules replaces all tax rules.
+func (s *TaxService) SetRules(ctx context.Context, rules []TaxRule) ([]TaxRule, error) {
+	type ruleKey struct{ country, region, class, name string }
+	seen := make(map[ruleKey]bool, len(rules))
+	inclusive := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		rule.ID = 0
+		rule.Country = strings.ToUpper(strings.TrimSpace(rule.Country))
+		rule.Region = strings.ToUpper(strings.TrimSpace(rule.Region))
+		rule.TaxClass = strings.TrimSpace(rule.TaxClass)
+		rule.Name = strings.TrimSpace(rule.Name)
+		switch {
+		case !countryCodePattern.MatchString(rule.Country):
+			return nil, fmt.Errorf("%w: country must be a two-letter ISO code", ErrInvalidTaxRule)
+		case rule.Name == "":
+			return nil, fmt.Errorf("%w: name is required", ErrInvalidTaxRule)
+		case rule.Rate < 0 || rule.Rate > 1:
+			return nil, fmt.Errorf("%w: rate of %q must be between 0 and 1", ErrInvalidTaxRule, rule.Name)
+		}
+		key := ruleKey{rule.Country, rule.Region, rule.TaxClass, rule.Name}
+		if seen[key] {
+			return nil, fmt.Errorf("%w: duplicate rule %q for %s", ErrInvalidTaxRule, rule.Name, rule.Country)
+		}
+		seen[key] = true
+		// Alternatives of one tax must agree on how prices carry it
+		nameKey := rule.Country + "/" + rule.Name
+		if previous, ok := inclusive[nameKey]; ok && previous != rule.Inclusive {
+			return nil, fmt.Errorf("%w: rules for %q in %s mix inclusive and exclusive pricing", ErrInvalidTaxRule, rule.Name, rule.Country)
+		}
+		inclusive[nameKey] = rule.Inclusive
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("1 = 1").Delete(&TaxRule{}).Error; err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		return tx.Create(&rules).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Calculate taxes the lines shipped to address. The rules of the destination
+// country are loaded once and applied per line; amounts are rounded to cents
+// per line and tax.
+func (s *TaxService) Calculate(ctx context.Context, address Address, lines []taxLine) (*TaxResult, error) {
+	var rules []TaxRule
+	if err := s.db.WithContext(ctx).Where("country = ?", address.Country).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return calculateTax(rules, address, lines), nil
+}
+
+func calculateTax(rules []TaxRule, address Address, lines []taxLine) *TaxResult {
+	result := &TaxResult{Lines: make([]lineTax, len(lines))}
+	breakdown := make(map[string]*OrderTax)
+
+	for i, line := range lines {
+		applied := applicableRules(rules, address, line.TaxClass)
+
+		// Inclusive taxes are part of the price, so the net amount is the
+		// price without all of them; every tax is then a share of that net.
+		inclusiveRate := 0.0
+		for _, rule := range applied {
+			if rule.Inclusive {
+				inclusiveRate += rule.Rate
+			}
+		}
+		net := line.Amount / (1 + inclusiveRate)
+
+		for _, rule := range applied {
+			amount := roundCents(net * rule.Rate)
+			result.Lines[i].Rate += rule.Rate
+			result.Lines[i].Amount += amount
+			result.Total += amount
+			if !rule.Inclusive {
+				result.Exclusive += amount
+			}
+
+			entry, ok := breakdown[rule.Name]
+			if !ok {
+				entry = &OrderTax{Name: rule.Name, Rate: rule.Rate, Inclusive: rule.Inclusive}
+				breakdown[rule.Name] = entry
+			}
+			// A tax charged at different rates per class has no single rate
+			if entry.Rate != rule.Rate {
+				entry.Rate = 0
+			}
+			entry.Amount += amount
+		}
+		result.Lines[i].Amount = roundCents(result.Lines[i].Amount)
+	}
+
+	for _, entry := range breakdown {
+		entry.Amount = roundCents(entry.Amount)
+		result.Breakdown = append(result.Breakdown, *entry)
+	}
+	sort.Slice(result.Breakdown, func(i, j int) bool { return result.Breakdown[i].Name < result.Breakdown[j].Name })
+	result.Total = roundCents(result.Total)
+	result.Exclusive = roundCents(result.Exclusive)
+	return result
+}
+
+// applicableRules picks, for every tax name, the most specific rule matching
+// the address and tax class.
+func applicableRules(rules []TaxRule, address Address, taxClass string) []*TaxRule {
+	best := make(map[string]*TaxRule)
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.matches(address, taxClass) {
+			continue
+		}
+		if current, ok := best[rule.Name]; !ok || rule.specificity() > current.specificity() {
+			best[rule.Name] = rule
+		}
+	}
+	applied := make([]*TaxRule, 0, len(best))
+	for _, rule := range best {
+		applied = append(applied, rule)
+	}
+	sort.Slice(applied, func(i, j int) bool { return applied[i].Name < applied[j].Name })
+	return applied
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
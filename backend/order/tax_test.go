@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplicableRules(t *testing.T) {
+	rules := []TaxRule{
+		{Country: "US", Name: "sales", Rate: 0.05},
+		{Country: "US", TaxClass: "reduced", Name: "sales", Rate: 0.02},
+		{Country: "US", Region: "CA", Name: "sales", Rate: 0.07},
+		{Country: "US", Region: "CA", TaxClass: "reduced", Name: "sales", Rate: 0.03},
+		{Country: "US", Region: "NY", Name: "city", Rate: 0.01},
+		{Country: "DE", Name: "vat", Rate: 0.19, Inclusive: true},
+	}
+
+	tests := []struct {
+		name     string
+		address  Address
+		taxClass string
+		want     map[string]float64
+	}{
+		{
+			name:     "country-wide rule for all classes",
+			address:  Address{Country: "US", Region: "TX"},
+			taxClass: "standard",
+			want:     map[string]float64{"sales": 0.05},
+		},
+		{
+			name:     "class beats country-wide",
+			address:  Address{Country: "US", Region: "TX"},
+			taxClass: "reduced",
+			want:     map[string]float64{"sales": 0.02},
+		},
+		{
+			name:     "region beats class",
+			address:  Address{Country: "US", Region: "CA"},
+			taxClass: "standard",
+			want:     map[string]float64{"sales": 0.07},
+		},
+		{
+			name:     "region and class beat region alone",
+			address:  Address{Country: "US", Region: "CA"},
+			taxClass: "reduced",
+			want:     map[string]float64{"sales": 0.03},
+		},
+		{
+			name:     "taxes with different names add up",
+			address:  Address{Country: "US", Region: "NY"},
+			taxClass: "standard",
+			want:     map[string]float64{"city": 0.01, "sales": 0.05},
+		},
+		{
+			name:     "no rules for the country",
+			address:  Address{Country: "FR"},
+			taxClass: "standard",
+			want:     map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]float64{}
+			for _, rule := range applicableRules(rules, tt.address, tt.taxClass) {
+				got[rule.Name] = rule.Rate
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rates %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateTax(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         []TaxRule
+		lines         []taxLine
+		wantLines     []lineTax
+		wantTotal     float64
+		wantExclusive float64
+		wantBreakdown []OrderTax
+	}{
+		{
+			name:          "exclusive tax is added on top",
+			rules:         []TaxRule{{Country: "US", Name: "sales", Rate: 0.1}},
+			lines:         []taxLine{{TaxClass: "standard", Amount: 50}, {TaxClass: "standard", Amount: 25}},
+			wantLines:     []lineTax{{Rate: 0.1, Amount: 5}, {Rate: 0.1, Amount: 2.5}},
+			wantTotal:     7.5,
+			wantExclusive: 7.5,
+			wantBreakdown: []OrderTax{{Name: "sales", Rate: 0.1, Amount: 7.5}},
+		},
+		{
+			name:          "inclusive tax is extracted from the price",
+			rules:         []TaxRule{{Country: "US", Name: "vat", Rate: 0.25, Inclusive: true}},
+			lines:         []taxLine{{TaxClass: "standard", Amount: 125}},
+			wantLines:     []lineTax{{Rate: 0.25, Amount: 25}},
+			wantTotal:     25,
+			wantExclusive: 0,
+			wantBreakdown: []OrderTax{{Name: "vat", Rate: 0.25, Inclusive: true, Amount: 25}},
+		},
+		{
+			name: "a tax charged at several rates has no single rate",
+			rules: []TaxRule{
+				{Country: "US", Name: "sales", Rate: 0.1},
+				{Country: "US", TaxClass: "reduced", Name: "sales", Rate: 0.05},
+			},
+			lines:         []taxLine{{TaxClass: "standard", Amount: 10}, {TaxClass: "reduced", Amount: 10}},
+			wantLines:     []lineTax{{Rate: 0.1, Amount: 1}, {Rate: 0.05, Amount: 0.5}},
+			wantTotal:     1.5,
+			wantExclusive: 1.5,
+			wantBreakdown: []OrderTax{{Name: "sales", Rate: 0, Amount: 1.5}},
+		},
+		{
+			name:          "amounts are rounded to cents per line",
+			rules:         []TaxRule{{Country: "US", Name: "sales", Rate: 0.0825}},
+			lines:         []taxLine{{TaxClass: "standard", Amount: 9.99}, {TaxClass: "standard", Amount: 9.99}},
+			wantLines:     []lineTax{{Rate: 0.0825, Amount: 0.82}, {Rate: 0.0825, Amount: 0.82}},
+			wantTotal:     1.64,
+			wantExclusive: 1.64,
+			wantBreakdown: []OrderTax{{Name: "sales", Rate: 0.0825, Amount: 1.64}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := calculateTax(tt.rules, Address{Country: "US"}, tt.lines)
+			if !reflect.DeepEqual(result.Lines, tt.wantLines) {
+				t.Errorf("lines %+v, want %+v", result.Lines, tt.wantLines)
+			}
+			if result.Total != tt.wantTotal || result.Exclusive != tt.wantExclusive {
+				t.Errorf("total %v, exclusive %v; want %v, %v", result.Total, result.Exclusive, tt.wantTotal, tt.wantExclusive)
+			}
+			if !reflect.DeepEqual(result.Breakdown, tt.wantBreakdown) {
+				t.Errorf("breakdown %+v, want %+v", result.Breakdown, tt.wantBreakdown)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WebhookSignatureHeader carries the signature of a webhook delivery in the
+// form "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">".
+const WebhookSignatureHeader = "X-Payment-Signature"
+
+const (
+	WebhookReceived  = "received"
+	WebhookProcessed = "processed"
+	WebhookIgnored   = "ignored"
+	WebhookFailed    = "failed"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrInvalidWebhook   = errors.New("invalid webhook event")
+	ErrWebhookNotFound  = errors.New("webhook event not found")
+)
+
+// WebhookEvent is a webhook delivery from the payment provider. The raw
+// payload is kept as received so events can be replayed, and the provider's
+// event ID makes repeated deliveries of the same event a no-op.
+type WebhookEvent struct {
+	gorm.Model
+	Provider    string     `json:"provider" gorm:"not null;uniqueIndex:idx_webhook_events_provider_event"`
+	EventID     string     `json:"eventId" gorm:"not null;uniqueIndex:idx_webhook_events_provider_event"`
+	Type        string     `json:"type" gorm:"not null"`
+	Payload     string     `json:"payload" gorm:"type:text;not null"`
+	Status      string     `json:"status" gorm:"not null;default:'received';index"`
+	Error       string     `json:"error,omitempty"`
+	ProcessedAt *time.Time `json:"processedAt,omitempty"`
+}
+
+// paymentEvent is the payload of a provider webhook. Reference is the
+// authorization reference returned by Authorize.
+type paymentEvent struct {
+	ID        string  `json:"id"`
+	Type      string  `json:"type"`
+	Reference string  `json:"reference"`
+	Amount    float64 `json:"amount"`
+	Error     string  `json:"error"`
+}
+
+// webhookTransition moves an order from one of the from statuses to to when
+// an event arrives, recording the payment operation it reports.
+type webhookTransition struct {
+	operation string
+	outcome   string
+	from      []string
+	to        string
+}
+
+var webhookTransitions = map[string]webhookTransition{
+	"payment.captured": {
+		operation: PaymentCapture,
+		outcome:   PaymentSucceeded,
+		from:      []string{OrderStatusAuthorized, OrderStatusPaymentFailed},
+		to:        OrderStatusPaid,
+	},
+	"payment.capture_failed": {
+		operation: PaymentCapture,
+		outcome:   PaymentFailed,
+		from:      []string{OrderStatusAuthorized},
+		to:        OrderStatusPaymentFailed,
+	},
+	// The order cannot be paid any more, but cancelling it is left to
+	// CancelOrder, which returns the stock and records why
+	"payment.voided": {
+		operation: PaymentVoid,
+		outcome:   PaymentSucceeded,
+		from:      []string{OrderStatusAuthorized, OrderStatusPaymentFailed},
+		to:        OrderStatusPaymentFailed,
+	},
+}
+
+func webhookMAC(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhookSignature checks the signature header against body and
+// rejects deliveries signed more than tolerance away from now, which stops
+// old deliveries from being replayed by a third party.
+func verifyWebhookSignature(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	if secret == "" {
+		return fmt.Errorf("%w: no webhook secret is configured", ErrInvalidSignature)
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("%w: malformed %s header", ErrInvalidSignature, WebhookSignatureHeader)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if now.Sub(signedAt) > tolerance || signedAt.Sub(now) > tolerance {
+		return fmt.Errorf("%w: timestamp outside the tolerance", ErrInvalidSignature)
+	}
+
+	expected := webhookMAC(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+}
+
+type WebhookService struct {
+	db        *gorm.DB
+	provider  string
+	secret    string
+	tolerance time.Duration
+	invoices  *InvoiceService
+}
+
+func NewWebhookService(db *gorm.DB, provider, secret string, tolerance time.Duration, invoices *InvoiceService) *WebhookService {
+	return &WebhookService{
+		db:        db,
+		provider:  provider,
+		secret:    secret,
+		tolerance: tolerance,
+		invoices:  invoices,
+	}
+}
+
+// Receive verifies and stores a webhook delivery, then applies it. Deliveries
+// of an event that was already handled are reported as duplicates and not
+// applied again; events that failed are retried on redelivery.
+func (s *WebhookService) Receive(ctx context.Context, signature string, body []byte) (*WebhookEvent, bool, error) {
+	if err := verifyWebhookSignature(s.secret, signature, body, time.Now(), s.tolerance); err != nil {
+		return nil, false, err
+	}
+	var event paymentEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	if event.ID == "" || event.Type == "" {
+		return nil, false, fmt.Errorf("%w: id and type are required", ErrInvalidWebhook)
+	}
+
+	record := WebhookEvent{
+		Provider: s.provider,
+		EventID:  event.ID,
+		Type:     event.Type,
+		Payload:  string(body),
+		Status:   WebhookReceived,
+	}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&record).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if record.ID == 0 {
+		// Already stored by an earlier delivery
+		if err := s.db.WithContext(ctx).Where("provider = ? AND event_id = ?", s.provider, event.ID).First(&record).Error; err != nil {
+			return nil, false, err
+		}
+	}
+	return s.process(ctx, record.ID, false)
+}
+
+// Replay applies a stored event again from its raw payload.
+func (s *WebhookService) Replay(ctx context.Context, id uint) (*WebhookEvent, error) {
+	event, _, err := s.process(ctx, id, true)
+	return event, err
+}
+
+// process applies a stored event with its row locked, so concurrent
+// deliveries of the same event are applied once. Unless force is set, events
+// that were already processed or ignored are left alone.
+func (s *WebhookService) process(ctx context.Context, id uint, force bool) (*WebhookEvent, bool, error) {
+	var record WebhookEvent
+	duplicate := false
+	var applyErr error
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&record, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrWebhookNotFound
+			}
+			return err
+		}
+		if !force && (record.Status == WebhookProcessed || record.Status == WebhookIgnored) {
+			duplicate = true
+			return nil
+		}
+
+		var event paymentEvent
+		if err := json.Unmarshal([]byte(record.Payload), &event); err != nil {
+			applyErr = fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+		} else {
+			// A failed event is recorded without any of its partial changes
+			applyErr = tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				record.Status, err = s.apply(tx, event)
+				return err
+			})
+		}
+		record.Error = ""
+		if applyErr != nil {
+			record.Status = WebhookFailed
+			record.Error = applyErr.Error()
+		}
+		now := time.Now()
+		record.ProcessedAt = &now
+		return tx.Model(&record).Select("status", "error", "processed_at").Updates(&record).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &record, duplicate, applyErr
+}
+
+// apply moves the order the event refers to through the matching
+// transition. Events without a transition, or that do not apply to the
+// current order status, are ignored.
+func (s *WebhookService) apply(tx *gorm.DB, event paymentEvent) (string, error) {
+	transition, ok := webhookTransitions[event.Type]
+	if !ok {
+		return WebhookIgnored, nil
+	}
+
+	var authorization Payment
+	err := tx.Where("reference = ? AND operation = ? AND status = ?", event.Reference, PaymentAuthorize, PaymentSucceeded).
+		First(&authorization).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("%w: %q", ErrUnknownAuthorization, event.Reference)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var order Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Items").First(&order, authorization.OrderID).Error; err != nil {
+		return "", err
+	}
+	allowed := false
+	for _, status := range transition.from {
+		allowed = allowed || order.Status == status
+	}
+	if !allowed {
+		return WebhookIgnored, nil
+	}
+
+	// Without an amount the event covers what is left of the authorization
+	// after cancellations, as Capture would have charged
+	amount := event.Amount
+	if amount == 0 {
+		amount = roundCents(authorization.Amount - order.CancelledTotal)
+	}
+	payment := Payment{
+		OrderID:   order.ID,
+		Provider:  authorization.Provider,
+		Operation: transition.operation,
+		Reference: authorization.Reference,
+		Amount:    amount,
+		Status:    transition.outcome,
+		Error:     event.Error,
+	}
+	if err := tx.Create(&payment).Error; err != nil {
+		return "", err
+	}
+	if err := tx.Model(&order).Update("status", transition.to).Error; err != nil {
+		return "", err
+	}
+	if transition.to == OrderStatusPaid {
+		if _, err := s.invoices.issueInvoice(tx, &order); err != nil {
+			return "", err
+		}
+	}
+	return WebhookProcessed, nil
+}
+
+// GetEvents returns stored webhook events, newest first, optionally only
+// those with status.
+func (s *WebhookService) GetEvents(ctx context.Context, status string, limit int) ([]WebhookEvent, error) {
+	query := s.db.WithContext(ctx).Order("id DESC").Limit(limit)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var events []WebhookEvent
+	if err := query.Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
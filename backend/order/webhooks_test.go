@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	const secret = "whsec"
+	body := []byte(`{"id":"evt_1","type":"payment.captured"}`)
+	now := time.Unix(1700000000, 0)
+	tolerance := 5 * time.Minute
+	sign := func(signedAt time.Time) string {
+		timestamp := fmt.Sprint(signedAt.Unix())
+		return fmt.Sprintf("t=%s,v1=%s", timestamp, webhookMAC(secret, timestamp, body))
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		body    []byte
+		wantErr bool
+	}{
+		{name: "valid", secret: secret, header: sign(now), body: body},
+		{name: "signed just within the tolerance", secret: secret, header: sign(now.Add(-tolerance)), body: body},
+		{name: "clock skew within the tolerance", secret: secret, header: sign(now.Add(tolerance)), body: body},
+		{name: "too old", secret: secret, header: sign(now.Add(-tolerance - time.Second)), body: body, wantErr: true},
+		{name: "too far in the future", secret: secret, header: sign(now.Add(tolerance + time.Second)), body: body, wantErr: true},
+		{
+			name:   "one of several signatures matches",
+			secret: secret,
+			header: fmt.Sprintf("t=%d, v1=deadbeef, v1=%s", now.Unix(), webhookMAC(secret, fmt.Sprint(now.Unix()), body)),
+			body:   body,
+		},
+		{name: "tampered body", secret: secret, header: sign(now), body: []byte(`{"id":"evt_2"}`), wantErr: true},
+		{name: "wrong secret", secret: "other", header: sign(now), body: body, wantErr: true},
+		{name: "no secret configured", secret: "", header: sign(now), body: body, wantErr: true},
+		{name: "missing timestamp", secret: secret, header: "v1=" + webhookMAC(secret, "", body), body: body, wantErr: true},
+		{name: "missing signature", secret: secret, header: fmt.Sprintf("t=%d", now.Unix()), body: body, wantErr: true},
+		{name: "empty header", secret: secret, header: "", body: body, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyWebhookSignature(tt.secret, tt.header, tt.body, now, tolerance)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSignature) {
+					t.Errorf("got %v, want %v", err, ErrInvalidSignature)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebhookCapture(t *testing.T) {
+	const secret = "whsec"
+	tests := []struct {
+		name       string
+		amount     float64
+		wantAmount float64
+	}{
+		{name: "amount of the event", amount: 50, wantAmount: 50},
+		{name: "no amount captures what was not cancelled", wantAmount: 84.2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			ctx := context.Background()
+			order := createTestOrder(t, db, OrderStatusAuthorized, "card")
+			if err := db.Model(order).Update("cancelled_total", 19.8).Error; err != nil {
+				t.Fatalf("failed to cancel part of the order: %v", err)
+			}
+			authorization := Payment{OrderID: order.ID, Provider: "fake", Operation: PaymentAuthorize, Reference: "auth_1", Amount: order.Total, Status: PaymentSucceeded}
+			if err := db.Create(&authorization).Error; err != nil {
+				t.Fatalf("failed to create authorization: %v", err)
+			}
+			service := NewWebhookService(db, "fake", secret, time.Minute, NewInvoiceService(db, InvoiceSeller{Name: "Test Shop"}))
+
+			body := []byte(fmt.Sprintf(`{"id":"evt_1","type":"payment.captured","reference":"auth_1","amount":%v}`, tt.amount))
+			timestamp := fmt.Sprint(time.Now().Unix())
+			signature := fmt.Sprintf("t=%s,v1=%s", timestamp, webhookMAC(secret, timestamp, body))
+			if _, _, err := service.Receive(ctx, signature, body); err != nil {
+				t.Fatalf("failed to receive the event: %v", err)
+			}
+
+			var capture Payment
+			if err := db.Where("order_id = ? AND operation = ?", order.ID, PaymentCapture).First(&capture).Error; err != nil {
+				t.Fatalf("failed to load the capture: %v", err)
+			}
+			if capture.Amount != tt.wantAmount || capture.Status != PaymentSucceeded {
+				t.Errorf("capture %v %s, want %v succeeded", capture.Amount, capture.Status, tt.wantAmount)
+			}
+			var paid Order
+			if err := db.First(&paid, order.ID).Error; err != nil || paid.Status != OrderStatusPaid {
+				t.Errorf("order %s, %v; want paid", paid.Status, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AttributeTypeString  = "string"
+	AttributeTypeNumber  = "number"
+	AttributeTypeBoolean = "boolean"
+)
+
+// Attributes holds the structured attributes of a product as a JSONB column.
+type Attributes map[string]interface{}
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (a *Attributes) Scan(value interface{}) error {
+	return scanJSON(value, a)
+}
+
+// StringList is a list of strings stored as a JSONB array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	return scanJSON(value, l)
+}
+
+func scanJSON(value interface{}, dest interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, dest)
+	case string:
+		return json.Unmarshal([]byte(v), dest)
+	default:
+		return fmt.Errorf("unsupported JSON column type %T", value)
+	}
+}
+
+// AttributeDefinition describes one attribute products in a category may carry.
+// Variant attributes, such as color and size, tell apart the variants of a
+// product and are kept on the order items they were bought as.
+type AttributeDefinition struct {
+	gorm.Model
+	Category      string     `json:"category" gorm:"not null;uniqueIndex:idx_attribute_definitions_category_name"`
+	Name          string     `json:"name" gorm:"not null;uniqueIndex:idx_attribute_definitions_category_name"`
+	Type          string     `json:"type" gorm:"not null"`
+	AllowedValues StringList `json:"allowedValues,omitempty" gorm:"type:jsonb"`
+	Required      bool       `json:"required" gorm:"not null;default:false"`
+	Variant       bool       `json:"variant" gorm:"not null;default:false"`
+}
+
+var ErrInvalidSchema = errors.New("invalid attribute schema")
+
+// GetAttributeSchema returns the attribute definitions for a category.
+func (s *ProductService) GetAttributeSchema(ctx context.Context, category string) ([]AttributeDefinition, error) {
+	var definitions []AttributeDefinition
+	if err := s.db.WithContext(ctx).
+		Where("category = ?", category).
+		Order("name").
+		Find(&definitions).Error; err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
+// SetAttributeSchema replaces the attribute definitions for a category.
+// Existing products are not revalidated.
+func (s *ProductService) SetAttributeSchema(ctx context.Context, category string, definitions []AttributeDefinition) ([]AttributeDefinition, error) {
+	seen := make(map[string]bool, len(definitions))
+	for i := range definitions {
+		def := &definitions[i]
+		if def.Name == "" {
+			return nil, fmt.Errorf("%w: attribute name is required", ErrInvalidSchema)
+		}
+		if seen[def.Name] {
+			return nil, fmt.Errorf("%w: duplicate attribute %q", ErrInvalidSchema, def.Name)
+		}
+		seen[def.Name] = true
+		switch def.Type {
+		case AttributeTypeString:
+		case AttributeTypeNumber, AttributeTypeBoolean:
+			if len(def.AllowedValues) > 0 {
+				return nil, fmt.Errorf("%w: allowedValues is only supported for string attributes", ErrInvalidSchema)
+			}
+		default:
+			return nil, fmt.Errorf("%w: attribute %q has unknown type %q", ErrInvalidSchema, def.Name, def.Type)
+		}
+		def.ID = 0
+		def.Category = category
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("category = ?", category).Delete(&AttributeDefinition{}).Error; err != nil {
+			return err
+		}
+		if len(definitions) == 0 {
+			return nil
+		}
+		return tx.Create(&definitions).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
+// validateAttributes checks a product's attributes against the schema of its
+// category.
+func (s *ProductService) validateAttributes(ctx context.Context, product *Product) error {
+	definitions, err := s.GetAttributeSchema(ctx, product.Category)
+	if err != nil {
+		return err
+	}
+	return checkAttributes(definitions, product)
+}
+
+// checkAttributes checks a product's attributes against definitions: every
+// attribute must be defined, well typed and, for string attributes with
+// allowed values, one of them. Required attributes must be set.
+func checkAttributes(definitions []AttributeDefinition, product *Product) error {
+	byName := make(map[string]AttributeDefinition, len(definitions))
+	for _, def := range definitions {
+		byName[def.Name] = def
+	}
+
+	for name, value := range product.Attributes {
+		def, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%w: attribute %q is not defined for category %q", ErrInvalidProduct, name, product.Category)
+		}
+		if err := checkAttributeValue(def, value); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidProduct, err)
+		}
+	}
+	for _, def := range definitions {
+		if _, ok := product.Attributes[def.Name]; def.Required && !ok {
+			return fmt.Errorf("%w: attribute %q is required", ErrInvalidProduct, def.Name)
+		}
+	}
+	return nil
+}
+
+func checkAttributeValue(def AttributeDefinition, value interface{}) error {
+	switch def.Type {
+	case AttributeTypeString:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("attribute %q must be a string", def.Name)
+		}
+		if len(def.AllowedValues) == 0 {
+			return nil
+		}
+		for _, allowed := range def.AllowedValues {
+			if str == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("attribute %q must be one of %s", def.Name, strings.Join(def.AllowedValues, ", "))
+	case AttributeTypeNumber:
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("attribute %q must be a number", def.Name)
+		}
+	case AttributeTypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("attribute %q must be a boolean", def.Name)
+		}
+	}
+	return nil
+}
+
+// ProductFilter narrows the product listing. Attribute filters match any of
+// the given values for that attribute.
+type ProductFilter struct {
+	Category   string
+	Query      string
+	MinPrice   *float64
+	MaxPrice   *float64
+	Attributes map[string][]string
+}
+
+func (f ProductFilter) scope(db *gorm.DB) *gorm.DB {
+	if f.Category != "" {
+		db = db.Where("products.category = ?", f.Category)
+	}
+	if f.Query != "" {
+		like := "%" + f.Query + "%"
+		db = db.Where("products.name ILIKE ? OR products.description ILIKE ?", like, like)
+	}
+	if f.MinPrice != nil {
+		db = db.Where("products.price >= ?", *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		db = db.Where("products.price <= ?", *f.MaxPrice)
+	}
+	for name, values := range f.Attributes {
+		db = db.Where("products.attributes ->> ? IN ?", name, values)
+	}
+	return db
+}
+
+// Facets maps attribute name to value to the number of matching products.
+type Facets map[string]map[string]int64
+
+// GetFacets counts attribute values across the products matching filter.
+func (s *ProductService) GetFacets(ctx context.Context, filter ProductFilter) (Facets, error) {
+	var rows []struct {
+		Name  string
+		Value string
+		Count int64
+	}
+	if err := s.db.WithContext(ctx).Model(&Product{}).
+		Scopes(filter.scope).
+		Joins("CROSS JOIN LATERAL jsonb_each_text(products.attributes) AS attr").
+		Select("attr.key AS name, attr.value AS value, COUNT(*) AS count").
+		Group("attr.key, attr.value").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	facets := Facets{}
+	for _, row := range rows {
+		if facets[row.Name] == nil {
+			facets[row.Name] = map[string]int64{}
+		}
+		facets[row.Name][row.Value] = row.Count
+	}
+	return facets, nil
+}
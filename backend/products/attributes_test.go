@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckAttributes(t *testing.T) {
+	definitions := []AttributeDefinition{
+		{Name: "color", Type: AttributeTypeString, AllowedValues: StringList{"blue", "red"}, Required: true},
+		{Name: "material", Type: AttributeTypeString},
+		{Name: "size", Type: AttributeTypeNumber},
+		{Name: "organic", Type: AttributeTypeBoolean},
+	}
+
+	tests := []struct {
+		name        string
+		definitions []AttributeDefinition
+		attributes  Attributes
+		wantErr     bool
+	}{
+		{name: "all attributes", attributes: Attributes{"color": "blue", "material": "clay", "size": 42.0, "organic": true}},
+		{name: "only the required ones", attributes: Attributes{"color": "red"}},
+		{name: "value not allowed", attributes: Attributes{"color": "green"}, wantErr: true},
+		{name: "string given a number", attributes: Attributes{"color": "blue", "material": 3.0}, wantErr: true},
+		{name: "number given a string", attributes: Attributes{"color": "blue", "size": "42"}, wantErr: true},
+		{name: "boolean given a string", attributes: Attributes{"color": "blue", "organic": "true"}, wantErr: true},
+		{name: "string given an object", attributes: Attributes{"color": map[string]interface{}{"name": "blue"}}, wantErr: true},
+		{name: "required attribute missing", attributes: Attributes{"material": "clay"}, wantErr: true},
+		{name: "unknown attribute", attributes: Attributes{"color": "blue", "weight": 1.0}, wantErr: true},
+		{name: "category without a schema", definitions: []AttributeDefinition{}, attributes: Attributes{"color": "blue"}, wantErr: true},
+		{name: "no attributes and no schema", definitions: []AttributeDefinition{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defs := definitions
+			if tt.definitions != nil {
+				defs = tt.definitions
+			}
+			err := checkAttributes(defs, &Product{Category: "mugs", Attributes: tt.attributes})
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidProduct) {
+					t.Errorf("got %v, want %v", err, ErrInvalidProduct)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseProductFilter(t *testing.T) {
+	price := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name    string
+		query   string
+		want    ProductFilter
+		wantErr bool
+	}{
+		{name: "no filters", query: "", want: ProductFilter{Attributes: map[string][]string{}}},
+		{
+			name:  "all filters",
+			query: "category=mugs&q=blue&minPrice=5&maxPrice=20.5&attr[color]=blue,red&attr[size]=L",
+			want: ProductFilter{
+				Category:   "mugs",
+				Query:      "blue",
+				MinPrice:   price(5),
+				MaxPrice:   price(20.5),
+				Attributes: map[string][]string{"color": {"blue", "red"}, "size": {"L"}},
+			},
+		},
+		{name: "invalid minimum price", query: "minPrice=cheap", wantErr: true},
+		{name: "empty maximum price", query: "maxPrice=", want: ProductFilter{Attributes: map[string][]string{}}},
+		{name: "maximum price not a number", query: "maxPrice=1e", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/products?"+tt.query, nil)
+			got, err := parseProductFilter(c)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filter %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// createFilterProducts stores products to filter and count facets over.
+func createFilterProducts(t *testing.T, service *ProductService) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := service.SetAttributeSchema(ctx, "mugs", []AttributeDefinition{
+		{Name: "color", Type: AttributeTypeString},
+		{Name: "size", Type: AttributeTypeString},
+	}); err != nil {
+		t.Fatalf("failed to set schema: %v", err)
+	}
+	for _, product := range []*Product{
+		{Name: "Blue Mug", Price: 10, Category: "mugs", Attributes: Attributes{"color": "blue", "size": "L"}},
+		{Name: "Red Mug", Price: 12, Category: "mugs", Attributes: Attributes{"color": "red", "size": "L"}},
+		{Name: "Small Mug", Description: "A blue one", Price: 8, Category: "mugs", Attributes: Attributes{"color": "blue", "size": "S"}},
+		{Name: "Blue Plate", Price: 15, Category: "plates"},
+	} {
+		if err := service.CreateProduct(ctx, product); err != nil {
+			t.Fatalf("failed to create product: %v", err)
+		}
+	}
+}
+
+func TestProductFilter(t *testing.T) {
+	service := NewProductService(testDB(t))
+	createFilterProducts(t, service)
+	price := func(f float64) *float64 { return &f }
+
+	tests := []struct {
+		name   string
+		filter ProductFilter
+		want   []string
+	}{
+		{name: "no filters", want: []string{"Blue Mug", "Blue Plate", "Red Mug", "Small Mug"}},
+		{name: "category", filter: ProductFilter{Category: "mugs"}, want: []string{"Blue Mug", "Red Mug", "Small Mug"}},
+		{name: "name or description, any case", filter: ProductFilter{Query: "BLUE"}, want: []string{"Blue Mug", "Blue Plate", "Small Mug"}},
+		{name: "price range", filter: ProductFilter{MinPrice: price(10), MaxPrice: price(12)}, want: []string{"Blue Mug", "Red Mug"}},
+		{name: "any of the attribute values", filter: ProductFilter{Attributes: map[string][]string{"color": {"red", "green"}}}, want: []string{"Red Mug"}},
+		{
+			name:   "every attribute",
+			filter: ProductFilter{Attributes: map[string][]string{"color": {"blue", "red"}, "size": {"L"}}},
+			want:   []string{"Blue Mug", "Red Mug"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			products, err := service.GetProducts(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			names := []string{}
+			for _, product := range products {
+				names = append(names, product.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("products %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFacets(t *testing.T) {
+	service := NewProductService(testDB(t))
+	createFilterProducts(t, service)
+
+	tests := []struct {
+		name   string
+		filter ProductFilter
+		want   Facets
+	}{
+		{name: "all products", want: Facets{"color": {"blue": 2, "red": 1}, "size": {"L": 2, "S": 1}}},
+		{
+			name:   "matching products only",
+			filter: ProductFilter{Attributes: map[string][]string{"size": {"L"}}},
+			want:   Facets{"color": {"blue": 1, "red": 1}, "size": {"L": 2}},
+		},
+		{name: "nothing matches", filter: ProductFilter{Category: "plates"}, want: Facets{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facets, err := service.GetFacets(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(facets, tt.want) {
+				t.Errorf("facets %v, want %v", facets, tt.want)
+			}
+		})
+	}
+}
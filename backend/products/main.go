@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,12 +23,49 @@ import (
 type Product struct {
 	gorm.Model
 	Name        string  `json:"name" gorm:"not null"`
+	SKU         string  `json:"sku" gorm:"not null;default:'';index"`
 	Description string  `json:"description"`
 	Price       float64 `json:"price" gorm:"not null"`
 	Image       string  `json:"image"`
 	Stock       int     `json:"stock" gorm:"not null"`
+	Category    string  `json:"category" gorm:"index"`
+	Version     uint    `json:"version" gorm:"not null;default:1"`
+
+	// Weight is in kilograms and drives weight-based shipping rates
+	Weight float64 `json:"weight" gorm:"not null;default:0"`
+	// TaxClass selects the tax rules that apply, e.g. standard or reduced
+	TaxClass string `json:"taxClass" gorm:"not null;default:'standard'"`
+
+	// Per-order quantity limits enforced by the cart; zero means no limit
+	MinOrderQuantity int `json:"minOrderQuantity" gorm:"not null;default:0"`
+	MaxPerOrder      int `json:"maxPerOrder" gorm:"not null;default:0"`
+
+	// Attributes are validated against the category's AttributeDefinitions
+	Attributes Attributes `json:"attributes" gorm:"type:jsonb;not null;default:'{}'"`
+
+	// Aggregates over approved reviews, maintained incrementally
+	RatingAverage float64 `json:"ratingAverage" gorm:"not null;default:0"`
+	RatingCount   int     `json:"ratingCount" gorm:"not null;default:0"`
+	RatingTotal   int     `json:"-" gorm:"not null;default:0"`
 }
 
+// models are the tables of the products service.
+var models = []interface{}{&Product{}, &AttributeDefinition{}, &Review{}, &ProductRecommendation{}}
+
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrProductDeleted  = errors.New("product has been deleted")
+	ErrVersionConflict = errors.New("product has been modified")
+	ErrInvalidProduct  = errors.New("invalid product")
+	ErrOutOfStock      = errors.New("not enough stock")
+)
+
+// DefaultTaxClass is used for products that do not name a tax class.
+const DefaultTaxClass = "standard"
+
+// maxBatchSize caps the number of products fetched by one batch request.
+const maxBatchSize = 100
+
 type ProductService struct {
 	db *gorm.DB
 }
@@ -33,39 +74,184 @@ func NewProductService(db *gorm.DB) *ProductService {
 	return &ProductService{db: db}
 }
 
-func (s *ProductService) GetProducts(ctx context.Context) ([]Product, error) {
+func (s *ProductService) GetProducts(ctx context.Context, filter ProductFilter) ([]Product, error) {
 	var products []Product
-	if err := s.db.WithContext(ctx).Find(&products).Error; err != nil {
+	if err := s.db.WithContext(ctx).Scopes(filter.scope).Find(&products).Error; err != nil {
 		return nil, err
 	}
 	return products, nil
 }
 
+// ProductBatch is the result of a batch lookup. Every requested ID appears in
+// exactly one of the three lists.
+type ProductBatch struct {
+	Products []Product `json:"products"`
+	Deleted  []uint    `json:"deleted"`
+	Missing  []uint    `json:"missing"`
+}
+
+// GetProductsByIDs looks up many products in one query.
+func (s *ProductService) GetProductsByIDs(ctx context.Context, ids []uint) (*ProductBatch, error) {
+	var products []Product
+	if err := s.db.WithContext(ctx).Unscoped().Where("id IN ?", ids).Find(&products).Error; err != nil {
+		return nil, err
+	}
+
+	batch := &ProductBatch{Products: []Product{}, Deleted: []uint{}, Missing: []uint{}}
+	found := make(map[uint]bool, len(products))
+	for _, product := range products {
+		found[product.ID] = true
+		if product.DeletedAt.Valid {
+			batch.Deleted = append(batch.Deleted, product.ID)
+			continue
+		}
+		batch.Products = append(batch.Products, product)
+	}
+	for _, id := range ids {
+		if !found[id] {
+			batch.Missing = append(batch.Missing, id)
+			found[id] = true
+		}
+	}
+	return batch, nil
+}
+
+// GetProduct returns a live product. Soft-deleted products yield
+// ErrProductDeleted so callers can tell them apart from unknown IDs.
 func (s *ProductService) GetProduct(ctx context.Context, id uint) (*Product, error) {
 	var product Product
-	if err := s.db.WithContext(ctx).First(&product, id).Error; err != nil {
+	if err := s.db.WithContext(ctx).Unscoped().First(&product, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrProductNotFound
+		}
 		return nil, err
 	}
+	if product.DeletedAt.Valid {
+		return nil, ErrProductDeleted
+	}
 	return &product, nil
 }
 
 func (s *ProductService) CreateProduct(ctx context.Context, product *Product) error {
+	if err := validateProduct(product); err != nil {
+		return err
+	}
+	if err := s.validateAttributes(ctx, product); err != nil {
+		return err
+	}
+	product.Version = 1
 	return s.db.WithContext(ctx).Create(product).Error
 }
 
-func (s *ProductService) UpdateProduct(ctx context.Context, id uint, product *Product) error {
-	return s.db.WithContext(ctx).Model(&Product{}).Where("id = ?", id).Updates(product).Error
+// UpdateProduct replaces the editable fields of a product, including zero
+// values; stock is left to UpdateStock. When expectedVersion is non-zero the
+// update only applies if the stored version still matches, otherwise
+// ErrVersionConflict is returned.
+func (s *ProductService) UpdateProduct(ctx context.Context, id uint, product *Product, expectedVersion uint) (*Product, error) {
+	if err := validateProduct(product); err != nil {
+		return nil, err
+	}
+	if err := s.validateAttributes(ctx, product); err != nil {
+		return nil, err
+	}
+
+	query := s.db.WithContext(ctx).Model(&Product{}).Where("id = ?", id)
+	if expectedVersion != 0 {
+		query = query.Where("version = ?", expectedVersion)
+	}
+	result := query.Updates(map[string]interface{}{
+		"name":               product.Name,
+		"sku":                product.SKU,
+		"description":        product.Description,
+		"price":              product.Price,
+		"image":              product.Image,
+		"weight":             product.Weight,
+		"tax_class":          product.TaxClass,
+		"category":           product.Category,
+		"attributes":         product.Attributes,
+		"min_order_quantity": product.MinOrderQuantity,
+		"max_per_order":      product.MaxPerOrder,
+		"version":            gorm.Expr("version + 1"),
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := s.GetProduct(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrVersionConflict
+	}
+	return s.GetProduct(ctx, id)
+}
+
+// PatchProduct applies a JSON Merge Patch (RFC 7396) to a product. Fields
+// present in the patch are written even when they are zero or empty.
+func (s *ProductService) PatchProduct(ctx context.Context, id uint, patch []byte, expectedVersion uint) (*Product, error) {
+	current, err := s.GetProduct(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return nil, ErrVersionConflict
+	}
+
+	patched, err := applyMergePatch(current, patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProduct, err)
+	}
+	return s.UpdateProduct(ctx, id, patched, current.Version)
 }
 
 func (s *ProductService) DeleteProduct(ctx context.Context, id uint) error {
 	return s.db.WithContext(ctx).Delete(&Product{}, id).Error
 }
 
+func validateProduct(product *Product) error {
+	if product.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidProduct)
+	}
+	product.SKU = strings.TrimSpace(product.SKU)
+	if product.Price < 0 {
+		return fmt.Errorf("%w: price must not be negative", ErrInvalidProduct)
+	}
+	if product.Stock < 0 {
+		return fmt.Errorf("%w: stock must not be negative", ErrInvalidProduct)
+	}
+	if product.TaxClass == "" {
+		product.TaxClass = DefaultTaxClass
+	}
+	if product.Weight < 0 {
+		return fmt.Errorf("%w: weight must not be negative", ErrInvalidProduct)
+	}
+	if product.MinOrderQuantity < 0 || product.MaxPerOrder < 0 {
+		return fmt.Errorf("%w: order quantity limits must not be negative", ErrInvalidProduct)
+	}
+	if product.MaxPerOrder > 0 && product.MinOrderQuantity > product.MaxPerOrder {
+		return fmt.Errorf("%w: minOrderQuantity must not exceed maxPerOrder", ErrInvalidProduct)
+	}
+	return nil
+}
+
+// UpdateStock adds quantity to the stock of a product, or takes it away when
+// negative. Stock never goes below zero.
+// UpdateStock adds quantity to the stock of a product, which may be negative.
+// Stock is not part of the version, so sales and restocks never make an
+// admin's edit of the product fail.
 func (s *ProductService) UpdateStock(ctx context.Context, id uint, quantity int) error {
-	return s.db.WithContext(ctx).Model(&Product{}).
-		Where("id = ?", id).
-		Update("stock", gorm.Expr("stock + ?", quantity)).
-		Error
+	result := s.db.WithContext(ctx).Model(&Product{}).
+		Where("id = ? AND stock + ? >= 0", id, quantity).
+		Update("stock", gorm.Expr("stock + ?", quantity))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := s.GetProduct(ctx, id); err != nil {
+			return err
+		}
+		return ErrOutOfStock
+	}
+	return nil
 }
 
 func main() {
@@ -81,39 +267,99 @@ func main() {
 		" port=" + os.Getenv("DB_PORT") +
 		" sslmode=disable"
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	// TranslateError reports unique violations as gorm.ErrDuplicatedKey
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
 	// Auto-migrate the schema
-	if err := db.AutoMigrate(&Product{}); err != nil {
+	if err := db.AutoMigrate(models...); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
 	// Initialize product service
 	service := NewProductService(db)
+	reviewService := NewReviewService(db, service, os.Getenv("ORDER_SERVICE_URL"))
+	recommendationService := NewRecommendationService(
+		db,
+		service,
+		os.Getenv("ORDER_SERVICE_URL"),
+		getEnvInt("RECOMMENDATIONS_TOP_N", 20),
+	)
 
 	// Initialize Gin router
 	r := gin.Default()
 
 	// API routes
 	r.GET("/api/products", func(c *gin.Context) {
-		products, err := service.GetProducts(c.Request.Context())
+		filter, err := parseProductFilter(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		products, err := service.GetProducts(c.Request.Context(), filter)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
 			return
 		}
-		c.JSON(http.StatusOK, products)
+		if c.Query("facets") != "true" {
+			c.JSON(http.StatusOK, products)
+			return
+		}
+		facets, err := service.GetFacets(c.Request.Context(), filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute facets"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"products": products, "facets": facets})
+	})
+
+	getBatch := func(c *gin.Context, ids []uint) {
+		if len(ids) == 0 || len(ids) > maxBatchSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Between 1 and %d ids per request", maxBatchSize)})
+			return
+		}
+		batch, err := service.GetProductsByIDs(c.Request.Context(), ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch products"})
+			return
+		}
+		c.JSON(http.StatusOK, batch)
+	}
+
+	r.GET("/api/products/batch", func(c *gin.Context) {
+		ids, err := parseIDList(c.Query("ids"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ids"})
+			return
+		}
+		getBatch(c, ids)
+	})
+
+	r.POST("/api/products/batch", func(c *gin.Context) {
+		var input struct {
+			IDs []uint `json:"ids" binding:"required"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		getBatch(c, input.IDs)
 	})
 
 	r.GET("/api/products/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		var product Product
-		if err := db.First(&product, id).Error; err != nil {
+		id := uint(parseUint(c.Param("id")))
+		product, err := service.GetProduct(c.Request.Context(), id)
+		if errors.Is(err, ErrProductDeleted) {
+			c.JSON(http.StatusGone, gin.H{"error": "Product has been deleted"})
+			return
+		}
+		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
+		c.Header("ETag", productETag(product))
 		c.JSON(http.StatusOK, product)
 	})
 
@@ -124,26 +370,77 @@ func main() {
 			return
 		}
 		if err := service.CreateProduct(c.Request.Context(), &product); err != nil {
+			if errors.Is(err, ErrInvalidProduct) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
 			return
 		}
+		c.Header("ETag", productETag(&product))
 		c.JSON(http.StatusCreated, product)
 	})
 
 	r.PUT("/api/products/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		var product Product
-		if err := c.BindJSON(&product); err != nil {
+		id := uint(parseUint(c.Param("id")))
+		expectedVersion, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+		var input Product
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		product, err := service.UpdateProduct(c.Request.Context(), id, &input, expectedVersion)
+		if err != nil {
+			writeProductUpdateError(c, err)
+			return
+		}
+		c.Header("ETag", productETag(product))
+		c.JSON(http.StatusOK, product)
+	})
+
+	r.PATCH("/api/products/:id", func(c *gin.Context) {
+		id := uint(parseUint(c.Param("id")))
+		expectedVersion, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+		patch, err := c.GetRawData()
+		if err != nil || !json.Valid(patch) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 			return
 		}
-		if err := service.UpdateProduct(c.Request.Context(), uint(parseUint(id)), &product); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
+		product, err := service.PatchProduct(c.Request.Context(), id, patch, expectedVersion)
+		if err != nil {
+			writeProductUpdateError(c, err)
 			return
 		}
+		c.Header("ETag", productETag(product))
 		c.JSON(http.StatusOK, product)
 	})
 
+	r.PUT("/api/products/:id/stock", func(c *gin.Context) {
+		id := uint(parseUint(c.Param("id")))
+		quantity, err := strconv.Atoi(c.Query("quantity"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quantity parameter"})
+			return
+		}
+		err = service.UpdateStock(c.Request.Context(), id, quantity)
+		switch {
+		case errors.Is(err, ErrOutOfStock):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrProductNotFound), errors.Is(err, ErrProductDeleted):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update stock"})
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	})
+
 	r.DELETE("/api/products/:id", func(c *gin.Context) {
 		id := c.Param("id")
 		if err := service.DeleteProduct(c.Request.Context(), uint(parseUint(id))); err != nil {
@@ -153,6 +450,170 @@ func main() {
 		c.Status(http.StatusNoContent)
 	})
 
+	r.GET("/api/products/:id/related", func(c *gin.Context) {
+		productID := uint(parseUint(c.Param("id")))
+		limit := int(parseUint(c.DefaultQuery("limit", "10")))
+		if limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		related, err := recommendationService.GetRelated(c.Request.Context(), productID, limit)
+		if errors.Is(err, ErrProductNotFound) || errors.Is(err, ErrProductDeleted) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch related products"})
+			return
+		}
+		c.JSON(http.StatusOK, related)
+	})
+
+	// Attribute schema routes
+	r.GET("/api/categories/:category/attributes", func(c *gin.Context) {
+		definitions, err := service.GetAttributeSchema(c.Request.Context(), c.Param("category"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attribute schema"})
+			return
+		}
+		c.JSON(http.StatusOK, definitions)
+	})
+
+	r.PUT("/api/admin/categories/:category/attributes", func(c *gin.Context) {
+		var definitions []AttributeDefinition
+		if err := c.BindJSON(&definitions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		definitions, err := service.SetAttributeSchema(c.Request.Context(), c.Param("category"), definitions)
+		if errors.Is(err, ErrInvalidSchema) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update attribute schema"})
+			return
+		}
+		c.JSON(http.StatusOK, definitions)
+	})
+
+	// Review routes
+	r.GET("/api/products/:id/reviews", func(c *gin.Context) {
+		productID := uint(parseUint(c.Param("id")))
+		reviews, err := reviewService.GetProductReviews(c.Request.Context(), productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+			return
+		}
+		c.JSON(http.StatusOK, reviews)
+	})
+
+	r.POST("/api/products/:id/reviews", func(c *gin.Context) {
+		productID := uint(parseUint(c.Param("id")))
+		var review Review
+		if err := c.BindJSON(&review); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		if err := reviewService.CreateReview(c.Request.Context(), productID, &review); err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidReview):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, ErrProductNotFound), errors.Is(err, ErrProductDeleted):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			case errors.Is(err, ErrDuplicateReview):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create review"})
+			}
+			return
+		}
+		c.JSON(http.StatusCreated, review)
+	})
+
+	r.GET("/api/admin/reviews", func(c *gin.Context) {
+		status := c.DefaultQuery("status", ReviewStatusPending)
+		reviews, err := reviewService.GetReviewsByStatus(c.Request.Context(), status)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reviews"})
+			return
+		}
+		c.JSON(http.StatusOK, reviews)
+	})
+
+	r.PUT("/api/admin/reviews/:reviewId/status", func(c *gin.Context) {
+		reviewID := uint(parseUint(c.Param("reviewId")))
+		var input struct {
+			Status string `json:"status" binding:"required"`
+		}
+		if err := c.BindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+			return
+		}
+		review, err := reviewService.SetReviewStatus(c.Request.Context(), reviewID, input.Status)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidReview):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, ErrReviewNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update review status"})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, review)
+	})
+
+	// Admin routes for soft-deleted products
+	r.GET("/api/admin/products/trash", func(c *gin.Context) {
+		products, err := service.ListDeletedProducts(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deleted products"})
+			return
+		}
+		c.JSON(http.StatusOK, products)
+	})
+
+	r.POST("/api/admin/products/:id/restore", func(c *gin.Context) {
+		id := uint(parseUint(c.Param("id")))
+		product, err := service.RestoreProduct(c.Request.Context(), id)
+		if errors.Is(err, ErrProductNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Deleted product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore product"})
+			return
+		}
+		c.Header("ETag", productETag(product))
+		c.JSON(http.StatusOK, product)
+	})
+
+	r.DELETE("/api/admin/products/:id/purge", func(c *gin.Context) {
+		id := uint(parseUint(c.Param("id")))
+		err := service.PurgeProduct(c.Request.Context(), id)
+		if errors.Is(err, ErrProductNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Deleted product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge product"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Start background jobs
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go service.RunTrashPurger(
+		jobsCtx,
+		getEnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+		getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+	)
+	go recommendationService.RunRecommender(jobsCtx, getEnvDuration("RECOMMENDATIONS_INTERVAL", time.Hour))
+
 	// Start server
 	srv := &http.Server{
 		Addr:    ":8080",
@@ -169,6 +630,7 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
+	stopJobs()
 
 	// Graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -185,4 +647,133 @@ func parseUint(s string) uint64 {
 		return 0
 	}
 	return result
-} 
\ No newline at end of file
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// parseProductFilter reads listing filters from the query string. Attribute
+// filters use attr[name]=value1,value2.
+func parseProductFilter(c *gin.Context) (ProductFilter, error) {
+	filter := ProductFilter{
+		Category:   c.Query("category"),
+		Query:      c.Query("q"),
+		Attributes: map[string][]string{},
+	}
+	var err error
+	if filter.MinPrice, err = parseOptionalFloat(c.Query("minPrice")); err != nil {
+		return filter, fmt.Errorf("invalid minPrice")
+	}
+	if filter.MaxPrice, err = parseOptionalFloat(c.Query("maxPrice")); err != nil {
+		return filter, fmt.Errorf("invalid maxPrice")
+	}
+	for name, values := range c.QueryMap("attr") {
+		filter.Attributes[name] = strings.Split(values, ",")
+	}
+	return filter, nil
+}
+
+// parseIDList parses a comma separated list of product IDs.
+func parseIDList(value string) ([]uint, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ",")
+	ids := make([]uint, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+func parseOptionalFloat(value string) (*float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func productETag(product *Product) string {
+	return fmt.Sprintf("\"%d\"", product.Version)
+}
+
+// parseIfMatch extracts the expected product version from an If-Match
+// header. "*" yields version 0, which disables the check for clients that
+// deliberately overwrite whatever is stored; handlers reject an absent header.
+func parseIfMatch(header string) (uint, bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return 0, true
+	}
+	header = strings.TrimPrefix(header, "W/")
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(header[1:len(header)-1], 10, 64)
+	if err != nil || version == 0 {
+		return 0, false
+	}
+	return uint(version), true
+}
+
+// requireIfMatch returns the product version expected by the If-Match header
+// of an update, or answers 428 without one and 400 for a malformed one.
+func requireIfMatch(c *gin.Context) (uint, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+		return 0, false
+	}
+	expectedVersion, ok := parseIfMatch(header)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+		return 0, false
+	}
+	return expectedVersion, true
+}
+
+func writeProductUpdateError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrProductNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	case errors.Is(err, ErrProductDeleted):
+		c.JSON(http.StatusGone, gin.H{"error": "Product has been deleted"})
+	case errors.Is(err, ErrVersionConflict):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Product has been modified by another request"})
+	case errors.Is(err, ErrInvalidProduct):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
+	}
+}
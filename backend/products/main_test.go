@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB returns a database for one test: a schema of its own in the database
+// in TEST_DATABASE_URL, given as keyword/value pairs, with the tables
+// migrated and dropped when the test ends. Tests that need a database are
+// skipped without one.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("failed to create schema %s: %v", schema, err)
+	}
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), &gorm.Config{Logger: logger.Discard, TranslateError: true})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("failed to migrate the test database: %v", err)
+	}
+	return db
+}
+
+func TestUpdateProductVersion(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	service := NewProductService(db)
+	product := &Product{Name: "Mug", Price: 10, Stock: 5}
+	if err := service.CreateProduct(ctx, product); err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+
+	// A sale does not change the version an admin is editing
+	if err := service.UpdateStock(ctx, product.ID, -1); err != nil {
+		t.Fatalf("failed to update stock: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		id          uint
+		replace     *Product
+		patch       string
+		version     uint
+		wantErr     error
+		wantVersion uint
+	}{
+		{name: "replace at the current version", replace: &Product{Name: "Cup", Price: 12, Stock: 99}, version: 1, wantVersion: 2},
+		{name: "replace at a stale version", replace: &Product{Name: "Bowl", Price: 12}, version: 1, wantErr: ErrVersionConflict, wantVersion: 2},
+		{name: "patch at a stale version", patch: `{"price": 11}`, version: 1, wantErr: ErrVersionConflict, wantVersion: 2},
+		{name: "patch at the current version", patch: `{"price": 11}`, version: 2, wantVersion: 3},
+		{name: "patch whatever the version", patch: `{"price": 13}`, wantVersion: 4},
+		{name: "unknown product", id: product.ID + 1, patch: `{"price": 13}`, wantErr: ErrProductNotFound, wantVersion: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := product.ID
+			if tt.id != 0 {
+				id = tt.id
+			}
+			var err error
+			if tt.replace != nil {
+				_, err = service.UpdateProduct(ctx, id, tt.replace, tt.version)
+			} else {
+				_, err = service.PatchProduct(ctx, id, []byte(tt.patch), tt.version)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			stored, err := service.GetProduct(ctx, product.ID)
+			if err != nil {
+				t.Fatalf("failed to load product: %v", err)
+			}
+			// Stock only ever changes through UpdateStock
+			if stored.Version != tt.wantVersion || stored.Stock != 4 {
+				t.Errorf("version %d, stock %d; want %d, 4", stored.Version, stored.Stock, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		header     string
+		want       uint
+		wantStatus int
+	}{
+		{name: "version", header: `"3"`, want: 3},
+		{name: "weak version", header: `W/"3"`, want: 3},
+		{name: "any version", header: "*", want: 0},
+		{name: "missing", header: "", wantStatus: http.StatusPreconditionRequired},
+		{name: "not quoted", header: "3", wantStatus: http.StatusBadRequest},
+		{name: "version zero", header: `"0"`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPatch, "/api/products/1", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("If-Match", tt.header)
+			}
+			version, ok := requireIfMatch(c)
+			if ok != (tt.wantStatus == 0) {
+				t.Fatalf("ok %v with status %d", ok, w.Code)
+			}
+			if ok && version != tt.want {
+				t.Errorf("version %d, want %d", version, tt.want)
+			}
+			if !ok && w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeProductUpdateError(c, ErrVersionConflict)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("version conflict answered %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+}
+
+func TestGetProductsByIDs(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	service := NewProductService(db)
+	live := &Product{Name: "Mug", Price: 10, Stock: 5}
+	deleted := &Product{Name: "Cup", Price: 8, Stock: 5}
+	for _, product := range []*Product{live, deleted} {
+		if err := service.CreateProduct(ctx, product); err != nil {
+			t.Fatalf("failed to create product: %v", err)
+		}
+	}
+	if err := service.DeleteProduct(ctx, deleted.ID); err != nil {
+		t.Fatalf("failed to delete product: %v", err)
+	}
+	missing := deleted.ID + 1
+
+	batch, err := service.GetProductsByIDs(ctx, []uint{live.ID, deleted.ID, missing, missing, live.ID})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The cart and order services read these keys
+	data, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got struct {
+		Products []struct {
+			ID uint `json:"ID"`
+		} `json:"products"`
+		Deleted []uint `json:"deleted"`
+		Missing []uint `json:"missing"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Products) != 1 || got.Products[0].ID != live.ID {
+		t.Errorf("products %+v, want only %d", got.Products, live.ID)
+	}
+	if !reflect.DeepEqual(got.Deleted, []uint{deleted.ID}) || !reflect.DeepEqual(got.Missing, []uint{missing}) {
+		t.Errorf("deleted %v and missing %v, want [%d] and [%d]", got.Deleted, got.Missing, deleted.ID, missing)
+	}
+}
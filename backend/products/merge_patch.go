@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// patchableFields lists the product fields a merge patch may touch. Anything
+// else in the patch (id, version, timestamps) is rejected, as is stock, which
+// only changes through relative stock updates.
+var patchableFields = map[string]bool{
+	"name":             true,
+	"sku":              true,
+	"description":      true,
+	"price":            true,
+	"image":            true,
+	"weight":           true,
+	"taxClass":         true,
+	"category":         true,
+	"attributes":       true,
+	"minOrderQuantity": true,
+	"maxPerOrder":      true,
+}
+
+// applyMergePatch returns a copy of product with the JSON Merge Patch applied.
+// A null value resets a field to its zero value.
+func applyMergePatch(product *Product, patch []byte) (*Product, error) {
+	var changes map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, fmt.Errorf("patch must be a JSON object")
+	}
+
+	original, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, err
+	}
+
+	for field, raw := range changes {
+		if !patchableFields[field] {
+			return nil, fmt.Errorf("field %q cannot be patched", field)
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("invalid value for %q", field)
+		}
+		doc[field] = mergeValue(doc[field], value)
+	}
+
+	merged, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var patched Product
+	if err := json.Unmarshal(merged, &patched); err != nil {
+		return nil, fmt.Errorf("patch produces an invalid product: %v", err)
+	}
+	patched.ID = product.ID
+	patched.Version = product.Version
+	return &patched, nil
+}
+
+// mergeValue implements the recursive MergePatch algorithm from RFC 7396.
+func mergeValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergeValue(targetObject[key], value)
+	}
+	return targetObject
+}
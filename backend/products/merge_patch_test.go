@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	original := func() *Product {
+		product := &Product{
+			Name:        "Mug",
+			Description: "Stoneware",
+			Price:       12.5,
+			Stock:       10,
+			Category:    "kitchen",
+			Version:     3,
+			Attributes:  Attributes{"color": "blue", "size": map[string]interface{}{"height": 10.0, "width": 8.0}},
+		}
+		product.ID = 7
+		return product
+	}
+
+	tests := []struct {
+		name    string
+		patch   string
+		check   func(t *testing.T, patched *Product)
+		wantErr bool
+	}{
+		{
+			name:  "changes only the given fields",
+			patch: `{"price": 15, "description": "Porcelain"}`,
+			check: func(t *testing.T, patched *Product) {
+				if patched.Price != 15 || patched.Description != "Porcelain" {
+					t.Errorf("price %v, description %q; want 15, Porcelain", patched.Price, patched.Description)
+				}
+				if patched.Name != "Mug" || patched.Category != "kitchen" {
+					t.Errorf("untouched fields changed: %+v", patched)
+				}
+			},
+		},
+		{
+			name:  "null resets a field",
+			patch: `{"description": null}`,
+			check: func(t *testing.T, patched *Product) {
+				if patched.Description != "" {
+					t.Errorf("description %q, want empty", patched.Description)
+				}
+			},
+		},
+		{
+			name:  "merges nested objects and removes null members",
+			patch: `{"attributes": {"color": null, "material": "clay", "size": {"width": 9}}}`,
+			check: func(t *testing.T, patched *Product) {
+				want := Attributes{"material": "clay", "size": map[string]interface{}{"height": 10.0, "width": 9.0}}
+				if !reflect.DeepEqual(patched.Attributes, want) {
+					t.Errorf("attributes %v, want %v", patched.Attributes, want)
+				}
+			},
+		},
+		{
+			name:  "keeps the ID and version",
+			patch: `{"name": "Cup"}`,
+			check: func(t *testing.T, patched *Product) {
+				if patched.ID != 7 || patched.Version != 3 {
+					t.Errorf("id %d, version %d; want 7, 3", patched.ID, patched.Version)
+				}
+			},
+		},
+		{name: "rejects fields that cannot be patched", patch: `{"version": 9}`, wantErr: true},
+		{name: "rejects the ID", patch: `{"ID": 9}`, wantErr: true},
+		{name: "rejects stock, which only changes through stock updates", patch: `{"stock": 4}`, wantErr: true},
+		{name: "rejects a patch that is not an object", patch: `[1]`, wantErr: true},
+		{name: "rejects values of the wrong type", patch: `{"price": "free"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product := original()
+			patched, err := applyMergePatch(product, []byte(tt.patch))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", patched)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, patched)
+			if !reflect.DeepEqual(product, original()) {
+				t.Errorf("the original product was modified: %+v", product)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ProductRecommendation is a precomputed "frequently bought together" entry.
+type ProductRecommendation struct {
+	ProductID        uint      `json:"productId" gorm:"primaryKey"`
+	RelatedProductID uint      `json:"relatedProductId" gorm:"primaryKey"`
+	Score            int64     `json:"score" gorm:"not null"`
+	ComputedAt       time.Time `json:"computedAt" gorm:"not null"`
+}
+
+type RelatedProducts struct {
+	FrequentlyBoughtTogether []Product `json:"frequentlyBoughtTogether"`
+	SameCategory             []Product `json:"sameCategory"`
+}
+
+type RecommendationService struct {
+	db        *gorm.DB
+	products  *ProductService
+	ordersURL string
+	topN      int
+}
+
+func NewRecommendationService(db *gorm.DB, products *ProductService, ordersURL string, topN int) *RecommendationService {
+	return &RecommendationService{
+		db:        db,
+		products:  products,
+		ordersURL: ordersURL,
+		topN:      topN,
+	}
+}
+
+// GetRelated combines co-purchased products with other products from the
+// same category. Out-of-stock and deleted products are never suggested.
+func (s *RecommendationService) GetRelated(ctx context.Context, productID uint, limit int) (*RelatedProducts, error) {
+	product, err := s.products.GetProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	related := &RelatedProducts{
+		FrequentlyBoughtTogether: []Product{},
+		SameCategory:             []Product{},
+	}
+	if err := s.db.WithContext(ctx).
+		Joins("JOIN product_recommendations r ON r.related_product_id = products.id").
+		Where("r.product_id = ? AND products.stock > 0", productID).
+		Order("r.score DESC").
+		Limit(limit).
+		Find(&related.FrequentlyBoughtTogether).Error; err != nil {
+		return nil, err
+	}
+
+	if product.Category == "" {
+		return related, nil
+	}
+
+	exclude := []uint{productID}
+	for _, p := range related.FrequentlyBoughtTogether {
+		exclude = append(exclude, p.ID)
+	}
+	if err := s.db.WithContext(ctx).
+		Where("category = ? AND stock > 0 AND id NOT IN ?", product.Category, exclude).
+		Order("rating_average DESC, id").
+		Limit(limit).
+		Find(&related.SameCategory).Error; err != nil {
+		return nil, err
+	}
+	return related, nil
+}
+
+// Refresh replaces the stored recommendations with fresh co-purchase counts
+// from the order service.
+func (s *RecommendationService) Refresh(ctx context.Context) (int, error) {
+	pairs, err := s.fetchCoPurchases(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	recommendations := make([]ProductRecommendation, 0, len(pairs))
+	for _, pair := range pairs {
+		recommendations = append(recommendations, ProductRecommendation{
+			ProductID:        pair.ProductID,
+			RelatedProductID: pair.RelatedProductID,
+			Score:            pair.Count,
+			ComputedAt:       now,
+		})
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&ProductRecommendation{}).Error; err != nil {
+			return err
+		}
+		if len(recommendations) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(recommendations, 500).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(recommendations), nil
+}
+
+// RunRecommender refreshes recommendations immediately and then on every
+// interval. It returns when ctx is cancelled.
+func (s *RecommendationService) RunRecommender(ctx context.Context, interval time.Duration) {
+	if s.ordersURL == "" {
+		log.Printf("Warning: ORDER_SERVICE_URL not set, recommendations disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if count, err := s.Refresh(ctx); err != nil {
+			log.Printf("Failed to refresh recommendations: %v", err)
+		} else {
+			log.Printf("Refreshed %d product recommendations", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type coPurchase struct {
+	ProductID        uint  `json:"productId"`
+	RelatedProductID uint  `json:"relatedProductId"`
+	Count            int64 `json:"count"`
+}
+
+func (s *RecommendationService) fetchCoPurchases(ctx context.Context) ([]coPurchase, error) {
+	url := fmt.Sprintf("%s/api/orders/stats/co-purchases?top=%d", s.ordersURL, s.topN)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch co-purchases: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch co-purchases: unexpected status %d", resp.StatusCode)
+	}
+
+	var pairs []coPurchase
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, fmt.Errorf("failed to decode co-purchases: %v", err)
+	}
+	return pairs, nil
+}
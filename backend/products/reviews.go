@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ReviewStatusPending  = "pending"
+	ReviewStatusApproved = "approved"
+	ReviewStatusRejected = "rejected"
+)
+
+type Review struct {
+	gorm.Model
+	ProductID        uint   `json:"productId" gorm:"not null;uniqueIndex:idx_reviews_product_user"`
+	UserID           uint   `json:"userId" gorm:"not null;uniqueIndex:idx_reviews_product_user"`
+	Rating           int    `json:"rating" gorm:"not null"`
+	Title            string `json:"title"`
+	Body             string `json:"body"`
+	VerifiedPurchase bool   `json:"verifiedPurchase" gorm:"not null;default:false"`
+	Status           string `json:"status" gorm:"not null;default:'pending';index"`
+}
+
+var (
+	ErrReviewNotFound  = errors.New("review not found")
+	ErrDuplicateReview = errors.New("user has already reviewed this product")
+	ErrInvalidReview   = errors.New("invalid review")
+)
+
+type ReviewService struct {
+	db        *gorm.DB
+	products  *ProductService
+	ordersURL string
+}
+
+func NewReviewService(db *gorm.DB, products *ProductService, ordersURL string) *ReviewService {
+	return &ReviewService{
+		db:        db,
+		products:  products,
+		ordersURL: ordersURL,
+	}
+}
+
+// CreateReview stores a new review awaiting moderation. Reviews only count
+// towards the product rating once approved.
+func (s *ReviewService) CreateReview(ctx context.Context, productID uint, review *Review) error {
+	if review.UserID == 0 {
+		return fmt.Errorf("%w: userId is required", ErrInvalidReview)
+	}
+	if review.Rating < 1 || review.Rating > 5 {
+		return fmt.Errorf("%w: rating must be between 1 and 5", ErrInvalidReview)
+	}
+	if _, err := s.products.GetProduct(ctx, productID); err != nil {
+		return err
+	}
+
+	var existing int64
+	if err := s.db.WithContext(ctx).Model(&Review{}).
+		Where("product_id = ? AND user_id = ?", productID, review.UserID).
+		Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrDuplicateReview
+	}
+
+	verified, err := s.hasDeliveredOrder(ctx, review.UserID, productID)
+	if err != nil {
+		log.Printf("Failed to verify purchase for user %d product %d: %v", review.UserID, productID, err)
+	}
+
+	review.ID = 0
+	review.ProductID = productID
+	review.VerifiedPurchase = verified
+	review.Status = ReviewStatusPending
+	// The count above misses a review created concurrently, which the unique
+	// index on product and user turns away
+	if err := s.db.WithContext(ctx).Create(review).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrDuplicateReview
+		}
+		return err
+	}
+	return nil
+}
+
+// GetProductReviews returns the approved reviews for a product.
+func (s *ReviewService) GetProductReviews(ctx context.Context, productID uint) ([]Review, error) {
+	var reviews []Review
+	if err := s.db.WithContext(ctx).
+		Where("product_id = ? AND status = ?", productID, ReviewStatusApproved).
+		Order("created_at DESC").
+		Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// GetReviewsByStatus returns reviews in the given moderation status, oldest first.
+func (s *ReviewService) GetReviewsByStatus(ctx context.Context, status string) ([]Review, error) {
+	var reviews []Review
+	if err := s.db.WithContext(ctx).
+		Where("status = ?", status).
+		Order("created_at ASC").
+		Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// SetReviewStatus moves a review through moderation and keeps the product's
+// rating aggregate in step with the set of approved reviews.
+func (s *ReviewService) SetReviewStatus(ctx context.Context, reviewID uint, status string) (*Review, error) {
+	if !isValidReviewStatus(status) {
+		return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidReview, status)
+	}
+
+	var review Review
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&review, reviewID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrReviewNotFound
+			}
+			return err
+		}
+		if review.Status == status {
+			return nil
+		}
+
+		delta := 0
+		if review.Status == ReviewStatusApproved {
+			delta--
+		}
+		if status == ReviewStatusApproved {
+			delta++
+		}
+
+		if err := tx.Model(&review).Update("status", status).Error; err != nil {
+			return err
+		}
+		if delta == 0 {
+			return nil
+		}
+		return applyRatingDelta(tx, review.ProductID, delta, delta*review.Rating)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// applyRatingDelta adjusts the stored rating aggregate of a product without
+// rescanning its reviews.
+func applyRatingDelta(tx *gorm.DB, productID uint, count, total int) error {
+	return tx.Unscoped().Model(&Product{}).
+		Where("id = ?", productID).
+		Updates(map[string]interface{}{
+			"rating_count": gorm.Expr("rating_count + ?", count),
+			"rating_total": gorm.Expr("rating_total + ?", total),
+			"rating_average": gorm.Expr(
+				"CASE WHEN rating_count + ? > 0 THEN (rating_total + ?)::numeric / (rating_count + ?) ELSE 0 END",
+				count, total, count,
+			),
+		}).Error
+}
+
+func isValidReviewStatus(status string) bool {
+	switch status {
+	case ReviewStatusPending, ReviewStatusApproved, ReviewStatusRejected:
+		return true
+	}
+	return false
+}
+
+// hasDeliveredOrder asks the order service whether the user has a delivered
+// order containing the product, going through the pages of the user's
+// delivered orders.
+func (s *ReviewService) hasDeliveredOrder(ctx context.Context, userID, productID uint) (bool, error) {
+	if s.ordersURL == "" {
+		return false, nil
+	}
+
+	cursor := ""
+	for {
+		query := url.Values{"status": {"delivered"}, "include": {"items"}, "limit": {"100"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+		ordersURL := fmt.Sprintf("%s/api/orders/user/%d?%s", s.ordersURL, userID, query.Encode())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ordersURL, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return false, fmt.Errorf("unexpected status %d from order service", resp.StatusCode)
+		}
+
+		var orders []struct {
+			Status string `json:"status"`
+			Items  []struct {
+				ProductID uint `json:"productId"`
+			} `json:"items"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&orders)
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+
+		for _, order := range orders {
+			if order.Status != "delivered" {
+				continue
+			}
+			for _, item := range order.Items {
+				if item.ProductID == productID {
+					return true, nil
+				}
+			}
+		}
+
+		// The order service returns the cursor of the next page in a header
+		cursor = resp.Header.Get("X-Next-Cursor")
+		if cursor == "" {
+			return false, nil
+		}
+	}
+}
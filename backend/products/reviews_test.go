@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestCreateReview(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	products := NewProductService(db)
+	reviews := NewReviewService(db, products, "")
+	product := &Product{Name: "Mug", Price: 10, Stock: 5}
+	if err := db.Create(product).Error; err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+	if err := reviews.CreateReview(ctx, product.ID, &Review{UserID: 1, Rating: 5}); err != nil {
+		t.Fatalf("failed to create review: %v", err)
+	}
+	// A deleted review is not counted but still holds the unique index, as
+	// one created concurrently would
+	deleted := &Review{ProductID: product.ID, UserID: 2, Rating: 4}
+	if err := db.Create(deleted).Error; err != nil {
+		t.Fatalf("failed to create review: %v", err)
+	}
+	if err := db.Delete(deleted).Error; err != nil {
+		t.Fatalf("failed to delete review: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		productID uint
+		review    Review
+		wantErr   error
+	}{
+		{name: "another user", productID: product.ID, review: Review{UserID: 3, Rating: 4}},
+		{name: "second review of a user", productID: product.ID, review: Review{UserID: 1, Rating: 1}, wantErr: ErrDuplicateReview},
+		{name: "unique index", productID: product.ID, review: Review{UserID: 2, Rating: 1}, wantErr: ErrDuplicateReview},
+		{name: "rating out of range", productID: product.ID, review: Review{UserID: 4, Rating: 6}, wantErr: ErrInvalidReview},
+		{name: "no user", productID: product.ID, review: Review{Rating: 3}, wantErr: ErrInvalidReview},
+		{name: "unknown product", productID: product.ID + 1, review: Review{UserID: 4, Rating: 3}, wantErr: ErrProductNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			review := tt.review
+			err := reviews.CreateReview(ctx, tt.productID, &review)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (review.Status != ReviewStatusPending || review.ProductID != tt.productID) {
+				t.Errorf("review %+v, want pending for product %d", review, tt.productID)
+			}
+		})
+	}
+}
+
+func TestCreateReviewConcurrently(t *testing.T) {
+	db := testDB(t)
+	reviews := NewReviewService(db, NewProductService(db), "")
+	product := &Product{Name: "Mug", Price: 10, Stock: 5}
+	if err := db.Create(product).Error; err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+
+	const attempts = 8
+	errs := make([]error, attempts)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = reviews.CreateReview(context.Background(), product.ID, &Review{UserID: 1, Rating: 5})
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrDuplicateReview):
+			t.Errorf("got %v, want %v", err, ErrDuplicateReview)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d reviews created, want 1", created)
+	}
+}
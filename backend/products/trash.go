@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListDeletedProducts returns soft-deleted products, most recently deleted first.
+func (s *ProductService) ListDeletedProducts(ctx context.Context) ([]Product, error) {
+	var products []Product
+	if err := s.db.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").
+		Find(&products).Error; err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// RestoreProduct brings a soft-deleted product back into the catalog.
+func (s *ProductService) RestoreProduct(ctx context.Context, id uint) (*Product, error) {
+	result := s.db.WithContext(ctx).Unscoped().Model(&Product{}).
+		Where("id = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"version":    gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrProductNotFound
+	}
+	return s.GetProduct(ctx, id)
+}
+
+// PurgeProduct permanently removes a product that is already in the trash,
+// along with its reviews and recommendations.
+func (s *ProductService) PurgeProduct(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		purged, err := purgeProducts(tx, "id = ?", id)
+		if err != nil {
+			return err
+		}
+		if purged == 0 {
+			return ErrProductNotFound
+		}
+		return nil
+	})
+}
+
+// PurgeDeletedBefore permanently removes products soft-deleted before cutoff,
+// along with their reviews and recommendations.
+func (s *ProductService) PurgeDeletedBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	var purged int64
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		purged, err = purgeProducts(tx, "deleted_at < ?", cutoff)
+		return err
+	})
+	return purged, err
+}
+
+// purgeProducts hard-deletes the trashed products matching query in tx and the
+// rows that refer to them, so nothing is left pointing at a missing product.
+func purgeProducts(tx *gorm.DB, query string, args ...interface{}) (int64, error) {
+	var ids []uint
+	if err := tx.Unscoped().Model(&Product{}).
+		Where("deleted_at IS NOT NULL").
+		Where(query, args...).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if err := tx.Unscoped().Where("product_id IN ?", ids).Delete(&Review{}).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Where("product_id IN ? OR related_product_id IN ?", ids, ids).Delete(&ProductRecommendation{}).Error; err != nil {
+		return 0, err
+	}
+	result := tx.Unscoped().Where("id IN ?", ids).Delete(&Product{})
+	return result.RowsAffected, result.Error
+}
+
+// RunTrashPurger periodically purges products that have been in the trash
+// longer than retention. It returns when ctx is cancelled.
+func (s *ProductService) RunTrashPurger(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.PurgeDeletedBefore(ctx, time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Failed to purge deleted products: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d deleted products", purged)
+			}
+		}
+	}
+}